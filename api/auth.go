@@ -0,0 +1,129 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	db_handler "chat.app/db"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type TokenVerifier interface {
+	// Returns the Firebase uid (users.authId) the token was issued for and
+	// when the token expires
+	Verify(ctx context.Context, token string) (string, time.Time, error)
+}
+
+// Accepts any non empty token and uses it as the uid. Only meant for tests
+// and local development, never use it in production.
+type LocalTokenVerifier struct{}
+
+func (LocalTokenVerifier) Verify(ctx context.Context, token string) (string, time.Time, error) {
+	if token == "" {
+		return "", time.Time{}, errors.New("empty token")
+	}
+	return token, time.Now().Add(time.Hour), nil
+}
+
+// Optionally implemented by verifiers that can tell whether a previously
+// valid token was revoked, used to drop long lived WebSocket connections
+type RevocationChecker interface {
+	Revoked(ctx context.Context, token string) (bool, error)
+}
+
+var verifier TokenVerifier
+
+func SetTokenVerifier(v TokenVerifier) {
+	verifier = v
+}
+
+// Routes callable with a valid token by users that don't have a users record yet
+var unregisteredRoutes = []string{
+	"/sign-in",
+	"/get-user-id",
+}
+
+type contextKey int
+
+const (
+	authIdKey contextKey = iota
+	userKey
+)
+
+var errUnauthorized = errors.New("unauthorized")
+
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+// Verifies the request token and returns a context carrying the caller's
+// authId and, when registered, the caller's user record.
+func authenticate(r *http.Request) (context.Context, error) {
+	token := bearerToken(r)
+	if token == "" || verifier == nil {
+		return nil, errUnauthorized
+	}
+	authId, _, err := verifier.Verify(r.Context(), token)
+	if err != nil {
+		return nil, errUnauthorized
+	}
+
+	ctx := context.WithValue(r.Context(), authIdKey, authId)
+	user, err := db_handler.Storage().GetUserByAuthId(ctx, authId)
+	if err == nil {
+		ctx = context.WithValue(ctx, userKey, user)
+	} else if !errors.Is(err, db_handler.ErrNotFound) {
+		return nil, err
+	}
+	if user == nil && !contains(unregisteredRoutes, r.URL.Path) {
+		return nil, errUnauthorized
+	}
+	return ctx, nil
+}
+
+// Verifies a token for a registered user, returns the user and when the token
+// expires. Used by the WebSocket endpoint which has no route middleware.
+func authenticateToken(ctx context.Context, token string) (*User, time.Time, error) {
+	if token == "" || verifier == nil {
+		return nil, time.Time{}, errUnauthorized
+	}
+	authId, expires, err := verifier.Verify(ctx, token)
+	if err != nil {
+		return nil, time.Time{}, errUnauthorized
+	}
+	user, err := db_handler.Storage().GetUserByAuthId(ctx, authId)
+	if err != nil {
+		return nil, time.Time{}, errUnauthorized
+	}
+	return user, expires, nil
+}
+
+func callerAuthId(r *http.Request) string {
+	authId, _ := r.Context().Value(authIdKey).(string)
+	return authId
+}
+
+// Authenticated user, nil on routes that allow unregistered callers
+func callerUser(r *http.Request) *User {
+	user, _ := r.Context().Value(userKey).(*User)
+	return user
+}
+
+// Resolves the id a request acts on behalf of. Ids sent in the body are only
+// accepted when empty or equal to the caller, otherwise a 403 is written.
+func authorize(w http.ResponseWriter, r *http.Request, claimed primitive.ObjectID) (primitive.ObjectID, bool) {
+	user := callerUser(r)
+	if user == nil || (!claimed.IsZero() && claimed != user.Id) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write(responseError("forbidden"))
+		return primitive.NilObjectID, false
+	}
+	return user.Id, true
+}
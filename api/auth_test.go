@@ -0,0 +1,183 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	db_handler "chat.app/db"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Runs the test on an empty MemoryStore with LocalTokenVerifier, where the
+// bearer token is the caller's authId
+func useTestStore(t *testing.T) {
+	t.Helper()
+	previousStore, previousVerifier := db_handler.Storage(), verifier
+	db_handler.SetStorage(db_handler.NewMemoryStore())
+	SetTokenVerifier(LocalTokenVerifier{})
+	t.Cleanup(func() {
+		db_handler.SetStorage(previousStore)
+		SetTokenVerifier(previousVerifier)
+	})
+}
+
+func createTestUser(t *testing.T, name string) *User {
+	t.Helper()
+	user := &User{
+		Id:     primitive.NewObjectID(),
+		AuthId: name + "-uid",
+		Email:  name + "@example.com",
+		Name:   name,
+	}
+	if err := db_handler.Storage().CreateUser(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// Calls the route through routeHandler, as the server does, from the allowed
+// origin. An empty authorization sends no header.
+func callRoute(t *testing.T, route AppRoute, authorization string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, route.Path, bytes.NewReader(data))
+	r.Header.Set("Origin", origins[0])
+	if authorization != "" {
+		r.Header.Set("Authorization", authorization)
+	}
+	w := httptest.NewRecorder()
+	routeHandler(route)(w, r)
+	return w
+}
+
+func TestAuthenticate(t *testing.T) {
+	useTestStore(t)
+	alice := createTestUser(t, "alice")
+	route := AppRoute{"/get-user-id", getUserId}
+
+	tests := []struct {
+		name          string
+		authorization string
+		status        int
+	}{
+		{"missing token", "", http.StatusUnauthorized},
+		{"empty token", "Bearer ", http.StatusUnauthorized},
+		{"not a bearer token", "Basic " + alice.AuthId, http.StatusUnauthorized},
+		{"valid token", "Bearer " + alice.AuthId, http.StatusOK},
+		{"scheme in another case", "bearer " + alice.AuthId, http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := callRoute(t, route, test.authorization, struct{}{})
+			if w.Code != test.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, test.status, w.Body)
+			}
+		})
+	}
+
+	var user User
+	w := callRoute(t, route, "Bearer "+alice.AuthId, struct{}{})
+	if err := json.Unmarshal(w.Body.Bytes(), &user); err != nil || user.Id != alice.Id {
+		t.Fatalf("authenticated as %+v, %v, want alice", user, err)
+	}
+}
+
+func TestAuthenticateUnregistered(t *testing.T) {
+	useTestStore(t)
+
+	// A valid token of someone without a users record only reaches sign-in
+	w := callRoute(t, AppRoute{"/get-user-contacts", getUserContacts}, "Bearer newcomer", struct{}{})
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("unregistered caller got %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	w = callRoute(t, AppRoute{"/sign-in", signIn}, "Bearer newcomer", map[string]string{"email": "new@example.com"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("sign-in = %d: %s", w.Code, w.Body)
+	}
+	w = callRoute(t, AppRoute{"/get-user-contacts", getUserContacts}, "Bearer newcomer", struct{}{})
+	if w.Code != http.StatusOK {
+		t.Fatalf("after signing in got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestSignInClaimedAuthId(t *testing.T) {
+	useTestStore(t)
+	w := callRoute(t, AppRoute{"/sign-in", signIn}, "Bearer newcomer", map[string]string{"authId": "someone-else"})
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("sign-in as another uid = %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+// Concurrent first sign-ins of the same uid all get the same account
+func TestSignInRace(t *testing.T) {
+	useTestStore(t)
+	var wg sync.WaitGroup
+	ids := make(chan primitive.ObjectID, 8)
+	for i := 0; i < cap(ids); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := callRoute(t, AppRoute{"/sign-in", signIn}, "Bearer racer", struct{}{})
+			var user User
+			if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &user) != nil {
+				t.Errorf("sign-in = %d: %s", w.Code, w.Body)
+			}
+			ids <- user.Id
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	user, err := db_handler.Storage().GetUserByAuthId(context.Background(), "racer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := range ids {
+		if id != user.Id {
+			t.Fatalf("sign-in returned %s, the account is %s", id.Hex(), user.Id.Hex())
+		}
+	}
+}
+
+// Ids in the body must be the caller's own or left empty
+func TestAuthorize(t *testing.T) {
+	useTestStore(t)
+	alice := createTestUser(t, "alice")
+	bob := createTestUser(t, "bob")
+	token := "Bearer " + alice.AuthId
+
+	tests := []struct {
+		name   string
+		route  AppRoute
+		body   interface{}
+		status int
+	}{
+		{"own id", AppRoute{"/get-user-contacts", getUserContacts}, map[string]interface{}{"_id": alice.Id}, http.StatusOK},
+		{"no id", AppRoute{"/get-user-contacts", getUserContacts}, struct{}{}, http.StatusOK},
+		{"another user's id", AppRoute{"/get-user-contacts", getUserContacts}, map[string]interface{}{"_id": bob.Id}, http.StatusForbidden},
+		{"sending as another user", AppRoute{"/send-friend-request", sendFriendRequest}, map[string]interface{}{"from": bob.Id, "to": alice.Id}, http.StatusForbidden},
+		{"accepting for another user", AppRoute{"/accept-friend-request", acceptFriendRequest}, map[string]interface{}{"from": alice.Id, "to": bob.Id}, http.StatusForbidden},
+		{"updating another user", AppRoute{"/update", updateUser}, map[string]interface{}{"_id": bob.Id, "prop": "name", "value": "mallory"}, http.StatusForbidden},
+		{"another user's authId", AppRoute{"/get-user-id", getUserId}, map[string]interface{}{"authId": bob.AuthId}, http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := callRoute(t, test.route, token, test.body)
+			if w.Code != test.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, test.status, w.Body)
+			}
+		})
+	}
+
+	if user, err := db_handler.Storage().GetUser(context.Background(), bob.Id); err != nil || user.Name != "bob" {
+		t.Fatalf("bob after rejected requests = %+v, %v", user, err)
+	}
+}
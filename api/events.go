@@ -0,0 +1,131 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	db_handler "chat.app/db"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// How long events stay available to resume/sync
+var eventRetention = time.Hour * time.Duration(24*7)
+
+// Largest batch of events returned by one resume frame or sync call
+const maxSyncEvents = 100
+
+var eventRoutes = []AppRoute{
+	{"/sync", syncEvents},
+}
+
+// Records the envelope in the user's event log, so clients that miss it can
+// catch up with resume or /sync, then delivers it to the user's connections.
+// Returns whether any connection got it.
+func publish(ctx context.Context, user primitive.ObjectID, envelope Envelope) bool {
+	return publishEvent(ctx, user, envelope, nil)
+}
+
+// Same for events about a message: they're kept no longer than the message,
+// go with the conversation's older events when its retention shortens and
+// with the message when it's deleted for everyone
+func publishAbout(ctx context.Context, user primitive.ObjectID, message *Message, envelope Envelope) bool {
+	return publishEvent(ctx, user, envelope, message)
+}
+
+func publishEvent(ctx context.Context, user primitive.ObjectID, envelope Envelope, message *Message) bool {
+	id, err := primitive.ObjectIDFromHex(envelope.Id)
+	if err != nil {
+		id = primitive.NewObjectID()
+		envelope.Id = id.Hex()
+	}
+	event := &db_handler.Event{
+		Id:        id,
+		User:      user,
+		Type:      envelope.Type,
+		Timestamp: envelope.Timestamp,
+		Payload:   envelope.Payload,
+		ExpireAt:  time.Now().Add(eventRetention),
+	}
+	if message != nil {
+		event.ConversationId = message.ConversationId
+		event.MessageId = message.Id
+		if message.ExpireAt != nil && message.ExpireAt.Before(event.ExpireAt) {
+			event.ExpireAt = *message.ExpireAt
+		}
+	}
+	if err = db_handler.Storage().AppendEvent(ctx, event); err != nil {
+		log.Printf("error: %v", err)
+	}
+	envelope.Seq = event.Seq
+	return hub.Send(user.Hex(), envelope)
+}
+
+// Events of the user after the given sequence number or, for clients that
+// only kept it, envelope id, oldest first, and whether there are more to fetch
+func eventsAfter(ctx context.Context, user primitive.ObjectID, afterSeq int64, after string, limit int64) ([]Envelope, bool, error) {
+	if limit <= 0 || limit > maxSyncEvents {
+		limit = maxSyncEvents
+	}
+	if afterSeq == 0 && after != "" {
+		afterId, err := primitive.ObjectIDFromHex(after)
+		if err != nil {
+			return nil, false, err
+		}
+		if afterSeq, err = db_handler.Storage().EventSeqAt(ctx, user, afterId); err != nil {
+			return nil, false, err
+		}
+	}
+
+	// One extra event tells whether another page exists
+	events, err := db_handler.Storage().GetEvents(ctx, user, afterSeq, limit+1)
+	if err != nil {
+		return nil, false, err
+	}
+	hasMore := int64(len(events)) > limit
+	if hasMore {
+		events = events[:limit]
+	}
+	envelopes := make([]Envelope, 0, len(events))
+	for _, event := range events {
+		envelopes = append(envelopes, Envelope{
+			Type:      event.Type,
+			Id:        event.Id.Hex(),
+			Seq:       event.Seq,
+			Timestamp: event.Timestamp,
+			Payload:   event.Payload,
+		})
+	}
+	return envelopes, hasMore, nil
+}
+
+func syncEvents(w http.ResponseWriter, r *http.Request) {
+	type BodyStruct = struct {
+		AfterSeq int64  `json:"afterSeq"`
+		After    string `json:"after"`
+		Limit    int64  `json:"limit"`
+	}
+	var body BodyStruct
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Bad request"))
+		return
+	}
+
+	events, hasMore, err := eventsAfter(r.Context(), callerUser(r).Id, body.AfterSeq, body.After, body.Limit)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Unable to get"))
+		return
+	}
+	json_data, json_error := json.Marshal(&ResumedPayload{Events: events, HasMore: hasMore})
+	if json_error != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Bad data"))
+		return
+	}
+	w.Write(json_data)
+}
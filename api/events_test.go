@@ -0,0 +1,155 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	db_handler "chat.app/db"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestSyncEvents(t *testing.T) {
+	useTestStore(t)
+	alice := createTestUser(t, "alice")
+	var published []Envelope
+	for i := 0; i < 3; i++ {
+		envelope := newEnvelope(EventMessage, i)
+		publish(context.Background(), alice.Id, envelope)
+		published = append(published, envelope)
+	}
+	route := AppRoute{"/sync", syncEvents}
+
+	tests := []struct {
+		name  string
+		body  map[string]interface{}
+		first int
+	}{
+		{"everything", map[string]interface{}{}, 0},
+		{"after a seq", map[string]interface{}{"afterSeq": 1}, 1},
+		{"after an id", map[string]interface{}{"after": published[1].Id}, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := callRoute(t, route, "Bearer "+alice.AuthId, test.body)
+			var resumed ResumedPayload
+			if err := json.Unmarshal(w.Body.Bytes(), &resumed); w.Code != http.StatusOK || err != nil {
+				t.Fatalf("sync = %d: %s", w.Code, w.Body)
+			}
+			if len(resumed.Events) != len(published)-test.first {
+				t.Fatalf("got %d events, want %d", len(resumed.Events), len(published)-test.first)
+			}
+			for i, event := range resumed.Events {
+				if event.Id != published[test.first+i].Id || event.Seq != int64(test.first+i+1) {
+					t.Fatalf("event %d is %s with seq %d", i, event.Id, event.Seq)
+				}
+			}
+		})
+	}
+}
+
+// Events about a message go no later than the message
+func TestPublishAboutExpiringMessage(t *testing.T) {
+	useTestStore(t)
+	alice := createTestUser(t, "alice")
+	expireAt := time.Now().Add(time.Hour)
+	message := &Message{Id: primitive.NewObjectID(), ConversationId: primitive.NewObjectID(), ExpireAt: &expireAt}
+	publishAbout(context.Background(), alice.Id, message, newEnvelope(EventMessage, message))
+	publish(context.Background(), alice.Id, newEnvelope(EventRequestReceived, struct{}{}))
+
+	events, err := db_handler.Storage().GetEvents(context.Background(), alice.Id, 0, 0)
+	if err != nil || len(events) != 2 {
+		t.Fatalf("GetEvents = %d events, %v", len(events), err)
+	}
+	if !events[0].ExpireAt.Equal(expireAt) || events[0].ConversationId != message.ConversationId {
+		t.Fatalf("message event expires at %v in %s, want %v in %s", events[0].ExpireAt, events[0].ConversationId.Hex(), expireAt, message.ConversationId.Hex())
+	}
+	if events[1].ExpireAt.Before(time.Now().Add(eventRetention - time.Minute)) {
+		t.Fatalf("other event expires at %v", events[1].ExpireAt)
+	}
+}
+
+// Shortening the retention drops the message events it would have expired
+func TestSetRetentionPurgesEvents(t *testing.T) {
+	useTestStore(t)
+	alice, bob := createTestUser(t, "alice"), createTestUser(t, "bob")
+	makeContacts(t, alice, bob)
+	ctx := context.Background()
+	conversation, err := db_handler.Storage().EnsureDirectConversation(ctx, alice.Id, bob.Id, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := &db_handler.Event{
+		Id:             primitive.NewObjectID(),
+		User:           bob.Id,
+		Type:           EventMessage,
+		Timestamp:      time.Now().Add(-48 * time.Hour).UnixMilli(),
+		ExpireAt:       time.Now().Add(time.Hour),
+		ConversationId: conversation.Id,
+	}
+	if err = db_handler.Storage().AppendEvent(ctx, old); err != nil {
+		t.Fatal(err)
+	}
+
+	w := callRoute(t, AppRoute{"/set-retention", setRetention}, "Bearer "+alice.AuthId, map[string]interface{}{
+		"with":   bob.Id,
+		"policy": RetentionDay,
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("set-retention = %d: %s", w.Code, w.Body)
+	}
+	if types := eventTypes(t, bob.Id); len(types) != 1 || types[0] != EventRetentionChanged {
+		t.Fatalf("bob's events = %v, want only %s", types, EventRetentionChanged)
+	}
+}
+
+// Deleting a message for everyone takes the events holding its text along
+func TestDeleteMessagePurgesEvents(t *testing.T) {
+	useTestStore(t)
+	alice, bob := createTestUser(t, "alice"), createTestUser(t, "bob")
+	makeContacts(t, alice, bob)
+	w := callRoute(t, AppRoute{"/save-message", saveMessage}, "Bearer "+alice.AuthId, map[string]interface{}{
+		"to":      bob.Id,
+		"message": "meet me at noon",
+	})
+	var message Message
+	if err := json.Unmarshal(w.Body.Bytes(), &message); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("save-message = %d: %s", w.Code, w.Body)
+	}
+
+	w = callRoute(t, AppRoute{"/delete-message", deleteMessage}, "Bearer "+alice.AuthId, map[string]interface{}{
+		"_id":         message.Id,
+		"forEveryone": true,
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("delete-message = %d: %s", w.Code, w.Body)
+	}
+	for _, user := range []*User{alice, bob} {
+		w = callRoute(t, AppRoute{"/sync", syncEvents}, "Bearer "+user.AuthId, map[string]interface{}{})
+		if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "meet me at noon") {
+			t.Fatalf("%s's sync = %d: %s", user.Name, w.Code, w.Body)
+		}
+		if types := eventTypes(t, user.Id); len(types) != 1 || types[0] != EventMessageDeleted {
+			t.Fatalf("%s's events = %v, want only %s", user.Name, types, EventMessageDeleted)
+		}
+	}
+}
+
+// Retention can't be used to start a conversation with a stranger
+func TestSetRetentionWithStranger(t *testing.T) {
+	useTestStore(t)
+	alice, mallory := createTestUser(t, "alice"), createTestUser(t, "mallory")
+	w := callRoute(t, AppRoute{"/set-retention", setRetention}, "Bearer "+mallory.AuthId, map[string]interface{}{
+		"with":   alice.Id,
+		"policy": RetentionDay,
+	})
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("set-retention with a stranger = %d: %s", w.Code, w.Body)
+	}
+	if _, err := db_handler.Storage().GetDirectConversation(context.Background(), mallory.Id, alice.Id); err == nil {
+		t.Fatal("conversation started with a stranger")
+	}
+}
@@ -0,0 +1,403 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	blob_store "chat.app/blob-store"
+	db_handler "chat.app/db"
+	image_processing "chat.app/image-processing"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type Attachment = db_handler.Attachment
+type AttachmentRef = db_handler.AttachmentRef
+
+var attachmentRoutes = []AppRoute{
+	{"/upload-attachment", uploadAttachment},
+	{"/get-attachment", getAttachment},
+}
+
+// Largest file accepted for each kind of attachment, in bytes
+const (
+	maxImageSize      = 10 << 20
+	maxAudioSize      = 16 << 20
+	maxAttachmentSize = 25 << 20
+)
+
+const (
+	maxAttachmentsPerMessage = 10
+	maxAttachmentNameLength  = 255
+)
+
+func attachmentLimit(mimeType string) int64 {
+	switch {
+	case strings.HasPrefix(mimeType, "image/"):
+		return maxImageSize
+	case strings.HasPrefix(mimeType, "audio/"):
+		return maxAudioSize
+	}
+	return maxAttachmentSize
+}
+
+// Types browsers may show inline, anything else is always downloaded so an
+// uploaded page or script never runs on our origin
+func isInlineType(mimeType string) bool {
+	if mimeType == "image/svg+xml" {
+		return false
+	}
+	return strings.HasPrefix(mimeType, "image/") || strings.HasPrefix(mimeType, "audio/") || strings.HasPrefix(mimeType, "video/")
+}
+
+// File name without any directory, control characters or excess length
+func cleanAttachmentName(name string) string {
+	if i := strings.LastIndexAny(name, `/\`); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	if runes := []rune(name); len(runes) > maxAttachmentNameLength {
+		name = string(runes[:maxAttachmentNameLength])
+	}
+	return strings.TrimSpace(name)
+}
+
+func attachmentKey(attachment *Attachment) string {
+	return attachment.ConversationId.Hex() + "/" + attachment.Id.Hex()
+}
+
+func variantKey(attachment *Attachment, name string) string {
+	return attachment.Key + "." + name
+}
+
+// The upload and its image variants, none are left behind on failure
+func storeBlobs(ctx context.Context, attachment *Attachment, content io.Reader, variants []image_processing.Variant) error {
+	err := blob_store.Blobs().Put(ctx, attachment.Key, content, attachment.Size, attachment.MimeType)
+	for i := 0; err == nil && i < len(variants); i++ {
+		variant := variants[i]
+		key := variantKey(attachment, variant.Name)
+		err = blob_store.Blobs().Put(ctx, key, bytes.NewReader(variant.Data), int64(len(variant.Data)), variant.MimeType)
+	}
+	if err != nil {
+		deleteBlobs(context.Background(), attachment)
+	}
+	return err
+}
+
+func deleteBlobs(ctx context.Context, attachment *Attachment) {
+	keys := []string{attachment.Key}
+	if attachment.Image != nil {
+		for _, variant := range attachment.Image.Variants {
+			keys = append(keys, variantKey(attachment, variant.Name))
+		}
+	}
+	for _, key := range keys {
+		if err := blob_store.Blobs().Delete(ctx, key); err != nil {
+			log.Printf("error deleting blob %s: %v", key, err)
+		}
+	}
+}
+
+// The raw request body is the file, its Content-Type the declared type.
+// conversationId or to in the query pick the conversation like when sending a
+// message, name is the original file name. Images lose their location
+// metadata and get their size, placeholder and variants. Answers with the
+// attachment to reference from the message.
+func uploadAttachment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write(responseError("Method not allowed"))
+		return
+	}
+	target := Message{}
+	var err error
+	if id := r.URL.Query().Get("conversationId"); id != "" {
+		target.ConversationId, err = primitive.ObjectIDFromHex(id)
+	} else {
+		target.To, err = primitive.ObjectIDFromHex(r.URL.Query().Get("to"))
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Bad request"))
+		return
+	}
+	declared, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		declared = ""
+	}
+	limit := attachmentLimit(declared)
+	if r.ContentLength > limit {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write(responseError("File too large"))
+		return
+	}
+	user := callerUser(r)
+	conversation, err := conversationOfMessage(r.Context(), user.Id, &target)
+	if errors.Is(err, errInvalidMessage) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(responseError("Conversation not found"))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Unable to upload"))
+		return
+	}
+
+	// Kept on disk while hashing, the checksum and type are known before the
+	// blob store sees it
+	file, err := os.CreateTemp("", "upload-*")
+	if err != nil {
+		log.Printf("error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(responseError("Unable to upload"))
+		return
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), http.MaxBytesReader(w, r.Body, limit))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write(responseError("File too large"))
+		return
+	}
+	if err != nil || size == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Bad request"))
+		return
+	}
+	head := make([]byte, 512)
+	n, _ := file.ReadAt(head, 0)
+	// Generic types, and the form type some clients send by default, say
+	// nothing about the file
+	mimeType := declared
+	if mimeType == "" || mimeType == "application/octet-stream" || mimeType == "application/x-www-form-urlencoded" {
+		mimeType, _, _ = mime.ParseMediaType(http.DetectContentType(head[:n]))
+	}
+	if size > attachmentLimit(mimeType) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write(responseError("File too large"))
+		return
+	}
+
+	attachment := Attachment{
+		Id:             primitive.NewObjectID(),
+		ConversationId: conversation.Id,
+		UploadedBy:     user.Id,
+		Name:           cleanAttachmentName(r.URL.Query().Get("name")),
+		MimeType:       mimeType,
+		Size:           size,
+		Checksum:       hex.EncodeToString(hash.Sum(nil)),
+		CreatedAt:      time.Now().UTC(),
+	}
+	attachment.Key = attachmentKey(&attachment)
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		log.Printf("error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(responseError("Unable to upload"))
+		return
+	}
+	var content io.Reader = file
+	var variants []image_processing.Variant
+	if image_processing.Supported(mimeType) {
+		// Images are at most a few megabytes, small enough to hold
+		data, err := io.ReadAll(file)
+		var result *image_processing.Result
+		if err == nil {
+			result, err = image_processing.Process(data, mimeType)
+		}
+		if errors.Is(err, image_processing.ErrTooLarge) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			w.Write(responseError("Image too large"))
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(responseError("Unreadable image"))
+			return
+		}
+		if result.Cleaned != nil {
+			data = result.Cleaned
+			checksum := sha256.Sum256(data)
+			attachment.Size = int64(len(data))
+			attachment.Checksum = hex.EncodeToString(checksum[:])
+		}
+		content = bytes.NewReader(data)
+		variants = result.Variants
+		attachment.Image = &db_handler.ImageInfo{
+			Width:    result.Width,
+			Height:   result.Height,
+			Blurhash: result.Blurhash,
+		}
+		for _, variant := range variants {
+			attachment.Image.Variants = append(attachment.Image.Variants, db_handler.AttachmentVariant{
+				Name:     variant.Name,
+				MimeType: variant.MimeType,
+				Width:    variant.Width,
+				Height:   variant.Height,
+				Size:     int64(len(variant.Data)),
+			})
+		}
+	}
+	if err = storeBlobs(r.Context(), &attachment, content, variants); err != nil {
+		log.Printf("error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(responseError("Unable to upload"))
+		return
+	}
+	if err = db_handler.Storage().SaveAttachment(r.Context(), &attachment); err != nil {
+		deleteBlobs(context.Background(), &attachment)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Unable to upload"))
+		return
+	}
+
+	json_data, json_error := json.Marshal(&attachment)
+	if json_error != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Bad data"))
+		return
+	}
+	w.Write(json_data)
+}
+
+// Streams an attachment to a current member of its conversation, or one of
+// its image variants when variant names one. Files not sent yet are only
+// available to their uploader.
+func getAttachment(w http.ResponseWriter, r *http.Request) {
+	id, err := primitive.ObjectIDFromHex(r.URL.Query().Get("id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Bad request"))
+		return
+	}
+	user := callerUser(r)
+	attachment, err := db_handler.Storage().GetAttachment(r.Context(), id)
+	if err == nil {
+		_, err = conversationOf(r.Context(), user.Id, attachment.ConversationId)
+	}
+	if err == nil && attachment.MessageId == nil && attachment.UploadedBy != user.Id {
+		err = errNotMember
+	}
+	if errors.Is(err, db_handler.ErrNotFound) || errors.Is(err, errNotMember) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(responseError("Attachment not found"))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Unable to get"))
+		return
+	}
+
+	key, mimeType, size := attachment.Key, attachment.MimeType, attachment.Size
+	// Contents never change, the checksum is a strong validator
+	etag := `"` + attachment.Checksum + `"`
+	if name := r.URL.Query().Get("variant"); name != "" {
+		var variant *db_handler.AttachmentVariant
+		if attachment.Image != nil {
+			for i := range attachment.Image.Variants {
+				if attachment.Image.Variants[i].Name == name {
+					variant = &attachment.Image.Variants[i]
+				}
+			}
+		}
+		if variant == nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write(responseError("Variant not found"))
+			return
+		}
+		key, mimeType, size = variantKey(attachment, name), variant.MimeType, variant.Size
+		etag = `"` + attachment.Checksum + "-" + name + `"`
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	content, err := blob_store.Blobs().Get(r.Context(), key)
+	if errors.Is(err, blob_store.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(responseError("Attachment not found"))
+		return
+	}
+	if err != nil {
+		log.Printf("error: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(responseError("Unable to get"))
+		return
+	}
+	defer content.Close()
+
+	disposition := "attachment"
+	if isInlineType(mimeType) {
+		disposition = "inline"
+	}
+	if attachment.Name != "" {
+		disposition = mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Name})
+	}
+	w.Header().Set("Content-Type", mimeType)
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("Content-Disposition", disposition)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if _, err = io.Copy(w, content); err != nil {
+		log.Printf("error sending attachment %s: %v", attachment.Id.Hex(), err)
+	}
+}
+
+// Gives the message the attachments it references, filling in their details.
+// errInvalidMessage when any isn't an unsent upload of the sender to the
+// message's conversation.
+func claimAttachments(ctx context.Context, data *Message) error {
+	if len(data.Attachments) > maxAttachmentsPerMessage {
+		return errInvalidMessage
+	}
+	ids := make([]primitive.ObjectID, len(data.Attachments))
+	for i, ref := range data.Attachments {
+		ids[i] = ref.Id
+	}
+	attachments, err := db_handler.Storage().ClaimAttachments(ctx, ids, data)
+	if errors.Is(err, db_handler.ErrNotFound) {
+		return errInvalidMessage
+	}
+	if err != nil {
+		return err
+	}
+	data.Attachments = data.Attachments[:0]
+	for i := range attachments {
+		data.Attachments = append(data.Attachments, attachments[i].Ref())
+	}
+	return nil
+}
+
+// Removes the files of a message deleted for everyone
+func deleteAttachments(ctx context.Context, message primitive.ObjectID) {
+	attachments, err := db_handler.Storage().DeleteMessageAttachments(ctx, message)
+	if err != nil {
+		log.Printf("error: %v", err)
+		return
+	}
+	for i := range attachments {
+		deleteBlobs(ctx, &attachments[i])
+	}
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	blob_store "chat.app/blob-store"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func useTestBlobs(t *testing.T) {
+	t.Helper()
+	store, err := blob_store.NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := blob_store.Blobs()
+	blob_store.SetBlobs(store)
+	t.Cleanup(func() { blob_store.SetBlobs(previous) })
+}
+
+// Calls an attachment route as the user, the query goes in the URL and the
+// file, if any, is the body
+func callAttachmentRoute(t *testing.T, route AppRoute, user *User, query string, file string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, route.Path+"?"+query, strings.NewReader(file))
+	r.Header.Set("Origin", origins[0])
+	r.Header.Set("Authorization", "Bearer "+user.AuthId)
+	r.Header.Set("Content-Type", "text/plain")
+	w := httptest.NewRecorder()
+	routeHandler(route)(w, r)
+	return w
+}
+
+// Only the conversation's members get a sent attachment, and only its
+// uploader one not sent yet. Each upload goes with a single message.
+func TestAttachmentAccess(t *testing.T) {
+	useTestStore(t)
+	useTestBlobs(t)
+	alice, bob, mallory := createTestUser(t, "alice"), createTestUser(t, "bob"), createTestUser(t, "mallory")
+	makeContacts(t, alice, bob)
+	makeContacts(t, mallory, bob)
+	upload := AppRoute{"/upload-attachment", uploadAttachment}
+	fetch := func(user *User, id primitive.ObjectID) int {
+		return callAttachmentRoute(t, AppRoute{"/get-attachment", getAttachment}, user, "id="+id.Hex(), "").Code
+	}
+
+	if w := callAttachmentRoute(t, upload, mallory, "to="+alice.Id.Hex(), "notes"); w.Code != http.StatusNotFound {
+		t.Fatalf("upload to a stranger = %d: %s", w.Code, w.Body)
+	}
+	w := callAttachmentRoute(t, upload, alice, "to="+bob.Id.Hex(), "notes")
+	var attachment Attachment
+	if err := json.Unmarshal(w.Body.Bytes(), &attachment); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("upload = %d: %s", w.Code, w.Body)
+	}
+	for _, user := range []*User{bob, mallory} {
+		if code := fetch(user, attachment.Id); code != http.StatusNotFound {
+			t.Fatalf("%s fetching an unsent upload = %d", user.Name, code)
+		}
+	}
+	if code := fetch(alice, attachment.Id); code != http.StatusOK {
+		t.Fatalf("uploader fetching their upload = %d", code)
+	}
+
+	attach := func(to *User) map[string]interface{} {
+		return map[string]interface{}{
+			"to":          to.Id,
+			"attachments": []map[string]interface{}{{"_id": attachment.Id}},
+		}
+	}
+	if _, code := sendMessage(t, mallory, attach(bob)); code != http.StatusBadRequest {
+		t.Fatalf("someone else claiming the upload = %d", code)
+	}
+	if _, code := sendMessage(t, bob, attach(alice)); code != http.StatusBadRequest {
+		t.Fatalf("the other member claiming the upload = %d", code)
+	}
+	if message, code := sendMessage(t, alice, attach(bob)); message == nil || len(message.Attachments) != 1 {
+		t.Fatalf("message with the upload = %+v, %d", message, code)
+	}
+	if _, code := sendMessage(t, alice, attach(bob)); code != http.StatusBadRequest {
+		t.Fatalf("reusing a sent upload = %d", code)
+	}
+
+	if code := fetch(bob, attachment.Id); code != http.StatusOK {
+		t.Fatalf("member fetching a sent attachment = %d", code)
+	}
+	if code := fetch(mallory, attachment.Id); code != http.StatusNotFound {
+		t.Fatalf("non member fetching a sent attachment = %d", code)
+	}
+}
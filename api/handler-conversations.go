@@ -0,0 +1,132 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	db_handler "chat.app/db"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type ConversationSummary = db_handler.ConversationSummary
+
+const (
+	defaultConversationPage = 20
+	maxConversationPage     = 50
+)
+
+var conversationRoutes = []AppRoute{
+	{"/get-conversations", getConversations},
+	{"/set-retention", setRetention},
+}
+
+// The caller's conversations, direct and groups, most recently active first.
+// The next page starts after the updatedAt and conversationId of the last
+// conversation of the previous one.
+func getConversations(w http.ResponseWriter, r *http.Request) {
+	type BodyStruct = struct {
+		Before   *time.Time         `json:"before"`
+		BeforeId primitive.ObjectID `json:"beforeId"`
+		Limit    int64              `json:"limit"`
+	}
+	var body BodyStruct
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.Limit < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Bad request"))
+		return
+	}
+	if body.Limit == 0 {
+		body.Limit = defaultConversationPage
+	}
+	if body.Limit > maxConversationPage {
+		body.Limit = maxConversationPage
+	}
+	user := callerUser(r)
+
+	// One more than asked tells whether there is a next page
+	summaries, err := db_handler.Storage().GetSummaries(r.Context(), db_handler.SummaryQuery{
+		User:               user.Id,
+		Before:             body.Before,
+		BeforeConversation: body.BeforeId,
+		Limit:              body.Limit + 1,
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Unable to get"))
+		return
+	}
+	hasMore := int64(len(summaries)) > body.Limit
+	if hasMore {
+		summaries = summaries[:body.Limit]
+	}
+
+	// The other users of direct conversations, all in a single lookup
+	var ids []primitive.ObjectID
+	for _, summary := range summaries {
+		if summary.With != nil {
+			ids = append(ids, *summary.With)
+		}
+	}
+	contactsData, err := db_handler.Storage().GetContactsData(r.Context(), user.Id)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Unable to get"))
+		return
+	}
+	users := make(map[primitive.ObjectID]*User)
+	if len(ids) > 0 {
+		found, err := db_handler.Storage().GetUsers(r.Context(), ids)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(responseError("Unable to get"))
+			return
+		}
+		for i := range found {
+			users[found[i].Id] = &found[i]
+		}
+	}
+
+	// Presence is only shared between contacts
+	type Contact = struct {
+		User
+		*Presence
+	}
+	type Item = struct {
+		ConversationSummary
+		Contact   *Contact        `json:"contact,omitempty"` // Direct conversations only
+		Retention RetentionPolicy `json:"retention"`
+	}
+	type ResponseStruct = struct {
+		Conversations []Item `json:"conversations"`
+		HasMore       bool   `json:"hasMore"`
+	}
+	response := ResponseStruct{
+		Conversations: []Item{},
+		HasMore:       hasMore,
+	}
+	for _, summary := range summaries {
+		item := Item{
+			ConversationSummary: summary,
+			Retention:           effectiveRetention(summary.Retention),
+		}
+		if summary.With != nil && users[*summary.With] != nil {
+			contact := users[*summary.With]
+			item.Contact = &Contact{User: *contact}
+			if contactsData.Contacts != nil && containsId(*contactsData.Contacts, contact.Id) {
+				presence := presenceOf(contact)
+				item.Contact.Presence = &presence
+			}
+		}
+		response.Conversations = append(response.Conversations, item)
+	}
+
+	json_data, json_error := json.Marshal(&response)
+	if json_error != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Bad data"))
+		return
+	}
+	w.Write(json_data)
+}
@@ -0,0 +1,317 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	db_handler "chat.app/db"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type Conversation = db_handler.Conversation
+
+// Largest group, creator included
+const maxGroupMembers = 256
+
+const maxGroupNameLength = 64
+
+var groupRoutes = []AppRoute{
+	{"/create-group", createGroup},
+	{"/add-group-members", addGroupMembers},
+	{"/remove-group-member", removeGroupMember},
+	{"/leave-group", leaveGroup},
+	{"/rename-group", renameGroup},
+	{"/set-group-admin", setGroupAdmin},
+}
+
+var errNotMember = errors.New("not a conversation member")
+
+// Conversation the user is a member of, errNotMember for conversations that
+// don't exist or the user isn't in, so both look the same to the caller
+func conversationOf(ctx context.Context, user primitive.ObjectID, id primitive.ObjectID) (*Conversation, error) {
+	conversation, err := db_handler.Storage().GetConversation(ctx, id)
+	if errors.Is(err, db_handler.ErrNotFound) {
+		return nil, errNotMember
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !containsId(conversation.Members, user) {
+		return nil, errNotMember
+	}
+	return conversation, nil
+}
+
+// Same as conversationOf, direct conversations don't count
+func groupOf(ctx context.Context, user primitive.ObjectID, id primitive.ObjectID) (*Conversation, error) {
+	conversation, err := conversationOf(ctx, user, id)
+	if err == nil && conversation.Type != db_handler.ConversationGroup {
+		return nil, errNotMember
+	}
+	return conversation, err
+}
+
+// The other member of a direct conversation
+func otherMember(conversation *Conversation, user primitive.ObjectID) primitive.ObjectID {
+	for _, member := range conversation.Members {
+		if member != user {
+			return member
+		}
+	}
+	return primitive.NilObjectID
+}
+
+func isAdmin(conversation *Conversation, user primitive.ObjectID) bool {
+	return containsId(conversation.Admins, user)
+}
+
+func validGroupName(name string) bool {
+	name = strings.TrimSpace(name)
+	return name != "" && len([]rune(name)) <= maxGroupNameLength
+}
+
+// Members can only add people they are friends with
+func allContacts(ctx context.Context, user primitive.ObjectID, ids []primitive.ObjectID) (bool, error) {
+	contactsData, err := db_handler.Storage().GetContactsData(ctx, user)
+	if err != nil {
+		return false, err
+	}
+	for _, id := range ids {
+		if contactsData.Contacts == nil || !containsId(*contactsData.Contacts, id) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Sends the group's new state to its members and to anyone who just left it
+func announceConversation(ctx context.Context, conversation *Conversation, former ...primitive.ObjectID) {
+	envelope := newEnvelope(EventConversationUpdated, conversationPayload(conversation))
+	for _, member := range append(conversation.Members, former...) {
+		publish(ctx, member, envelope)
+	}
+}
+
+// Shared by the handlers below: decodes the body, loads the group, checks the
+// caller is a member (and an admin when required) and writes the error
+// response otherwise
+func loadGroup(w http.ResponseWriter, r *http.Request, body interface{}, id func() primitive.ObjectID, admin bool) (*Conversation, bool) {
+	err := json.NewDecoder(r.Body).Decode(body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Bad request"))
+		return nil, false
+	}
+	user := callerUser(r)
+	conversation, err := groupOf(r.Context(), user.Id, id())
+	if errors.Is(err, errNotMember) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(responseError("Group not found"))
+		return nil, false
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Unable to get"))
+		return nil, false
+	}
+	if admin && !isAdmin(conversation, user.Id) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write(responseError("Only group admins can do that"))
+		return nil, false
+	}
+	return conversation, true
+}
+
+func writeConversation(w http.ResponseWriter, conversation *Conversation, err error) {
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Unable to update"))
+		return
+	}
+	json_data, json_error := json.Marshal(conversationPayload(conversation))
+	if json_error != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Bad data"))
+		return
+	}
+	w.Write(json_data)
+}
+
+func createGroup(w http.ResponseWriter, r *http.Request) {
+	type BodyStruct = struct {
+		Name    string               `json:"name"`
+		Members []primitive.ObjectID `json:"members"`
+	}
+	var body BodyStruct
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || !validGroupName(body.Name) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Bad request"))
+		return
+	}
+	user := callerUser(r)
+
+	members := []primitive.ObjectID{user.Id}
+	for _, member := range body.Members {
+		if !containsId(members, member) {
+			members = append(members, member)
+		}
+	}
+	if len(members) < 2 || len(members) > maxGroupMembers {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Bad request"))
+		return
+	}
+	contacts, err := allContacts(r.Context(), user.Id, members[1:])
+	if err != nil || !contacts {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write(responseError("Members must be contacts"))
+		return
+	}
+
+	now := time.Now().UTC()
+	conversation := Conversation{
+		Id:        primitive.NewObjectID(),
+		Type:      db_handler.ConversationGroup,
+		Name:      strings.TrimSpace(body.Name),
+		Members:   members,
+		Admins:    []primitive.ObjectID{user.Id},
+		CreatedBy: user.Id,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	err = db_handler.Storage().CreateConversation(r.Context(), &conversation)
+	if err == nil {
+		announceConversation(r.Context(), &conversation)
+	}
+	writeConversation(w, &conversation, err)
+}
+
+func addGroupMembers(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		ConversationId primitive.ObjectID   `json:"conversationId"`
+		Members        []primitive.ObjectID `json:"members"`
+	}
+	conversation, ok := loadGroup(w, r, &body, func() primitive.ObjectID { return body.ConversationId }, true)
+	if !ok {
+		return
+	}
+	var added []primitive.ObjectID
+	for _, member := range body.Members {
+		if !containsId(conversation.Members, member) && !containsId(added, member) {
+			added = append(added, member)
+		}
+	}
+	if len(added) == 0 || len(conversation.Members)+len(added) > maxGroupMembers {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Bad request"))
+		return
+	}
+	contacts, err := allContacts(r.Context(), callerUser(r).Id, added)
+	if err != nil || !contacts {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write(responseError("Members must be contacts"))
+		return
+	}
+
+	conversation, err = db_handler.Storage().AddMembers(r.Context(), conversation.Id, added, time.Now().UTC())
+	if err == nil {
+		announceConversation(r.Context(), conversation)
+	}
+	writeConversation(w, conversation, err)
+}
+
+// Admins remove other members, everyone leaves with /leave-group
+func removeGroupMember(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		ConversationId primitive.ObjectID `json:"conversationId"`
+		Member         primitive.ObjectID `json:"member"`
+	}
+	conversation, ok := loadGroup(w, r, &body, func() primitive.ObjectID { return body.ConversationId }, true)
+	if !ok {
+		return
+	}
+	if body.Member == callerUser(r).Id || !containsId(conversation.Members, body.Member) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Bad request"))
+		return
+	}
+
+	conversation, err := db_handler.Storage().RemoveMember(r.Context(), conversation.Id, body.Member, time.Now().UTC())
+	if err == nil {
+		announceConversation(r.Context(), conversation, body.Member)
+	}
+	writeConversation(w, conversation, err)
+}
+
+// When the last admin leaves, the longest standing member takes over
+func leaveGroup(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		ConversationId primitive.ObjectID `json:"conversationId"`
+	}
+	conversation, ok := loadGroup(w, r, &body, func() primitive.ObjectID { return body.ConversationId }, false)
+	if !ok {
+		return
+	}
+	user := callerUser(r)
+	now := time.Now().UTC()
+	conversation, err := db_handler.Storage().RemoveMember(r.Context(), conversation.Id, user.Id, now)
+	if err == nil && len(conversation.Admins) == 0 && len(conversation.Members) > 0 {
+		conversation, err = db_handler.Storage().SetAdmin(r.Context(), conversation.Id, conversation.Members[0], true, now)
+	}
+	if err == nil {
+		announceConversation(r.Context(), conversation, user.Id)
+	}
+	writeConversation(w, conversation, err)
+}
+
+func renameGroup(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		ConversationId primitive.ObjectID `json:"conversationId"`
+		Name           string             `json:"name"`
+	}
+	conversation, ok := loadGroup(w, r, &body, func() primitive.ObjectID { return body.ConversationId }, true)
+	if !ok {
+		return
+	}
+	if !validGroupName(body.Name) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Bad request"))
+		return
+	}
+
+	conversation, err := db_handler.Storage().RenameConversation(r.Context(), conversation.Id, strings.TrimSpace(body.Name), time.Now().UTC())
+	if err == nil {
+		announceConversation(r.Context(), conversation)
+	}
+	writeConversation(w, conversation, err)
+}
+
+// Promotes or demotes a member, a group always keeps at least one admin
+func setGroupAdmin(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		ConversationId primitive.ObjectID `json:"conversationId"`
+		Member         primitive.ObjectID `json:"member"`
+		Admin          bool               `json:"admin"`
+	}
+	conversation, ok := loadGroup(w, r, &body, func() primitive.ObjectID { return body.ConversationId }, true)
+	if !ok {
+		return
+	}
+	lastAdmin := len(conversation.Admins) == 1 && isAdmin(conversation, body.Member)
+	if !containsId(conversation.Members, body.Member) || (!body.Admin && lastAdmin) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Bad request"))
+		return
+	}
+
+	conversation, err := db_handler.Storage().SetAdmin(r.Context(), conversation.Id, body.Member, body.Admin, time.Now().UTC())
+	if err == nil {
+		announceConversation(r.Context(), conversation)
+	}
+	writeConversation(w, conversation, err)
+}
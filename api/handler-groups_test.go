@@ -0,0 +1,175 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Calls a group route as the user, the conversation is nil unless it succeeded
+func callGroupRoute(t *testing.T, route AppRoute, user *User, body map[string]interface{}) (*Conversation, int) {
+	t.Helper()
+	w := callRoute(t, route, "Bearer "+user.AuthId, body)
+	if w.Code != http.StatusOK {
+		return nil, w.Code
+	}
+	var payload ConversationPayload
+	if err := json.Unmarshal(w.Body.Bytes(), &payload); err != nil {
+		t.Fatalf("%s answered %s: %v", route.Path, w.Body, err)
+	}
+	return &payload.Conversation, w.Code
+}
+
+func createTestGroup(t *testing.T, creator *User, members ...*User) *Conversation {
+	t.Helper()
+	var ids []primitive.ObjectID
+	for _, member := range members {
+		ids = append(ids, member.Id)
+	}
+	group, code := callGroupRoute(t, AppRoute{"/create-group", createGroup}, creator, map[string]interface{}{
+		"name":    "trip",
+		"members": ids,
+	})
+	if group == nil {
+		t.Fatalf("create-group = %d", code)
+	}
+	return group
+}
+
+func TestGroupMembers(t *testing.T) {
+	useTestStore(t)
+	alice, bob, carol, dave := createTestUser(t, "alice"), createTestUser(t, "bob"), createTestUser(t, "carol"), createTestUser(t, "dave")
+	makeContacts(t, alice, bob)
+	makeContacts(t, alice, carol)
+	makeContacts(t, bob, dave)
+	group := createTestGroup(t, alice, bob)
+	add := AppRoute{"/add-group-members", addGroupMembers}
+	remove := AppRoute{"/remove-group-member", removeGroupMember}
+
+	tests := []struct {
+		name    string
+		route   AppRoute
+		caller  *User
+		member  *User
+		code    int
+		members int
+	}{
+		{"member adds", add, bob, dave, http.StatusForbidden, 0},
+		{"admin adds a stranger", add, alice, dave, http.StatusForbidden, 0},
+		{"admin adds a contact", add, alice, carol, http.StatusOK, 3},
+		{"admin adds a member again", add, alice, carol, http.StatusBadRequest, 0},
+		{"member removes", remove, bob, carol, http.StatusForbidden, 0},
+		{"admin removes themselves", remove, alice, alice, http.StatusBadRequest, 0},
+		{"admin removes a member", remove, alice, bob, http.StatusOK, 2},
+		{"former member adds", add, bob, dave, http.StatusNotFound, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body := map[string]interface{}{"conversationId": group.Id}
+			if test.route.Path == add.Path {
+				body["members"] = []primitive.ObjectID{test.member.Id}
+			} else {
+				body["member"] = test.member.Id
+			}
+			updated, code := callGroupRoute(t, test.route, test.caller, body)
+			if code != test.code {
+				t.Fatalf("%s = %d, want %d", test.route.Path, code, test.code)
+			}
+			if updated != nil && len(updated.Members) != test.members {
+				t.Fatalf("members = %v, want %d", updated.Members, test.members)
+			}
+		})
+	}
+	// The removed member hears about it
+	if types := eventTypes(t, bob.Id); len(types) == 0 || types[len(types)-1] != EventConversationUpdated {
+		t.Fatalf("removed member's events = %v", types)
+	}
+}
+
+func TestRenameGroup(t *testing.T) {
+	useTestStore(t)
+	alice, bob, mallory := createTestUser(t, "alice"), createTestUser(t, "bob"), createTestUser(t, "mallory")
+	makeContacts(t, alice, bob)
+	group := createTestGroup(t, alice, bob)
+	route := AppRoute{"/rename-group", renameGroup}
+
+	tests := []struct {
+		name   string
+		caller *User
+		title  string
+		code   int
+	}{
+		{"admin", alice, "  holidays ", http.StatusOK},
+		{"empty name", alice, "  ", http.StatusBadRequest},
+		{"member", bob, "mine", http.StatusForbidden},
+		{"outsider", mallory, "mine", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			renamed, code := callGroupRoute(t, route, test.caller, map[string]interface{}{
+				"conversationId": group.Id,
+				"name":           test.title,
+			})
+			if code != test.code {
+				t.Fatalf("rename-group = %d, want %d", code, test.code)
+			}
+			if renamed != nil && renamed.Name != "holidays" {
+				t.Fatalf("name = %q", renamed.Name)
+			}
+		})
+	}
+}
+
+// A group never ends up without an admin
+func TestLastGroupAdmin(t *testing.T) {
+	useTestStore(t)
+	alice, bob, carol := createTestUser(t, "alice"), createTestUser(t, "bob"), createTestUser(t, "carol")
+	makeContacts(t, alice, bob)
+	makeContacts(t, alice, carol)
+	group := createTestGroup(t, alice, bob, carol)
+
+	_, code := callGroupRoute(t, AppRoute{"/set-group-admin", setGroupAdmin}, alice, map[string]interface{}{
+		"conversationId": group.Id,
+		"member":         alice.Id,
+		"admin":          false,
+	})
+	if code != http.StatusBadRequest {
+		t.Fatalf("demoting the last admin = %d, want %d", code, http.StatusBadRequest)
+	}
+
+	left, code := callGroupRoute(t, AppRoute{"/leave-group", leaveGroup}, alice, map[string]interface{}{
+		"conversationId": group.Id,
+	})
+	if left == nil {
+		t.Fatalf("leave-group = %d", code)
+	}
+	if len(left.Members) != 2 || len(left.Admins) != 1 || left.Admins[0] != bob.Id {
+		t.Fatalf("after the last admin left, members %v and admins %v, want bob promoted", left.Members, left.Admins)
+	}
+	if types := eventTypes(t, alice.Id); len(types) == 0 || types[len(types)-1] != EventConversationUpdated {
+		t.Fatalf("leaver's events = %v", types)
+	}
+}
+
+// Only members send to a group, leaving ends it
+func TestSendToGroup(t *testing.T) {
+	useTestStore(t)
+	alice, bob, mallory := createTestUser(t, "alice"), createTestUser(t, "bob"), createTestUser(t, "mallory")
+	makeContacts(t, alice, bob)
+	group := createTestGroup(t, alice, bob)
+
+	if message, code := sendMessage(t, bob, map[string]interface{}{"conversationId": group.Id, "message": "hi"}); message == nil || message.To != primitive.NilObjectID {
+		t.Fatalf("member's message = %+v, %d", message, code)
+	}
+	if _, code := sendMessage(t, mallory, map[string]interface{}{"conversationId": group.Id, "message": "hi"}); code != http.StatusBadRequest {
+		t.Fatalf("outsider's message = %d, want %d", code, http.StatusBadRequest)
+	}
+	if _, code := callGroupRoute(t, AppRoute{"/leave-group", leaveGroup}, bob, map[string]interface{}{"conversationId": group.Id}); code != http.StatusOK {
+		t.Fatalf("leave-group = %d", code)
+	}
+	if _, code := sendMessage(t, bob, map[string]interface{}{"conversationId": group.Id, "message": "hi"}); code != http.StatusBadRequest {
+		t.Fatalf("former member's message = %d, want %d", code, http.StatusBadRequest)
+	}
+}
@@ -1,93 +1,536 @@
 package api
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
 	"time"
 
 	app_notifications "chat.app/app-notifications"
 	db_handler "chat.app/db"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-type Message = struct {
-	Id        primitive.ObjectID `json:"_id" bson:"_id"`
-	Message   string             `json:"message"`
-	From      primitive.ObjectID `json:"from"`
-	To        primitive.ObjectID `json:"to"`
-	CreatedAt time.Time          `json:"createdAt"`
-}
+type Message = db_handler.Message
 
 var messageRoutes = []AppRoute{
 	{"/save-message", saveMessage},
 	{"/get-messages", getMessages},
+	{"/edit-message", editMessage},
+	{"/delete-message", deleteMessage},
+	{"/mark-read", markConversationRead},
+	{"/get-unread-count", getUnreadCount},
 }
 
-func saveMessage(w http.ResponseWriter, r *http.Request) {
-	type BodyStruct = struct {
-		Id        primitive.ObjectID `json:"_id" bson:"_id"`
-		Message   string             `json:"message"`
-		Title     string             `json:"title"`
-		From      primitive.ObjectID `json:"from"`
-		To        primitive.ObjectID `json:"to"`
-		CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
-		ExpireAt  time.Time          `json:"expireAt" bson:"expireAt"`
+var errInvalidMessage = errors.New("invalid message")
+
+// Longest text kept in the preview of a quoted message, in characters
+const replySnippetLength = 100
+
+const (
+	defaultMessagePage = 20
+	maxMessagePage     = 100
+)
+
+var errBadCursor = errors.New("bad cursor")
+
+// Cursors are opaque to clients, they hold the conversation and the message
+// at the edge of a page so they can't be used on another conversation.
+// Searches across every conversation use an empty one.
+// Message ids only grow, so messages arriving while scrolling never shift the
+// pages that come after a cursor.
+func encodeCursor(conversation primitive.ObjectID, message primitive.ObjectID) string {
+	return base64.RawURLEncoding.EncodeToString(append(conversation[:], message[:]...))
+}
+
+func decodeCursor(cursor string, conversation primitive.ObjectID) (*primitive.ObjectID, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(raw) != 24 || !bytes.Equal(raw[:12], conversation[:]) {
+		return nil, errBadCursor
+	}
+	var message primitive.ObjectID
+	copy(message[:], raw[12:])
+	return &message, nil
+}
+
+// Validates and stores a message from the given sender, then delivers it to
+// every member of its conversation. Used by /save-message and the WebSocket
+// send frame, the id, creation and expiration dates are always assigned here.
+// Messages addressed with To start the direct conversation if needed. stored,
+// if given, runs once the message is saved and before anyone else hears about
+// it.
+func postMessage(ctx context.Context, from primitive.ObjectID, data *Message, stored func()) error {
+	if data.Message == "" && len(data.Attachments) == 0 {
+		return errInvalidMessage
+	}
+	conversation, err := conversationOfMessage(ctx, from, data)
+	if err != nil {
+		return err
+	}
+	data.From = from
+	data.Reply = nil
+	if data.ReplyTo != nil {
+		// Only messages of the same conversation can be quoted
+		quoted, err := db_handler.Storage().GetMessage(ctx, *data.ReplyTo)
+		if errors.Is(err, db_handler.ErrNotFound) {
+			return errInvalidMessage
+		}
+		if err != nil {
+			return err
+		}
+		if !sameConversation(quoted, data) || quoted.Deleted {
+			return errInvalidMessage
+		}
+		data.Reply = previewOf(quoted)
 	}
-	var data BodyStruct
-	err := json.NewDecoder(r.Body).Decode(&data)
-	// Messages will expire in a week
-	data.ExpireAt = time.Now().Add(time.Hour * time.Duration(24*7))
 	data.Id = primitive.NewObjectID()
+	data.CreatedAt = time.Now().UTC()
+	applyRetention(conversation, data)
+	if len(data.Attachments) > 0 {
+		if err = claimAttachments(ctx, data); err != nil {
+			return err
+		}
+	}
 
+	err = db_handler.Storage().SaveMessage(ctx, data)
+	if err != nil {
+		if len(data.Attachments) > 0 {
+			db_handler.Storage().ReleaseAttachments(ctx, data.Id)
+		}
+		return err
+	}
+	if stored != nil {
+		stored()
+	}
+
+	if conversation.Type == db_handler.ConversationGroup {
+		// The sender's devices get it like everyone else, pushes are tagged
+		// with the group so they stack together
+		title := data.Title
+		if title == "" {
+			title = conversation.Name
+		}
+		var recipients []primitive.ObjectID
+		for _, member := range conversation.Members {
+			publishAbout(ctx, member, data, newEnvelope(EventMessage, data))
+			if member != from {
+				recipients = append(recipients, member)
+			}
+		}
+		notifyAll(recipients, conversation.Id, title, notificationText(data))
+		return nil
+	}
+
+	// Sending ends the sender's typing indicator
+	typing.stop(from.Hex(), data.To.Hex())
+
+	// Messaging priority
+	// 1.- respond OK to sender
+	// 2.- Send WS event to receiver
+	// 3.- Send Push Notification to receiver
+	// The sender's other devices get the message too
+	publishAbout(ctx, data.From, data, newEnvelope(EventMessage, data))
+	if publishAbout(ctx, data.To, data, newEnvelope(EventMessage, data)) {
+		markDelivered(ctx, data.To, conversation, data.Id)
+	}
+	notifyAll([]primitive.ObjectID{data.To}, data.From, data.Title, notificationText(data))
+	return nil
+}
+
+// Messages whose pushes are sent at once, the others wait for their turn
+const maxPushingMessages = 16
+
+var pushSlots = make(chan struct{}, maxPushingMessages)
+
+// Sends the pushes of a message in the background, so neither the request
+// nor the sender's WebSocket read loop waits on the push service
+func notifyAll(recipients []primitive.ObjectID, tag primitive.ObjectID, title string, text string) {
+	go func() {
+		pushSlots <- struct{}{}
+		defer func() { <-pushSlots }()
+		for _, to := range recipients {
+			app_notifications.Notify(to, tag, title, text)
+		}
+	}()
+}
+
+// Push body, messages with only files get a placeholder
+func notificationText(message *Message) string {
+	if message.Message == "" && len(message.Attachments) > 0 {
+		return "Sent an attachment"
+	}
+	return message.Message
+}
+
+// Conversation a new message goes to, filling in its ConversationId or To,
+// whichever the sender left out. Also picks the conversation of uploads and
+// retention changes.
+func conversationOfMessage(ctx context.Context, from primitive.ObjectID, data *Message) (*Conversation, error) {
+	if !data.ConversationId.IsZero() {
+		conversation, err := conversationOf(ctx, from, data.ConversationId)
+		if errors.Is(err, errNotMember) {
+			return nil, errInvalidMessage
+		}
+		if err != nil {
+			return nil, err
+		}
+		data.To = primitive.NilObjectID
+		if conversation.Type == db_handler.ConversationDirect {
+			data.To = otherMember(conversation, from)
+		}
+		return conversation, nil
+	}
+
+	if data.To.IsZero() || data.To == from {
+		return nil, errInvalidMessage
+	}
+	conversation, err := db_handler.Storage().GetDirectConversation(ctx, from, data.To)
+	if err == nil {
+		data.ConversationId = conversation.Id
+		return conversation, nil
+	}
+	if !errors.Is(err, db_handler.ErrNotFound) {
+		return nil, err
+	}
+	// Only contacts start a conversation, users that don't exist aren't
+	// anyone's
+	contact, err := isContact(ctx, from, data.To)
+	if err != nil {
+		return nil, err
+	}
+	if !contact {
+		return nil, errInvalidMessage
+	}
+	conversation, err = db_handler.Storage().EnsureDirectConversation(ctx, from, data.To, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	data.ConversationId = conversation.Id
+	return conversation, nil
+}
+
+// Conversation a request refers to, by id or by the other user of a direct
+// conversation. db_handler.ErrNotFound when the two never talked.
+func findConversation(ctx context.Context, me primitive.ObjectID, you primitive.ObjectID, id primitive.ObjectID) (*Conversation, error) {
+	if !id.IsZero() {
+		return conversationOf(ctx, me, id)
+	}
+	return db_handler.Storage().GetDirectConversation(ctx, me, you)
+}
+
+// Only what a sender decides is read from the body, receipts, reactions,
+// edits and the like are the server's
+func saveMessage(w http.ResponseWriter, r *http.Request) {
+	type BodyStruct = struct {
+		From           primitive.ObjectID  `json:"from"`
+		To             primitive.ObjectID  `json:"to"`
+		ConversationId primitive.ObjectID  `json:"conversationId"`
+		Message        string              `json:"message"`
+		Title          string              `json:"title"`
+		ReplyTo        *primitive.ObjectID `json:"replyTo"`
+		// Uploaded with /upload-attachment, only their ids are read
+		Attachments []struct {
+			Id primitive.ObjectID `json:"_id"`
+		} `json:"attachments"`
+	}
+	var body BodyStruct
+	err := json.NewDecoder(r.Body).Decode(&body)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write(responseError("Bad request"))
 		return
 	}
+	from, ok := authorize(w, r, body.From)
+	if !ok {
+		return
+	}
 
-	_, err = db_handler.Client().Collection("messages").InsertOne(
-		context.TODO(),
-		data,
-	)
+	data := Message{
+		To:             body.To,
+		ConversationId: body.ConversationId,
+		Message:        body.Message,
+		Title:          body.Title,
+		ReplyTo:        body.ReplyTo,
+	}
+	for _, attachment := range body.Attachments {
+		data.Attachments = append(data.Attachments, AttachmentRef{Id: attachment.Id})
+	}
+	err = postMessage(r.Context(), from, &data, nil)
+	if errors.Is(err, errInvalidMessage) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Bad request"))
+		return
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write(responseError("Unable to save"))
 		return
 	}
 
-	// Messaging priority
-	// 1.- respond OK to sender
-	// 2.- Send WS event to receiver
-	// 3.- Send Push Notification to receiver
 	json_data, json_error := json.Marshal(&data)
 	if json_error != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write(responseError("Bad data"))
 		return
 	}
+	w.WriteHeader(200)
+	w.Write(json_data)
+}
+
+// Page of a conversation's messages, newest first. Without cursor it is the
+// latest messages, before and after continue from a previous page and around
+// centers the page on a message, to jump to a reply or a search result.
+func getMessages(w http.ResponseWriter, r *http.Request) {
+	type BodyStruct = struct {
+		Me             primitive.ObjectID  `json:"me"`
+		You            primitive.ObjectID  `json:"you"`
+		ConversationId primitive.ObjectID  `json:"conversationId"` // Instead of You
+		Limit          int64               `json:"limit"`
+		Before         string              `json:"before"` // Cursor, older messages
+		After          string              `json:"after"`  // Cursor, newer messages
+		Around         *primitive.ObjectID `json:"around"` // Message id
+	}
+	var data BodyStruct
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil || (data.You.IsZero() && data.ConversationId.IsZero()) || data.Limit < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Bad request"))
+		return
+	}
+	anchors := 0
+	for _, set := range []bool{data.Before != "", data.After != "", data.Around != nil} {
+		if set {
+			anchors++
+		}
+	}
+	if anchors > 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Only one of before, after and around"))
+		return
+	}
+	if data.Limit == 0 {
+		data.Limit = defaultMessagePage
+	}
+	if data.Limit > maxMessagePage {
+		data.Limit = maxMessagePage
+	}
+
+	var ok bool
+	if data.Me, ok = authorize(w, r, data.Me); !ok {
+		return
+	}
+
+	type ResponseStruct = struct {
+		Messages      []Message `json:"messages"`
+		Before        string    `json:"before,omitempty"` // Cursor for older messages
+		After         string    `json:"after,omitempty"`  // Cursor for newer messages
+		HasMoreBefore bool      `json:"hasMoreBefore"`
+		HasMoreAfter  bool      `json:"hasMoreAfter"`
+	}
+	response := ResponseStruct{Messages: []Message{}}
+
+	conversation, err := findConversation(r.Context(), data.Me, data.You, data.ConversationId)
+	if errors.Is(err, db_handler.ErrNotFound) && data.Around == nil {
+		// Nothing was said yet
+		json_data, _ := json.Marshal(&response)
+		w.Write(json_data)
+		return
+	}
+	if errors.Is(err, errNotMember) || errors.Is(err, db_handler.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(responseError("Conversation not found"))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Unable to get"))
+		return
+	}
 
-	if clients[data.To.Hex()] != nil {
-		err = clients[data.To.Hex()].WriteJSON(data)
+	query := db_handler.MessageQuery{
+		Me:           data.Me,
+		Conversation: conversation.Id,
+	}
+	if data.Before != "" {
+		query.Before, err = decodeCursor(data.Before, conversation.Id)
+	}
+	if data.After != "" {
+		query.After, err = decodeCursor(data.After, conversation.Id)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Bad cursor"))
+		return
+	}
+
+	if data.Around != nil {
+		response.Messages, response.HasMoreBefore, response.HasMoreAfter, err = messagesAround(r.Context(), query, *data.Around, data.Limit)
+	} else {
+		// One more than asked tells whether the page is the last one
+		query.Limit = data.Limit + 1
+		var messages []Message
+		messages, err = db_handler.Storage().GetMessages(r.Context(), query)
+		hasMore := int64(len(messages)) > data.Limit
+		if query.After != nil {
+			if hasMore {
+				messages = messages[1:]
+			}
+			response.HasMoreAfter = hasMore
+			response.HasMoreBefore = true // The cursor's message at least
+		} else {
+			if hasMore {
+				messages = messages[:data.Limit]
+			}
+			response.HasMoreBefore = hasMore
+			response.HasMoreAfter = query.Before != nil
+		}
+		response.Messages = messages
+	}
+	if errors.Is(err, db_handler.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(responseError("Message not found"))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Unable to get"))
+		return
+	}
+
+	if response.Messages == nil {
+		response.Messages = []Message{}
+	}
+	messages := response.Messages
+	if len(messages) > 0 {
+		response.Before = encodeCursor(conversation.Id, messages[len(messages)-1].Id)
+		response.After = encodeCursor(conversation.Id, messages[0].Id)
+	} else {
+		// Nothing further, the same cursors pick up what comes later
+		response.Before = data.Before
+		response.After = data.After
+	}
+
+	for i := range messages {
+		countReactions(&messages[i])
+	}
+	addReplyPreviews(r.Context(), messages)
+
+	// Newest message the other user sent in this page reached this device.
+	// Receipts are only kept for direct messages.
+	for _, message := range messages {
+		if conversation.Type == db_handler.ConversationDirect && message.From != data.Me {
+			markDelivered(r.Context(), data.Me, conversation, message.Id)
+			break
+		}
+	}
+
+	json_data, json_error := json.Marshal(&response)
+	if json_error != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Bad data"))
+		return
+	} else {
+		w.Write(json_data)
+	}
+}
+
+// The message and up to limit-1 others split on both sides of it, newest
+// first. ErrNotFound when the message isn't in the conversation or the user
+// deleted it for themselves.
+func messagesAround(ctx context.Context, query db_handler.MessageQuery, id primitive.ObjectID, limit int64) ([]Message, bool, bool, error) {
+	message, err := db_handler.Storage().GetMessage(ctx, id)
+	if err != nil {
+		return nil, false, false, err
+	}
+	if message.ConversationId != query.Conversation || isHiddenFor(message, query.Me) {
+		return nil, false, false, db_handler.ErrNotFound
+	}
+
+	olderLimit := (limit - 1) / 2
+	newerLimit := limit - 1 - olderLimit
+	query.Before, query.Limit = &id, olderLimit+1
+	older, err := db_handler.Storage().GetMessages(ctx, query)
+	if err != nil {
+		return nil, false, false, err
+	}
+	query.Before, query.After, query.Limit = nil, &id, newerLimit+1
+	newer, err := db_handler.Storage().GetMessages(ctx, query)
+	if err != nil {
+		return nil, false, false, err
+	}
+
+	hasMoreBefore := int64(len(older)) > olderLimit
+	if hasMoreBefore {
+		older = older[:olderLimit]
+	}
+	hasMoreAfter := int64(len(newer)) > newerLimit
+	if hasMoreAfter {
+		newer = newer[1:]
+	}
+	messages := append(newer, *message)
+	return append(messages, older...), hasMoreBefore, hasMoreAfter, nil
+}
+
+// Only the sender can edit, the previous text is kept in the message's edits
+func editMessage(w http.ResponseWriter, r *http.Request) {
+	type BodyStruct = struct {
+		Id      primitive.ObjectID `json:"_id"`
+		Message string             `json:"message"`
+	}
+	var data BodyStruct
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil || data.Message == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Bad request"))
+		return
+	}
+	user := callerUser(r)
+	message, err := db_handler.Storage().GetMessage(r.Context(), data.Id)
+	if err != nil || message.Deleted || !canSee(r.Context(), user.Id, message) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(responseError("Message not found"))
+		return
+	}
+	if message.From != user.Id {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write(responseError("Forbidden"))
+		return
+	}
+
+	edited := data.Message != message.Message
+	if edited {
+		message, err = db_handler.Storage().EditMessage(r.Context(), data.Id, data.Message, time.Now().UTC())
 		if err != nil {
-			clients[data.To.Hex()].Close()
-			delete(clients, data.To.Hex())
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(responseError("Unable to update"))
+			return
 		}
 	}
-	app_notifications.Notify(data.To, data.From, data.Title, data.Message)
+	countReactions(message)
+	addReplyPreview(r.Context(), message)
+	if edited {
+		publishToParticipants(r.Context(), message, newEnvelope(EventMessageEdited, message))
+	}
 
-	w.WriteHeader(200)
+	json_data, json_error := json.Marshal(message)
+	if json_error != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Bad data"))
+		return
+	}
 	w.Write(json_data)
 }
 
-func getMessages(w http.ResponseWriter, r *http.Request) {
+// Deleting for everyone is reserved to the sender and clears the text for all
+// participants, any participant can delete a message only for themselves.
+func deleteMessage(w http.ResponseWriter, r *http.Request) {
 	type BodyStruct = struct {
-		RetrieveBeforeIndex bool                `json:"retrieveBeforeIndex"`
-		IndexId             *primitive.ObjectID `json:"index"`
-		Me                  primitive.ObjectID  `json:"me"`
-		You                 primitive.ObjectID  `json:"you"`
+		Id          primitive.ObjectID `json:"_id"`
+		ForEveryone bool               `json:"forEveryone"`
 	}
 	var data BodyStruct
 	err := json.NewDecoder(r.Body).Decode(&data)
@@ -96,101 +539,249 @@ func getMessages(w http.ResponseWriter, r *http.Request) {
 		w.Write(responseError("Bad request"))
 		return
 	}
+	user := callerUser(r)
+	message, err := db_handler.Storage().GetMessage(r.Context(), data.Id)
+	if err != nil || !canSee(r.Context(), user.Id, message) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(responseError("Message not found"))
+		return
+	}
+	if data.ForEveryone && message.From != user.Id {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write(responseError("Forbidden"))
+		return
+	}
+
+	now := time.Now().UTC()
+	deleted := newEnvelope(EventMessageDeleted, MessageDeletedPayload{
+		MessageId:   message.Id,
+		ForEveryone: data.ForEveryone,
+		At:          now,
+	})
+	if data.ForEveryone {
+		if !message.Deleted {
+			_, err = db_handler.Storage().DeleteMessage(r.Context(), message.Id, now)
+			if err == nil {
+				publishToParticipants(r.Context(), message, deleted)
+				if len(message.Attachments) > 0 {
+					deleteAttachments(r.Context(), message.Id)
+				}
+			}
+		}
+	} else {
+		err = db_handler.Storage().HideMessage(r.Context(), message.Id, user.Id)
+		if err == nil {
+			publishAbout(r.Context(), user.Id, message, deleted)
+		}
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Unable to delete"))
+		return
+	}
+	w.Write([]byte(`{"success": true}`))
+}
+
+func sameConversation(a *Message, b *Message) bool {
+	return a.ConversationId == b.ConversationId
+}
+
+// Users the message is shared with, the current members of its conversation
+func participantsOf(ctx context.Context, message *Message) ([]primitive.ObjectID, error) {
+	conversation, err := db_handler.Storage().GetConversation(ctx, message.ConversationId)
+	if err != nil {
+		return nil, err
+	}
+	return conversation.Members, nil
+}
 
-	var messages []Message
+// Whether the user takes part in the message's conversation and didn't delete
+// it for themselves
+func canSee(ctx context.Context, user primitive.ObjectID, message *Message) bool {
+	participants, err := participantsOf(ctx, message)
+	return err == nil && containsId(participants, user) && !isHiddenFor(message, user)
+}
 
-	messagesFilter := bson.M{
-		"$or": bson.A{
-			bson.M{
-				"$and": bson.A{
-					bson.M{"from": data.Me},
-					bson.M{"to": data.You},
-				},
-			},
-			bson.M{
-				"$and": bson.A{
-					bson.M{"from": data.You},
-					bson.M{"to": data.Me},
-				},
-			},
-		},
+func publishToParticipants(ctx context.Context, message *Message, envelope Envelope) {
+	participants, err := participantsOf(ctx, message)
+	if err != nil {
+		log.Printf("error: %v", err)
+		return
 	}
+	for _, participant := range participants {
+		publishAbout(ctx, participant, message, envelope)
+	}
+}
+
+func previewOf(message *Message) *db_handler.MessagePreview {
+	snippet := []rune(message.Message)
+	if len(snippet) > replySnippetLength {
+		snippet = append(snippet[:replySnippetLength], '…')
+	}
+	return &db_handler.MessagePreview{
+		Id:      message.Id,
+		From:    message.From,
+		Snippet: string(snippet),
+		Deleted: message.Deleted,
+	}
+}
 
-	filter := bson.M{}
-	if data.IndexId != nil {
-		condition := "$gt"
-		if data.RetrieveBeforeIndex {
-			condition = "$lt"
+// Fills the Reply preview of every message quoting another one with a single
+// lookup. Quoted messages that expired show up as deleted.
+func addReplyPreviews(ctx context.Context, messages []Message) {
+	var ids []primitive.ObjectID
+	for _, message := range messages {
+		if message.ReplyTo != nil {
+			ids = append(ids, *message.ReplyTo)
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	quoted, err := db_handler.Storage().GetMessagesByIds(ctx, ids)
+	if err != nil {
+		log.Printf("error: %v", err)
+		return
+	}
+	previews := make(map[primitive.ObjectID]*db_handler.MessagePreview, len(quoted))
+	for i := range quoted {
+		previews[quoted[i].Id] = previewOf(&quoted[i])
+	}
+	for i := range messages {
+		if messages[i].ReplyTo == nil {
+			continue
 		}
-		indexFilter := bson.M{
-			"_id": bson.M{
-				condition: data.IndexId,
-			},
+		preview := previews[*messages[i].ReplyTo]
+		if preview == nil {
+			preview = &db_handler.MessagePreview{Id: *messages[i].ReplyTo, Deleted: true}
 		}
+		messages[i].Reply = preview
+	}
+}
 
-		filter["$and"] = bson.A{
-			messagesFilter,
-			indexFilter,
-		}
-	} else {
-		filter = messagesFilter
+func addReplyPreview(ctx context.Context, message *Message) {
+	messages := []Message{*message}
+	addReplyPreviews(ctx, messages)
+	message.Reply = messages[0].Reply
+}
+
+func isHiddenFor(message *Message, user primitive.ObjectID) bool {
+	return containsId(message.HiddenFor, user)
+}
+
+func markConversationRead(w http.ResponseWriter, r *http.Request) {
+	type BodyStruct = struct {
+		Me             primitive.ObjectID `json:"me"`
+		You            primitive.ObjectID `json:"you"`
+		ConversationId primitive.ObjectID `json:"conversationId"` // Instead of You
+		UpTo           primitive.ObjectID `json:"upTo"`
+	}
+	var data BodyStruct
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil || (data.You.IsZero() && data.ConversationId.IsZero()) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Bad request"))
+		return
+	}
+	var ok bool
+	if data.Me, ok = authorize(w, r, data.Me); !ok {
+		return
 	}
 
-	opts := options.Find().SetLimit(5)
-	opts.SetSort(bson.M{"_id": -1})
-	collection := db_handler.Client().Collection("messages")
-	cursor, err := collection.Find(context.TODO(), filter, opts)
+	err = markRead(r.Context(), data.Me, data.You, data.ConversationId, data.UpTo)
+	if errors.Is(err, errNotMember) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(responseError("Conversation not found"))
+		return
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write(responseError("Unable to get"))
+		w.Write(responseError("Unable to update"))
 		return
 	}
+	w.WriteHeader(200)
+	w.Write([]byte(`{"success": true}`))
+}
 
-	if err = cursor.All(context.TODO(), &messages); err != nil {
+// Total unread messages of the caller, for app badges
+func getUnreadCount(w http.ResponseWriter, r *http.Request) {
+	user := callerUser(r)
+	counts, err := db_handler.Storage().UnreadCounts(r.Context(), user.Id)
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write(responseError("Unable to get"))
 		return
 	}
+	type ResponseStruct = struct {
+		UnreadCount int64 `json:"unreadCount"`
+	}
+	var response ResponseStruct
+	for _, count := range counts {
+		response.UnreadCount += count
+	}
+	json_data, _ := json.Marshal(&response)
+	w.Write(json_data)
+}
 
-	json_data, json_error := json.Marshal(&messages)
-	if json_error != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write(responseError("Bad data"))
+// Records that recipient received the other member's messages of a direct
+// conversation up to upTo and lets them know. Failures only cost the receipt,
+// so they are just logged.
+func markDelivered(ctx context.Context, recipient primitive.ObjectID, conversation *Conversation, upTo primitive.ObjectID) {
+	now := time.Now().UTC()
+	changed, err := db_handler.Storage().MarkDelivered(ctx, recipient, conversation.Id, upTo, now)
+	if err != nil {
+		log.Printf("error: %v", err)
 		return
-	} else {
-		w.Write(json_data)
+	}
+	if changed > 0 {
+		publish(ctx, otherMember(conversation, recipient), newEnvelope(EventReceipt, ReceiptPayload{
+			ConversationId: conversation.Id,
+			Status:         ReceiptDelivered,
+			By:             recipient,
+			UpTo:           upTo,
+			At:             now,
+		}))
 	}
 }
 
-func getLastMessageBetweenUsers(id1 primitive.ObjectID, id2 primitive.ObjectID) (*Message, error) {
-	filter := bson.M{
-		"$or": bson.A{
-			bson.M{
-				"$and": bson.A{
-					bson.M{"from": id1},
-					bson.M{"to": id2},
-				},
-			},
-			bson.M{
-				"$and": bson.A{
-					bson.M{"from": id2},
-					bson.M{"to": id1},
-				},
-			},
-		},
-	}
-	var message Message
-	collection := db_handler.Client().Collection("messages")
-	opts := options.FindOne().SetSort(bson.M{"createdAt": -1})
-	err := collection.FindOne(context.TODO(), filter, opts).Decode(&message)
-	if err != nil {
-		message.Id = primitive.NewObjectID()
-		message.CreatedAt = time.Date(1995, 0, 0, 0, 0, 0, 0, time.Local)
-		message.From = primitive.NewObjectID()
-		message.To = primitive.NewObjectID()
-		message.Message = ""
-
-		return &message, nil
+// Moves the reader's cursor in the conversation with the given user, or the
+// one with the given id, up to upTo, the last message when upTo is empty.
+// Direct conversations also get read receipts and the sender hears about it.
+func markRead(ctx context.Context, reader primitive.ObjectID, with primitive.ObjectID, id primitive.ObjectID, upTo primitive.ObjectID) error {
+	conversation, err := findConversation(ctx, reader, with, id)
+	if errors.Is(err, db_handler.ErrNotFound) {
+		return nil
 	}
-	return &message, nil
+	if err != nil {
+		return err
+	}
+	if upTo.IsZero() {
+		last, err := db_handler.Storage().GetLastMessage(ctx, reader, conversation.Id)
+		if errors.Is(err, db_handler.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		upTo = last.Id
+	}
+	err = db_handler.Storage().SetReadCursor(ctx, reader, conversation.Id, upTo)
+	if err != nil || conversation.Type != db_handler.ConversationDirect {
+		return err
+	}
+	now := time.Now().UTC()
+	changed, err := db_handler.Storage().MarkRead(ctx, reader, conversation.Id, upTo, now)
+	if err != nil {
+		return err
+	}
+	if changed > 0 {
+		publish(ctx, otherMember(conversation, reader), newEnvelope(EventReceipt, ReceiptPayload{
+			ConversationId: conversation.Id,
+			Status:         ReceiptRead,
+			By:             reader,
+			UpTo:           upTo,
+			At:             now,
+		}))
+	}
+	return nil
 }
@@ -0,0 +1,151 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	db_handler "chat.app/db"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Sends the message as the user through /save-message and returns it as saved
+func sendMessage(t *testing.T, from *User, body map[string]interface{}) (*Message, int) {
+	t.Helper()
+	w := callRoute(t, AppRoute{"/save-message", saveMessage}, "Bearer "+from.AuthId, body)
+	if w.Code != http.StatusOK {
+		return nil, w.Code
+	}
+	var message Message
+	if err := json.Unmarshal(w.Body.Bytes(), &message); err != nil {
+		t.Fatalf("save-message answered %s: %v", w.Body, err)
+	}
+	return &message, w.Code
+}
+
+// Fields the server owns can't be set by the sender
+func TestSaveMessageIgnoresServerFields(t *testing.T) {
+	useTestStore(t)
+	alice, bob := createTestUser(t, "alice"), createTestUser(t, "bob")
+	makeContacts(t, alice, bob)
+	sent, code := sendMessage(t, alice, map[string]interface{}{
+		"to":        bob.Id,
+		"message":   "hi",
+		"reactions": map[string][]string{bob.Id.Hex(): {"👍"}},
+		"receipts":  map[string]interface{}{bob.Id.Hex(): map[string]interface{}{"readAt": "2024-01-01T00:00:00Z"}},
+		"edits":     []map[string]interface{}{{"message": "forged"}},
+		"editedAt":  "2024-01-01T00:00:00Z",
+		"deleted":   true,
+	})
+	if sent == nil {
+		t.Fatalf("save-message = %d", code)
+	}
+
+	stored, err := db_handler.Storage().GetMessage(context.Background(), sent.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, message := range []*Message{sent, stored} {
+		if message.From != alice.Id || message.Message != "hi" || message.Deleted || message.EditedAt != nil ||
+			len(message.Edits) > 0 || len(message.Reactions) > 0 || len(message.Receipts) > 0 {
+			t.Fatalf("message = %+v", message)
+		}
+	}
+}
+
+// Replies only quote existing messages of the same conversation
+func TestSaveMessageReplyTo(t *testing.T) {
+	useTestStore(t)
+	alice, bob, carol := createTestUser(t, "alice"), createTestUser(t, "bob"), createTestUser(t, "carol")
+	makeContacts(t, alice, bob)
+	makeContacts(t, alice, carol)
+	withBob, _ := sendMessage(t, alice, map[string]interface{}{"to": bob.Id, "message": "for bob"})
+	withCarol, _ := sendMessage(t, alice, map[string]interface{}{"to": carol.Id, "message": "for carol"})
+	if withBob == nil || withCarol == nil {
+		t.Fatal("messages not sent")
+	}
+
+	for _, test := range []struct {
+		name    string
+		replyTo interface{}
+		code    int
+	}{
+		{"same conversation", withBob.Id, http.StatusOK},
+		{"other conversation", withCarol.Id, http.StatusBadRequest},
+		{"missing message", primitive.NewObjectID(), http.StatusBadRequest},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			reply, code := sendMessage(t, bob, map[string]interface{}{"to": alice.Id, "message": "reply", "replyTo": test.replyTo})
+			if code != test.code {
+				t.Fatalf("reply = %d, want %d", code, test.code)
+			}
+			if reply != nil && (reply.Reply == nil || reply.Reply.Snippet != "for bob") {
+				t.Fatalf("quoted preview = %+v", reply.Reply)
+			}
+		})
+	}
+}
+
+// Walks the conversation back from the latest page, forward again and around
+// messages, each page continuing from the cursors of the one before
+func TestGetMessagesPages(t *testing.T) {
+	useTestStore(t)
+	alice, bob := createTestUser(t, "alice"), createTestUser(t, "bob")
+	makeContacts(t, alice, bob)
+	var sent []*Message
+	for _, text := range []string{"0", "1", "2", "3", "4", "5", "6"} {
+		message, code := sendMessage(t, alice, map[string]interface{}{"to": bob.Id, "message": text})
+		if message == nil {
+			t.Fatalf("save-message = %d", code)
+		}
+		sent = append(sent, message)
+	}
+
+	type page struct {
+		Messages      []Message `json:"messages"`
+		Before        string    `json:"before"`
+		After         string    `json:"after"`
+		HasMoreBefore bool      `json:"hasMoreBefore"`
+		HasMoreAfter  bool      `json:"hasMoreAfter"`
+	}
+	var previous page
+	tests := []struct {
+		name   string
+		anchor func() (string, interface{}) // Picked from the previous page
+		want   string                       // Texts, newest first
+		before bool
+		after  bool
+	}{
+		{"latest", func() (string, interface{}) { return "", nil }, "654", true, false},
+		{"older", func() (string, interface{}) { return "before", previous.Before }, "321", true, true},
+		{"oldest", func() (string, interface{}) { return "before", previous.Before }, "0", false, true},
+		{"newer", func() (string, interface{}) { return "after", previous.After }, "321", true, true},
+		{"newest", func() (string, interface{}) { return "after", previous.After }, "654", true, false},
+		{"nothing newer", func() (string, interface{}) { return "after", previous.After }, "", true, false},
+		{"around the middle", func() (string, interface{}) { return "around", sent[3].Id }, "432", true, true},
+		{"around the newest", func() (string, interface{}) { return "around", sent[6].Id }, "65", true, false},
+		{"around the oldest", func() (string, interface{}) { return "around", sent[0].Id }, "10", false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body := map[string]interface{}{"you": alice.Id, "limit": 3}
+			if key, value := test.anchor(); key != "" {
+				body[key] = value
+			}
+			w := callRoute(t, AppRoute{"/get-messages", getMessages}, "Bearer "+bob.AuthId, body)
+			var got page
+			if err := json.Unmarshal(w.Body.Bytes(), &got); w.Code != http.StatusOK || err != nil {
+				t.Fatalf("get-messages = %d: %s", w.Code, w.Body)
+			}
+			texts := ""
+			for _, message := range got.Messages {
+				texts += message.Message
+			}
+			if texts != test.want || got.HasMoreBefore != test.before || got.HasMoreAfter != test.after {
+				t.Fatalf("page %q, more before %v, after %v, want %q, %v, %v", texts, got.HasMoreBefore, got.HasMoreAfter, test.want, test.before, test.after)
+			}
+			previous = got
+		})
+	}
+}
@@ -3,26 +3,17 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"time"
 
 	db_handler "chat.app/db"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-type User = struct {
-	Id     primitive.ObjectID `json:"_id" bson:"_id"`
-	AuthId string             `json:"authId" bson:"authId"`
-	Email  string             `json:"email" bson:"email"`
-	Name   string             `json:"name" bson:"name"`
-}
+type User = db_handler.User
 
-type ContactsData = struct {
-	Contacts         *[]primitive.ObjectID `json:"contacts" bson:"contacts"`
-	ReceivedRequests *[]primitive.ObjectID `json:"receivedRequests" bson:"receivedRequests"`
-	SentRequests     *[]primitive.ObjectID `json:"sentRequests" bson:"sentRequests"`
-}
+type ContactsData = db_handler.ContactsData
 
 var userRoutes = []AppRoute{
 	{"/get-user-id", getUserId},
@@ -32,6 +23,7 @@ var userRoutes = []AppRoute{
 	{"/update-user-token", updateUserNotificationToken},
 	{"/send-friend-request", sendFriendRequest},
 	{"/accept-friend-request", acceptFriendRequest},
+	{"/update-privacy", updatePrivacy},
 }
 
 var validUserProperties = []string{
@@ -48,20 +40,24 @@ func getUserId(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var user User
-	filter := bson.M{
-		"authId": data.AuthId,
+	if data.AuthId != "" && data.AuthId != callerAuthId(r) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write(responseError("forbidden"))
+		return
 	}
-	err = db_handler.Client().Collection("users").FindOne(
-		context.TODO(),
-		filter,
-	).Decode(&user)
+
+	user, err := db_handler.Storage().GetUserByAuthId(r.Context(), callerAuthId(r))
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
 		return
 	}
-	json_data, json_error := json.Marshal(&user)
+	// Own privacy settings are only visible here
+	type ResponseStruct = struct {
+		*User
+		HidePresence bool `json:"hidePresence"`
+	}
+	json_data, json_error := json.Marshal(&ResponseStruct{user, user.HidePresence})
 	if json_error != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
@@ -83,12 +79,37 @@ func signIn(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(err.Error()))
 		return
 	}
+	if data.AuthId != "" && data.AuthId != callerAuthId(r) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write(responseError("forbidden"))
+		return
+	}
+	// Signing in twice returns the existing account
+	if existing := callerUser(r); existing != nil {
+		json_data, _ := json.Marshal(existing)
+		w.Write(json_data)
+		return
+	}
 	data.Id = primitive.NewObjectID()
-
-	_, err = db_handler.Client().Collection("users").InsertOne(
-		context.TODO(),
-		data,
-	)
+	data.AuthId = callerAuthId(r)
+
+	err = db_handler.Storage().CreateUser(r.Context(), &User{
+		Id:     data.Id,
+		Email:  data.Email,
+		AuthId: data.AuthId,
+	})
+	// A concurrent first sign-in created the account, return that one
+	if errors.Is(err, db_handler.ErrExists) {
+		existing, err := db_handler.Storage().GetUserByAuthId(r.Context(), data.AuthId)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		json_data, _ := json.Marshal(existing)
+		w.Write(json_data)
+		return
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
@@ -115,18 +136,12 @@ func getUserContacts(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var contactsData ContactsData
-	filter := bson.M{
-		"_id": body.Id,
-	}
-	project := bson.M{
-		"contacts":         1,
-		"receivedRequests": 1,
-		"sentRequests":     1,
+	me, ok := authorize(w, r, body.Id)
+	if !ok {
+		return
 	}
-	options := options.FindOne().SetProjection(project)
-	collection := db_handler.Client().Collection("users")
-	err = collection.FindOne(context.TODO(), filter, options).Decode(&contactsData)
+
+	contactsData, err := db_handler.Storage().GetContactsData(r.Context(), me)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
@@ -135,18 +150,46 @@ func getUserContacts(w http.ResponseWriter, r *http.Request) {
 
 	type Contact = struct {
 		User
-		LastMessage *Message `json:"lastMessage"`
+		Presence
+		ConversationId primitive.ObjectID `json:"conversationId"`
+		LastMessage    *Message           `json:"lastMessage"`
+		UnreadCount    int64              `json:"unreadCount"`
+		Retention      RetentionPolicy    `json:"retention"`
+	}
+	type Group = struct {
+		Conversation
+		LastMessage *Message        `json:"lastMessage"`
+		UnreadCount int64           `json:"unreadCount"`
+		Retention   RetentionPolicy `json:"retention"`
 	}
 	type ResponseStruct = struct {
 		Contacts         []Contact            `json:"contacts"`
+		Groups           []Group              `json:"groups"`
 		ReceivedRequests []User               `json:"receivedRequests"`
 		SentRequests     []primitive.ObjectID `json:"sentRequests"`
 	}
 	var response ResponseStruct
 
+	// Last message and unread count of every conversation in one query, most
+	// recently active first
+	summaries, err := db_handler.Storage().GetSummaries(r.Context(), db_handler.SummaryQuery{User: me})
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	direct := make(map[primitive.ObjectID]*ConversationSummary)
+	byConversation := make(map[primitive.ObjectID]*ConversationSummary)
+	for i, summary := range summaries {
+		if summary.With != nil {
+			direct[*summary.With] = &summaries[i]
+		}
+		byConversation[summary.ConversationId] = &summaries[i]
+	}
+
 	if contactsData.Contacts != nil {
 		var contacts []Contact
-		users, err := getArrayOfUserIds(contactsData.Contacts)
+		users, err := db_handler.Storage().GetUsers(r.Context(), *contactsData.Contacts)
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write([]byte(err.Error()))
@@ -155,21 +198,47 @@ func getUserContacts(w http.ResponseWriter, r *http.Request) {
 
 		for _, user := range users {
 			var contact Contact
-			lastMessage, err := getLastMessageBetweenUsers(user.Id, body.Id)
-			if err == nil {
-				contact.Id = user.Id
-				contact.AuthId = user.AuthId
-				contact.Email = user.Email
-				contact.Name = user.Name
-				contact.LastMessage = lastMessage
-				contacts = append(contacts, contact)
+			contact.Id = user.Id
+			contact.AuthId = user.AuthId
+			contact.Email = user.Email
+			contact.Name = user.Name
+			contact.Presence = presenceOf(&user)
+			summary := direct[user.Id]
+			contact.Retention = effectiveRetention(nil)
+			if summary != nil {
+				contact.ConversationId = summary.ConversationId
+				contact.UnreadCount = summary.UnreadCount
+				contact.Retention = effectiveRetention(summary.Retention)
 			}
+			contact.LastMessage = lastMessageOf(summary)
+			contacts = append(contacts, contact)
 		}
 		response.Contacts = contacts
 	}
 
+	conversations, err := db_handler.Storage().GetConversations(r.Context(), me)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	for _, conversation := range conversations {
+		if conversation.Type != db_handler.ConversationGroup {
+			continue
+		}
+		var group Group
+		group.Conversation = conversation
+		group.Retention = effectiveRetention(conversation.Retention)
+		summary := byConversation[conversation.Id]
+		if summary != nil {
+			group.UnreadCount = summary.UnreadCount
+		}
+		group.LastMessage = lastMessageOf(summary)
+		response.Groups = append(response.Groups, group)
+	}
+
 	if contactsData.ReceivedRequests != nil {
-		requests, err := getArrayOfUserIds(contactsData.ReceivedRequests)
+		requests, err := db_handler.Storage().GetUsers(r.Context(), *contactsData.ReceivedRequests)
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write([]byte(err.Error()))
@@ -199,65 +268,54 @@ func sendFriendRequest(w http.ResponseWriter, r *http.Request) {
 	}
 	var body BodyStruct
 	err := json.NewDecoder(r.Body).Decode(&body)
-	// Can't send friend request to yourself
-	if err != nil && body.From != body.To {
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(err.Error()))
+		w.Write(responseError("bad call"))
 		return
 	}
-
-	// Update sender
-	collection := db_handler.Client().Collection("users")
-	sender := bson.M{
-		"_id": body.From,
-	}
-	senderUpdate := bson.M{
-		"$push": bson.M{
-			"sentRequests": body.To,
-		},
-	}
-
-	// Update receiver
-	receiver := bson.M{
-		"_id": body.To,
+	var ok bool
+	if body.From, ok = authorize(w, r, body.From); !ok {
+		return
 	}
-	receiverUpdate := bson.M{
-		"$push": bson.M{
-			"receivedRequests": body.From,
-		},
+	// Can't send friend request to yourself
+	if body.From == body.To {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("bad call"))
+		return
 	}
 
-	type User = struct {
-		Type  string `json:"type" bson:"type"`
-		Email string `json:"email" bson:"email"`
-		Name  string `json:"name" bson:"name"`
-		Id    string `json:"_id" bson:"_id"`
+	_, err = db_handler.Storage().GetUser(r.Context(), body.To)
+	if errors.Is(err, db_handler.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(responseError("User not found"))
+		return
 	}
-	var user User
-	// Send info about user who sends the request to the one receiving the request
-	err = collection.FindOne(context.TODO(), bson.M{"_id": body.From}).Decode(&user)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
 		return
 	}
-	user.Type = "request-received"
-	// Notify who received the request trough WS
-	if clients[body.To.Hex()] != nil {
-		clients[body.To.Hex()].WriteJSON(user)
-	}
 
-	type requests = struct {
-		SentRequests []primitive.ObjectID `json:"sentRequests" bson:"sentRequests"`
+	sentRequests, err := db_handler.Storage().SendFriendRequest(r.Context(), body.From, body.To)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
 	}
-	var results requests
-	collection.FindOneAndUpdate(context.TODO(), receiver, receiverUpdate)
-	collection.FindOneAndUpdate(context.TODO(), sender, senderUpdate).Decode(&results)
+	// Send info about user who sends the request to the one receiving the request
+	sender := callerUser(r)
+	contact := ContactPayload{
+		Id:    sender.Id,
+		Email: sender.Email,
+		Name:  sender.Name,
+	}
+	// Notify who received the request trough WS, once it's stored
+	publish(r.Context(), body.To, newEnvelope(EventRequestReceived, contact))
 	// Send request data to who made the request
-	json_data, json_err := json.Marshal(&results.SentRequests)
+	json_data, json_err := json.Marshal(&sentRequests)
 	if json_err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(err.Error()))
+		w.Write([]byte(json_err.Error()))
 		return
 	}
 	w.WriteHeader(200)
@@ -271,75 +329,65 @@ func acceptFriendRequest(w http.ResponseWriter, r *http.Request) {
 	}
 	var body BodyStruct
 	err := json.NewDecoder(r.Body).Decode(&body)
-	if err != nil && body.From != body.To {
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(err.Error()))
+		w.Write(responseError("bad call"))
 		return
 	}
-
-	collection := db_handler.Client().Collection("users")
-
-	// Update sender
-	sender := bson.M{
-		"_id": body.From,
-	}
-	senderUpdate := bson.M{
-		"$pull": bson.M{
-			"sentRequests": body.To,
-		},
-		"$push": bson.M{
-			"contacts": body.To,
-		},
+	var ok bool
+	if body.To, ok = authorize(w, r, body.To); !ok {
+		return
 	}
-
-	// Update receiver
-	receiver := bson.M{
-		"_id": body.To,
+	if body.From == body.To {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("bad call"))
+		return
 	}
-	receiverUpdate := bson.M{
-		"$pull": bson.M{
-			"receivedRequests": body.From,
-		},
-		"$push": bson.M{
-			"contacts": body.From,
-		},
+	// Only requests that were actually received can be accepted
+	contactsData, err := db_handler.Storage().GetContactsData(r.Context(), body.To)
+	if err != nil || contactsData.ReceivedRequests == nil || !containsId(*contactsData.ReceivedRequests, body.From) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("no such request"))
+		return
 	}
 
-	collection.FindOneAndUpdate(context.TODO(), receiver, receiverUpdate)
-	collection.FindOneAndUpdate(context.TODO(), sender, senderUpdate)
-	type User = struct {
-		Id    string `json:"_id" bson:"_id"`
-		Email string `json:"email" bson:"email"`
-		Name  string `json:"name" bson:"name"`
-		Type  string `json:"type" bson:"type"`
+	err = db_handler.Storage().AcceptFriendRequest(r.Context(), body.From, body.To)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
 	}
-	var user User // Who sent the request
 	// Return new contact info to who accepted the request
-	err = collection.FindOne(context.TODO(), bson.M{"_id": body.To}).Decode(&user)
+	accepter, err := db_handler.Storage().GetUser(r.Context(), body.To)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
 		return
 	}
-	user.Type = "request-accepted"
-	// Notify original sender trough WS
-	if clients[body.From.Hex()] != nil {
-		err := clients[body.From.Hex()].WriteJSON(user)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(err.Error()))
-			return
-		}
+	contact := ContactPayload{
+		Id:    accepter.Id,
+		Email: accepter.Email,
+		Name:  accepter.Name,
 	}
+	// Notify original sender trough WS
+	publish(r.Context(), body.From, newEnvelope(EventRequestAccepted, contact))
 	w.WriteHeader(200)
 	w.Write([]byte(`{"success": true}`))
 }
 
+func isContact(ctx context.Context, user primitive.ObjectID, other primitive.ObjectID) (bool, error) {
+	contactsData, err := db_handler.Storage().GetContactsData(ctx, user)
+	if err != nil {
+		return false, err
+	}
+	return contactsData.Contacts != nil && containsId(*contactsData.Contacts, other), nil
+}
+
 func updateUser(w http.ResponseWriter, r *http.Request) {
 	type BodyStruct = struct {
 		Id    primitive.ObjectID `json:"_id" bson:"_id"`
 		Prop  string             `json:"prop"`
-		Value string             `json:"value`
+		Value string             `json:"value"`
 	}
 	var body BodyStruct
 	err := json.NewDecoder(r.Body).Decode(&body)
@@ -348,22 +396,22 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(err.Error()))
 		return
 	}
+	var ok bool
+	if body.Id, ok = authorize(w, r, body.Id); !ok {
+		return
+	}
 	if !contains(validUserProperties, body.Prop) {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write(responseError("bad call"))
 		return
 	}
 
-	collection := db_handler.Client().Collection("users")
-	filter := bson.M{
-		"_id": body.Id,
-	}
-	setter := bson.M{
-		"$set": bson.M{
-			body.Prop: body.Value,
-		},
+	err = db_handler.Storage().SetUserProperty(r.Context(), body.Id, body.Prop, body.Value)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Unable to update"))
+		return
 	}
-	collection.FindOneAndUpdate(context.TODO(), filter, setter)
 
 	w.WriteHeader(200)
 	w.Write([]byte(`{"success": true}`))
@@ -383,16 +431,17 @@ func updateUserData(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	collection := db_handler.Client().Collection("users")
-	filter := bson.M{
-		"_id": body.Id,
+	var ok bool
+	if body.Id, ok = authorize(w, r, body.Id); !ok {
+		return
 	}
-	setter := bson.M{
-		"$set": bson.M{
-			"name": body.Name,
-		},
+
+	err = db_handler.Storage().SetUserProperty(r.Context(), body.Id, "name", body.Name)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Unable to update"))
+		return
 	}
-	collection.FindOneAndUpdate(context.TODO(), filter, setter)
 
 	w.WriteHeader(200)
 	w.Write([]byte(`{"success": true}`))
@@ -412,35 +461,32 @@ func updateUserNotificationToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	collection := db_handler.Client().Collection("users")
-	filter := bson.M{
-		"_id": body.Id,
+	var ok bool
+	if body.Id, ok = authorize(w, r, body.Id); !ok {
+		return
 	}
-	setter := bson.M{
-		"$set": bson.M{
-			"token": body.Token,
-		},
+
+	err = db_handler.Storage().SetUserToken(r.Context(), body.Id, body.Token)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Unable to update"))
+		return
 	}
-	collection.FindOneAndUpdate(context.TODO(), filter, setter)
 	w.WriteHeader(200)
 	w.Write([]byte(`{"success": true}`))
 }
 
-func getArrayOfUserIds(ids *[]primitive.ObjectID) ([]User, error) {
-	filter := bson.M{
-		"_id": bson.M{
-			"$in": ids,
-		},
-	}
-	var users []User
-	collection := db_handler.Client().Collection("users")
-	contacts_cursor, contacts_err := collection.Find(context.TODO(), filter)
-	if contacts_err != nil {
-		return nil, contacts_err
-	}
-	err := contacts_cursor.All(context.TODO(), &users)
-	if err != nil {
-		return nil, err
-	}
-	return users, nil
+// Last message of a conversation summary. Contacts without messages get an
+// empty one dated 1995 so they sort last.
+func lastMessageOf(summary *ConversationSummary) *Message {
+	if summary != nil && summary.LastMessage != nil {
+		return summary.LastMessage
+	}
+	message := &Message{}
+	message.Id = primitive.NewObjectID()
+	message.CreatedAt = time.Date(1995, 0, 0, 0, 0, 0, 0, time.Local)
+	message.From = primitive.NewObjectID()
+	message.To = primitive.NewObjectID()
+	message.Message = ""
+	return message
 }
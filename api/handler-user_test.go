@@ -0,0 +1,56 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	db_handler "chat.app/db"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func eventTypes(t *testing.T, user primitive.ObjectID) []string {
+	t.Helper()
+	events, err := db_handler.Storage().GetEvents(context.Background(), user, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+func TestSendFriendRequest(t *testing.T) {
+	useTestStore(t)
+	alice := createTestUser(t, "alice")
+	bob := createTestUser(t, "bob")
+	route := AppRoute{"/send-friend-request", sendFriendRequest}
+
+	// Nothing is stored or announced for users that don't exist
+	nobody := primitive.NewObjectID()
+	w := callRoute(t, route, "Bearer "+alice.AuthId, map[string]interface{}{"to": nobody})
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("request to an unknown user = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	if types := eventTypes(t, nobody); len(types) != 0 {
+		t.Fatalf("unknown user got events %v", types)
+	}
+	data, err := db_handler.Storage().GetContactsData(context.Background(), alice.Id)
+	if err != nil || (data.SentRequests != nil && len(*data.SentRequests) > 0) {
+		t.Fatalf("sender's requests = %+v, %v", data, err)
+	}
+
+	w = callRoute(t, route, "Bearer "+alice.AuthId, map[string]interface{}{"to": bob.Id})
+	if w.Code != http.StatusOK {
+		t.Fatalf("request = %d: %s", w.Code, w.Body)
+	}
+	if types := eventTypes(t, bob.Id); len(types) != 1 || types[0] != EventRequestReceived {
+		t.Fatalf("receiver's events = %v, want one %s", types, EventRequestReceived)
+	}
+	data, err = db_handler.Storage().GetContactsData(context.Background(), bob.Id)
+	if err != nil || data.ReceivedRequests == nil || len(*data.ReceivedRequests) != 1 {
+		t.Fatalf("receiver's requests = %+v, %v", data, err)
+	}
+}
@@ -0,0 +1,372 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	db_handler "chat.app/db"
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Application close codes sent when a socket's credential stops being valid
+const (
+	closeUnauthorized = 4001
+	closeTokenExpired = 4002
+	closeTokenRevoked = 4003
+)
+
+// How long a client has to send its credential frame after connecting
+var authFrameTimeout = 10 * time.Second
+
+// How often sockets are checked for revoked credentials
+var revocationCheckInterval = 5 * time.Minute
+
+// Rejection of a client frame, sent back as an error envelope
+type frameError struct {
+	Code    string
+	Message string
+}
+
+func (e *frameError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+var errBadPayload = &frameError{"bad-payload", "invalid payload"}
+
+// Handlers for client frames, keyed by event type
+var frameHandlers = map[string]func(client *hubClient, envelope Envelope) error{
+	EventRelay:         handleRelay,
+	EventSend:          handleSend,
+	EventRead:          handleRead,
+	EventTypingStarted: handleTyping,
+	EventTypingStopped: handleTyping,
+	EventResume:        handleResume,
+}
+
+func closeSocket(ws *websocket.Conn, code int, reason string) {
+	message := websocket.FormatCloseMessage(code, reason)
+	ws.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+	ws.Close()
+}
+
+// Reads the auth frame sent by clients that can't put the token in the URL or
+// headers of the upgrade request
+func readAuthFrame(ws *websocket.Conn) (*User, string, time.Time, error) {
+	var envelope Envelope
+	var auth AuthPayload
+	ws.SetReadDeadline(time.Now().Add(authFrameTimeout))
+	if err := ws.ReadJSON(&envelope); err != nil {
+		return nil, "", time.Time{}, err
+	}
+	if envelope.Type != EventAuth || json.Unmarshal(envelope.Payload, &auth) != nil {
+		return nil, "", time.Time{}, errUnauthorized
+	}
+	ws.SetReadDeadline(time.Time{})
+	user, expires, err := authenticateToken(context.Background(), auth.Token)
+	return user, auth.Token, expires, err
+}
+
+// Closes the socket once the token expires or, if the verifier supports it,
+// gets revoked. The returned function stops watching.
+func watchCredential(ws *websocket.Conn, token string, expires time.Time) func() {
+	done := make(chan struct{})
+	checker, canCheck := verifier.(RevocationChecker)
+	go func() {
+		expired := time.NewTimer(time.Until(expires))
+		defer expired.Stop()
+		revocation := time.NewTicker(revocationCheckInterval)
+		defer revocation.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-expired.C:
+				closeSocket(ws, closeTokenExpired, "token expired")
+				return
+			case <-revocation.C:
+				if !canCheck {
+					continue
+				}
+				revoked, err := checker.Revoked(context.Background(), token)
+				if err != nil {
+					log.Printf("revocation check: %v", err)
+					continue
+				}
+				if revoked {
+					closeSocket(ws, closeTokenRevoked, "token revoked")
+					return
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// Authenticates the upgrade request with a bearer token, the "token" query
+// parameter or, failing both, an auth frame, then serves client frames.
+func handleConnections(w http.ResponseWriter, r *http.Request) {
+	var user *User
+	var expires time.Time
+	var err error
+	version := negotiateVersion(r)
+	if version == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("unsupported protocol version"))
+		return
+	}
+	token := bearerToken(r)
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	if token != "" {
+		user, expires, err = authenticateToken(r.Context(), token)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write(responseError(err.Error()))
+			return
+		}
+	}
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("error: %v", err)
+		return
+	}
+	defer ws.Close()
+	ws.SetReadLimit(socketConfig.MaxMessageSize)
+
+	if user == nil {
+		user, token, expires, err = readAuthFrame(ws)
+		if err != nil {
+			closeSocket(ws, closeUnauthorized, "unauthorized")
+			return
+		}
+	}
+	stop := watchCredential(ws, token, expires)
+	defer stop()
+
+	// Half open connections stop answering pings and hit the read deadline
+	ws.SetReadDeadline(time.Now().Add(socketConfig.PongTimeout))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(socketConfig.PongTimeout))
+	})
+
+	client := hub.Register(user.Id.Hex(), version, ws)
+	defer func() {
+		hub.Unregister(client)
+		if !hub.Connected(client.userId) {
+			typing.stopAll(client.userId)
+		}
+	}()
+	hub.Reply(client, newEnvelope(EventHello, HelloPayload{
+		Version: version,
+		UserId:  client.userId,
+	}))
+	for {
+		var envelope Envelope
+		err := ws.ReadJSON(&envelope)
+		if err != nil {
+			var syntaxError *json.SyntaxError
+			var typeError *json.UnmarshalTypeError
+			if errors.As(err, &syntaxError) || errors.As(err, &typeError) {
+				hub.Reply(client, errorEnvelope("", "bad-frame", "frames must be JSON envelopes"))
+				continue
+			}
+			log.Printf("error: %v", err)
+			break
+		}
+		ws.SetReadDeadline(time.Now().Add(socketConfig.PongTimeout))
+		dispatchFrame(client, envelope)
+	}
+}
+
+func dispatchFrame(client *hubClient, envelope Envelope) {
+	handler, exists := frameHandlers[envelope.Type]
+	if !exists {
+		hub.Reply(client, errorEnvelope(envelope.Id, "unknown-type", "unknown event type "+envelope.Type))
+		return
+	}
+	if err := handler(client, envelope); err != nil {
+		var rejection *frameError
+		if errors.As(err, &rejection) {
+			hub.Reply(client, errorEnvelope(envelope.Id, rejection.Code, rejection.Message))
+		} else {
+			log.Printf("error: %v", err)
+			hub.Reply(client, errorEnvelope(envelope.Id, "internal", "unable to process frame"))
+		}
+	}
+}
+
+// Relay frames each user can send per window
+var relayLimiter = newRateLimiter(30, 10*time.Second)
+
+var errRateLimited = &frameError{"rate-limited", "too many frames, slow down"}
+
+// Forwards ephemeral text as is to the connections of a contact or of someone
+// the sender shares a conversation with
+func handleRelay(client *hubClient, envelope Envelope) error {
+	var relay RelayPayload
+	if err := json.Unmarshal(envelope.Payload, &relay); err != nil {
+		return errBadPayload
+	}
+	if !relayLimiter.allow(client.userId) {
+		return errRateLimited
+	}
+	from, err := primitive.ObjectIDFromHex(client.userId)
+	if err != nil {
+		return err
+	}
+	to, err := primitive.ObjectIDFromHex(relay.To)
+	if err != nil {
+		return errBadPayload
+	}
+	reachable, err := canReach(context.Background(), from, to)
+	if err != nil {
+		return err
+	}
+	if !reachable {
+		return &frameError{"not-a-contact", "relay frames are only sent to contacts and conversation members"}
+	}
+
+	relay.From = client.userId
+	hub.Send(relay.To, newEnvelope(EventRelay, relay))
+	return nil
+}
+
+// Whether the users are contacts or members of a same conversation
+func canReach(ctx context.Context, user primitive.ObjectID, other primitive.ObjectID) (bool, error) {
+	contact, err := isContact(ctx, user, other)
+	if err != nil || contact {
+		return contact, err
+	}
+	conversations, err := db_handler.Storage().GetConversations(ctx, user)
+	if err != nil {
+		return false, err
+	}
+	for _, conversation := range conversations {
+		if containsId(conversation.Members, other) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Stores and delivers a message like /save-message, then acks it using the
+// frame id as correlation id
+func handleSend(client *hubClient, envelope Envelope) error {
+	var send SendPayload
+	if envelope.Id == "" {
+		return &frameError{"missing-id", "send frames need an id"}
+	}
+	if err := json.Unmarshal(envelope.Payload, &send); err != nil {
+		return errBadPayload
+	}
+	from, err := primitive.ObjectIDFromHex(client.userId)
+	if err != nil {
+		return err
+	}
+
+	message := Message{
+		To:             send.To,
+		ConversationId: send.ConversationId,
+		Message:        send.Message,
+		Title:          send.Title,
+		ReplyTo:        send.ReplyTo,
+	}
+	for _, id := range send.Attachments {
+		message.Attachments = append(message.Attachments, AttachmentRef{Id: id})
+	}
+	err = postMessage(context.Background(), from, &message, func() {
+		ack := newEnvelope(EventAck, AckPayload{
+			MessageId: message.Id,
+			CreatedAt: message.CreatedAt,
+		})
+		ack.Id = envelope.Id
+		hub.Reply(client, ack)
+	})
+	if errors.Is(err, errInvalidMessage) {
+		return &frameError{"invalid-message", err.Error()}
+	}
+	return err
+}
+
+func handleRead(client *hubClient, envelope Envelope) error {
+	var read ReadPayload
+	if err := json.Unmarshal(envelope.Payload, &read); err != nil || (read.With.IsZero() && read.ConversationId.IsZero()) {
+		return errBadPayload
+	}
+	reader, err := primitive.ObjectIDFromHex(client.userId)
+	if err != nil {
+		return err
+	}
+	err = markRead(context.Background(), reader, read.With, read.ConversationId, read.UpTo)
+	if errors.Is(err, errNotMember) {
+		return &frameError{"not-a-member", err.Error()}
+	}
+	return err
+}
+
+// Typing frames each user can send per window, across all their contacts
+var typingLimiter = newRateLimiter(30, 10*time.Second)
+
+// Typing indicators only go to contacts and are never stored
+func handleTyping(client *hubClient, envelope Envelope) error {
+	var payload TypingPayload
+	if err := json.Unmarshal(envelope.Payload, &payload); err != nil {
+		return errBadPayload
+	}
+	if !typingLimiter.allow(client.userId) {
+		return errRateLimited
+	}
+	// Only indicators already checked and started can be stopped
+	if envelope.Type == EventTypingStopped {
+		typing.stop(client.userId, payload.To)
+		return nil
+	}
+
+	// Refreshes of an active indicator skip the contacts lookup
+	if !typing.isActive(client.userId, payload.To) {
+		from, err := primitive.ObjectIDFromHex(client.userId)
+		if err != nil {
+			return err
+		}
+		to, err := primitive.ObjectIDFromHex(payload.To)
+		if err != nil {
+			return errBadPayload
+		}
+		contact, err := isContact(context.Background(), from, to)
+		if err != nil {
+			return err
+		}
+		if !contact {
+			return &frameError{"not-a-contact", "typing indicators are only sent to contacts"}
+		}
+	}
+	typing.start(client.userId, payload.To)
+	return nil
+}
+
+func handleResume(client *hubClient, envelope Envelope) error {
+	var resume ResumePayload
+	if err := json.Unmarshal(envelope.Payload, &resume); err != nil {
+		return errBadPayload
+	}
+	user, err := primitive.ObjectIDFromHex(client.userId)
+	if err != nil {
+		return err
+	}
+	events, hasMore, err := eventsAfter(context.Background(), user, resume.AfterSeq, resume.After, resume.Limit)
+	if err != nil {
+		return &frameError{"bad-cursor", "unknown event cursor"}
+	}
+
+	resumed := newEnvelope(EventResumed, ResumedPayload{Events: events, HasMore: hasMore})
+	resumed.Id = envelope.Id
+	hub.Reply(client, resumed)
+	return nil
+}
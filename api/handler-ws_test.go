@@ -0,0 +1,212 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	db_handler "chat.app/db"
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Serves handleConnections with a hub of its own
+func newSocketServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	previousHub := hub
+	hub = NewHub()
+	var handlers sync.WaitGroup
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.Add(1)
+		defer handlers.Done()
+		handleConnections(w, r)
+	}))
+	// Runs after the sockets are closed, the handlers return before the
+	// store and hub are put back
+	t.Cleanup(func() {
+		server.Close()
+		handlers.Wait()
+		hub = previousHub
+	})
+	return server
+}
+
+// Connects as the user and waits for the hello frame
+func connectUser(t *testing.T, server *httptest.Server, user *User) *testSocket {
+	t.Helper()
+	header := http.Header{"Origin": {origins[0]}}
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "?token=" + user.AuthId
+	client, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	socket := &testSocket{
+		client:   client,
+		received: make(chan Envelope, 1024),
+		closed:   make(chan error, 1),
+	}
+	go socket.read()
+	socket.expect(t, EventHello)
+	return socket
+}
+
+func sendFrame(t *testing.T, socket *testSocket, eventType string, payload interface{}) {
+	t.Helper()
+	envelope := newEnvelope(eventType, payload)
+	if err := socket.client.WriteJSON(envelope); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectErrorCode(t *testing.T, socket *testSocket, code string) {
+	t.Helper()
+	var payload ErrorPayload
+	envelope := socket.expect(t, EventError)
+	if err := json.Unmarshal(envelope.Payload, &payload); err != nil || payload.Code != code {
+		t.Fatalf("error frame %s, want code %s", envelope.Payload, code)
+	}
+}
+
+func makeContacts(t *testing.T, a *User, b *User) {
+	t.Helper()
+	ctx := context.Background()
+	if _, err := db_handler.Storage().SendFriendRequest(ctx, a.Id, b.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := db_handler.Storage().AcceptFriendRequest(ctx, a.Id, b.Id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRelay(t *testing.T) {
+	useTestStore(t)
+	server := newSocketServer(t)
+	alice, bob, mallory := createTestUser(t, "alice"), createTestUser(t, "bob"), createTestUser(t, "mallory")
+	makeContacts(t, alice, bob)
+	aliceSocket, bobSocket := connectUser(t, server, alice), connectUser(t, server, bob)
+	mallorySocket := connectUser(t, server, mallory)
+
+	sendFrame(t, mallorySocket, EventRelay, RelayPayload{To: bob.Id.Hex(), Message: "hi"})
+	expectErrorCode(t, mallorySocket, "not-a-contact")
+
+	sendFrame(t, aliceSocket, EventRelay, RelayPayload{From: mallory.Id.Hex(), To: bob.Id.Hex(), Message: "hi"})
+	var relay RelayPayload
+	envelope := bobSocket.expect(t, EventRelay)
+	if err := json.Unmarshal(envelope.Payload, &relay); err != nil || relay.From != alice.Id.Hex() || relay.Message != "hi" {
+		t.Fatalf("bob got %s", envelope.Payload)
+	}
+	select {
+	case envelope := <-bobSocket.received:
+		t.Fatalf("bob got a %s frame from the rejected relay", envelope.Type)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRelayRateLimit(t *testing.T) {
+	useTestStore(t)
+	server := newSocketServer(t)
+	previousLimiter := relayLimiter
+	relayLimiter = newRateLimiter(3, time.Hour)
+	t.Cleanup(func() { relayLimiter = previousLimiter })
+	alice, bob := createTestUser(t, "alice"), createTestUser(t, "bob")
+	makeContacts(t, alice, bob)
+	aliceSocket, bobSocket := connectUser(t, server, alice), connectUser(t, server, bob)
+
+	for i := 0; i < 3; i++ {
+		sendFrame(t, aliceSocket, EventRelay, RelayPayload{To: bob.Id.Hex()})
+		bobSocket.expect(t, EventRelay)
+	}
+	sendFrame(t, aliceSocket, EventRelay, RelayPayload{To: bob.Id.Hex()})
+	expectErrorCode(t, aliceSocket, "rate-limited")
+}
+
+// Frames that aren't envelopes are answered with bad-frame, the socket stays open
+func TestBadFrames(t *testing.T) {
+	useTestStore(t)
+	server := newSocketServer(t)
+	socket := connectUser(t, server, createTestUser(t, "alice"))
+
+	for _, frame := range []string{`{"type"}`, `{"type": 5}`, `[1, 2]`} {
+		if err := socket.client.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+			t.Fatal(err)
+		}
+		expectErrorCode(t, socket, "bad-frame")
+	}
+	sendFrame(t, socket, "nonsense", struct{}{})
+	expectErrorCode(t, socket, "unknown-type")
+}
+
+// Counts contact lookups
+type countingStore struct {
+	db_handler.Store
+	mu      sync.Mutex
+	lookups int
+}
+
+func (s *countingStore) GetContactsData(ctx context.Context, id primitive.ObjectID) (*db_handler.ContactsData, error) {
+	s.mu.Lock()
+	s.lookups++
+	s.mu.Unlock()
+	return s.Store.GetContactsData(ctx, id)
+}
+
+func (s *countingStore) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lookups
+}
+
+func TestTyping(t *testing.T) {
+	useTestStore(t)
+	store := &countingStore{Store: db_handler.Storage()}
+	db_handler.SetStorage(store)
+	server := newSocketServer(t)
+	alice, bob, mallory := createTestUser(t, "alice"), createTestUser(t, "bob"), createTestUser(t, "mallory")
+	makeContacts(t, alice, bob)
+	aliceSocket, bobSocket := connectUser(t, server, alice), connectUser(t, server, bob)
+	mallorySocket := connectUser(t, server, mallory)
+
+	sendFrame(t, mallorySocket, EventTypingStarted, TypingPayload{To: bob.Id.Hex()})
+	expectErrorCode(t, mallorySocket, "not-a-contact")
+
+	lookups := store.count()
+	for i := 0; i < 3; i++ {
+		sendFrame(t, aliceSocket, EventTypingStarted, TypingPayload{To: bob.Id.Hex()})
+	}
+	bobSocket.expect(t, EventTypingStarted)
+	sendFrame(t, aliceSocket, EventTypingStopped, TypingPayload{To: bob.Id.Hex()})
+	bobSocket.expect(t, EventTypingStopped)
+	if store.count()-lookups != 1 {
+		t.Fatalf("%d contact lookups for one active indicator, want 1", store.count()-lookups)
+	}
+}
+
+// Senders over the limit are turned away before the contacts are looked up
+func TestTypingRateLimit(t *testing.T) {
+	useTestStore(t)
+	store := &countingStore{Store: db_handler.Storage()}
+	db_handler.SetStorage(store)
+	server := newSocketServer(t)
+	previousLimiter := typingLimiter
+	typingLimiter = newRateLimiter(3, time.Hour)
+	t.Cleanup(func() { typingLimiter = previousLimiter })
+	mallory := createTestUser(t, "mallory")
+	socket := connectUser(t, server, mallory)
+
+	for i := 0; i < 3; i++ {
+		sendFrame(t, socket, EventTypingStarted, TypingPayload{To: primitive.NewObjectID().Hex()})
+		expectErrorCode(t, socket, "not-a-contact")
+	}
+	lookups := store.count()
+	sendFrame(t, socket, EventTypingStarted, TypingPayload{To: primitive.NewObjectID().Hex()})
+	expectErrorCode(t, socket, "rate-limited")
+	if store.count() != lookups {
+		t.Fatal("rate-limited frame looked up contacts")
+	}
+}
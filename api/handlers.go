@@ -1,7 +1,6 @@
 package api
 
 import (
-	"context"
 	"encoding/json"
 	"log"
 	"net/http"
@@ -9,20 +8,12 @@ import (
 
 	db_handler "chat.app/db"
 	"github.com/gorilla/websocket"
-	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-type WSMessage struct {
-	Timestamp int    `json:"timestamp"`
-	Message   string `json:"message"`
-	Id        string `json:"id"`
-	To        string `json:"to"`
-}
-
-var clients = make(map[string]*websocket.Conn)
-var broadcast = make(chan WSMessage)
 var origins = []string{"https://simple-chat-ui.vercel.app"}
 var upgrader = websocket.Upgrader{
+	Subprotocols: subprotocols(),
 	CheckOrigin: func(r *http.Request) bool {
 		var origin = r.Header.Get("Origin")
 		if os.Getenv("LOCAL") == "true" {
@@ -52,6 +43,12 @@ var routeGroups = [][]AppRoute{
 	generalRoutes,
 	userRoutes,
 	messageRoutes,
+	attachmentRoutes,
+	groupRoutes,
+	conversationRoutes,
+	searchRoutes,
+	reactionRoutes,
+	eventRoutes,
 }
 
 func InitRouterFunctions() {
@@ -60,20 +57,17 @@ func InitRouterFunctions() {
 		group := routeGroups[i]
 		for j := 0; j < len(group); j++ {
 			route := group[j]
-			http.HandleFunc(route.Path, func(w http.ResponseWriter, r *http.Request) {
-				if validateCall(w, r) {
-					route.Callback(w, r)
-				} else {
-					w.WriteHeader(http.StatusBadRequest)
-					w.Write([]byte((`"error": "bad call"`)))
-				}
-			})
+			http.HandleFunc(route.Path, routeHandler(route))
 		}
 	}
 
+	loadRetentionConfig()
+	startSweeper()
+
 	// Websocket connections
+	loadSocketConfig()
+	hub.onPresence = presenceChanged
 	http.HandleFunc("/ws", handleConnections)
-	go handleMessages()
 
 	// Initialize server
 	log.Println("http server started on :" + os.Getenv("PORT"))
@@ -83,8 +77,32 @@ func InitRouterFunctions() {
 	}
 }
 
+// Checks the origin and authenticates the caller before running the route
+func routeHandler(route AppRoute) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !validateCall(w, r) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte((`"error": "bad call"`)))
+			return
+		}
+		// CORS preflight, browsers don't send credentials here
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		ctx, err := authenticate(r)
+		if err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write(responseError(err.Error()))
+			return
+		}
+		route.Callback(w, r.WithContext(ctx))
+	}
+}
+
 func validateCall(w http.ResponseWriter, r *http.Request) bool {
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
 	if os.Getenv("LOCAL") == "true" {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		return true
@@ -108,8 +126,17 @@ func contains(elems []string, v string) bool {
 	return false
 }
 
+func containsId(ids []primitive.ObjectID, id primitive.ObjectID) bool {
+	for _, existing := range ids {
+		if existing == id {
+			return true
+		}
+	}
+	return false
+}
+
 func responseError(message string) []byte {
-	return []byte(`{ "error": ` + `"` + message + `"`)
+	return []byte(`{ "error": ` + `"` + message + `" }`)
 }
 
 func queryContacts(w http.ResponseWriter, r *http.Request) {
@@ -124,29 +151,13 @@ func queryContacts(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	filter := bson.M{
-		"$text": bson.M{
-			"$search":             body.SearchTerm,
-			"$caseSensitive":      false,
-			"$diacriticSensitive": false,
-		},
-	}
-
-	var results []User
-	collection := db_handler.Client().Collection("users")
-	cursor, err := collection.Find(context.TODO(), filter)
+	results, err := db_handler.Storage().SearchUsers(r.Context(), body.SearchTerm)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
 		return
 	}
 
-	if err = cursor.All(context.TODO(), &results); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(err.Error()))
-		return
-	}
-
 	if len(results) > 0 {
 		json_data, json_error := json.Marshal(&results)
 		if json_error != nil {
@@ -159,37 +170,3 @@ func queryContacts(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("[]"))
 	}
 }
-
-func handleConnections(w http.ResponseWriter, r *http.Request) {
-	query := r.URL.Query()
-	ws, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer ws.Close()
-	clients[query.Get("id")] = ws
-	for {
-		var msg WSMessage
-		err := ws.ReadJSON(&msg)
-		if err != nil {
-			log.Printf("error: %v", err)
-			delete(clients, query.Get("id"))
-			break
-		}
-		broadcast <- msg
-	}
-}
-
-func handleMessages() {
-	for {
-		msg := <-broadcast
-		if clients[msg.To] != nil {
-			err := clients[msg.To].WriteJSON(msg)
-			if err != nil {
-				log.Printf("error: %v", err)
-				clients[msg.To].Close()
-				delete(clients, msg.To)
-			}
-		}
-	}
-}
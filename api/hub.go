@@ -0,0 +1,170 @@
+package api
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Frames queued per connection before it's considered too slow and dropped
+var sendBufferSize = 64
+
+// A registered socket. All writes go through send and are performed by the
+// connection's own write goroutine, gorilla/websocket allows one writer only.
+type hubClient struct {
+	userId  string
+	version int
+	conn    *websocket.Conn
+	send    chan Envelope
+}
+
+// Owns the live WebSocket connections, safe for concurrent use. A user can
+// be connected from several devices at once, every event goes to all of them.
+type Hub struct {
+	mu      sync.RWMutex
+	clients map[string]map[*hubClient]struct{}
+	// Called when a user's first connection registers and when their last
+	// one goes away
+	onPresence func(userId string, online bool)
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		clients: make(map[string]map[*hubClient]struct{}),
+	}
+}
+
+var hub = NewHub()
+
+// Registers conn as one more connection of the user, speaking the given
+// protocol version, and starts its write goroutine.
+func (h *Hub) Register(userId string, version int, conn *websocket.Conn) *hubClient {
+	client := &hubClient{
+		userId:  userId,
+		version: version,
+		conn:    conn,
+		send:    make(chan Envelope, sendBufferSize),
+	}
+	h.mu.Lock()
+	first := h.clients[userId] == nil
+	if first {
+		h.clients[userId] = make(map[*hubClient]struct{})
+	}
+	h.clients[userId][client] = struct{}{}
+	h.mu.Unlock()
+
+	go h.writePump(client)
+	if first && h.onPresence != nil {
+		h.onPresence(userId, true)
+	}
+	return client
+}
+
+// Removes the client if still registered, the user's other connections are
+// left alone. Safe to call more than once.
+func (h *Hub) Unregister(client *hubClient) {
+	h.mu.Lock()
+	connections := h.clients[client.userId]
+	if _, exists := connections[client]; !exists {
+		h.mu.Unlock()
+		return
+	}
+	delete(connections, client)
+	last := len(connections) == 0
+	if last {
+		delete(h.clients, client.userId)
+	}
+	close(client.send)
+	h.mu.Unlock()
+
+	if last && h.onPresence != nil {
+		h.onPresence(client.userId, false)
+	}
+}
+
+// Queues the envelope for delivery to every connection of the user, returns
+// false when the user has none. Never blocks, connections with a full buffer
+// are dropped.
+func (h *Hub) Send(userId string, envelope Envelope) bool {
+	var slow []*hubClient
+	delivered := false
+	h.mu.RLock()
+	for client := range h.clients[userId] {
+		select {
+		case client.send <- envelope:
+			delivered = true
+		default:
+			slow = append(slow, client)
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, client := range slow {
+		log.Printf("dropping slow connection of %s", userId)
+		h.Unregister(client)
+	}
+	return delivered
+}
+
+// Queues the envelope for a single connection, e.g. a reply to its own frame
+func (h *Hub) Reply(client *hubClient, envelope Envelope) bool {
+	h.mu.RLock()
+	if _, exists := h.clients[client.userId][client]; !exists {
+		h.mu.RUnlock()
+		return false
+	}
+	select {
+	case client.send <- envelope:
+		h.mu.RUnlock()
+		return true
+	default:
+		h.mu.RUnlock()
+		log.Printf("dropping slow connection of %s", client.userId)
+		h.Unregister(client)
+		return false
+	}
+}
+
+func (h *Hub) Connected(userId string) bool {
+	return h.Connections(userId) > 0
+}
+
+// Number of devices the user is connected from
+func (h *Hub) Connections(userId string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.clients[userId])
+}
+
+// Writes queued frames and periodic pings until the client is unregistered,
+// then closes the connection so its read loop exits too.
+func (h *Hub) writePump(client *hubClient) {
+	ping := time.NewTicker(socketConfig.PingInterval)
+	defer func() {
+		ping.Stop()
+		client.conn.Close()
+	}()
+	for {
+		select {
+		case envelope, ok := <-client.send:
+			client.conn.SetWriteDeadline(time.Now().Add(socketConfig.WriteTimeout))
+			if !ok {
+				client.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				return
+			}
+			if err := client.conn.WriteJSON(envelope); err != nil {
+				log.Printf("error: %v", err)
+				h.Unregister(client)
+				return
+			}
+		case <-ping.C:
+			client.conn.SetWriteDeadline(time.Now().Add(socketConfig.WriteTimeout))
+			if err := client.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				h.Unregister(client)
+				return
+			}
+		}
+	}
+}
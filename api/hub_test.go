@@ -0,0 +1,295 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Connected WebSocket pair: the server side is what the hub registers, the
+// client side is read until it closes, keeping the frames it gets
+type testSocket struct {
+	server   *websocket.Conn
+	client   *websocket.Conn
+	received chan Envelope
+	closed   chan error
+}
+
+func newTestServer(t *testing.T) (*httptest.Server, chan *websocket.Conn) {
+	t.Helper()
+	conns := make(chan *websocket.Conn)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var upgrader websocket.Upgrader
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		conns <- ws
+	}))
+	t.Cleanup(server.Close)
+	return server, conns
+}
+
+func dialTestSocket(t *testing.T, server *httptest.Server, conns chan *websocket.Conn) *testSocket {
+	t.Helper()
+	socket, err := openTestSocket(t, server, conns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return socket
+}
+
+// Same without failing the test, for other goroutines than the test's
+func openTestSocket(t *testing.T, server *httptest.Server, conns chan *websocket.Conn) (*testSocket, error) {
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { client.Close() })
+	socket := &testSocket{
+		server:   <-conns,
+		client:   client,
+		received: make(chan Envelope, 1024),
+		closed:   make(chan error, 1),
+	}
+	go socket.read()
+	return socket, nil
+}
+
+func (s *testSocket) read() {
+	for {
+		var envelope Envelope
+		if err := s.client.ReadJSON(&envelope); err != nil {
+			s.closed <- err
+			return
+		}
+		select {
+		case s.received <- envelope:
+		default:
+		}
+	}
+}
+
+func (s *testSocket) expect(t *testing.T, eventType string) Envelope {
+	t.Helper()
+	select {
+	case envelope := <-s.received:
+		if envelope.Type != eventType {
+			t.Fatalf("got a %s frame, want %s", envelope.Type, eventType)
+		}
+		return envelope
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no %s frame", eventType)
+		return Envelope{}
+	}
+}
+
+// The send channel is closed once unregistered, whatever is left in it is
+// drained first
+func expectClosedSend(t *testing.T, client *hubClient) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		for range client.send {
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("send channel not closed")
+	}
+}
+
+func TestHubSendsToEveryConnection(t *testing.T) {
+	server, conns := newTestServer(t)
+	hub := NewHub()
+	var presence []string
+	var mu sync.Mutex
+	hub.onPresence = func(userId string, online bool) {
+		mu.Lock()
+		presence = append(presence, fmt.Sprintf("%s:%v", userId, online))
+		mu.Unlock()
+	}
+
+	phone, laptop := dialTestSocket(t, server, conns), dialTestSocket(t, server, conns)
+	first := hub.Register("alice", ProtocolVersion, phone.server)
+	second := hub.Register("alice", ProtocolVersion, laptop.server)
+	if hub.Connections("alice") != 2 {
+		t.Fatalf("alice has %d connections, want 2", hub.Connections("alice"))
+	}
+
+	if !hub.Send("alice", newEnvelope(EventPresence, struct{}{})) {
+		t.Fatal("Send to a connected user returned false")
+	}
+	phone.expect(t, EventPresence)
+	laptop.expect(t, EventPresence)
+	if !hub.Reply(second, newEnvelope(EventAck, struct{}{})) {
+		t.Fatal("Reply to a registered connection returned false")
+	}
+	laptop.expect(t, EventAck)
+	if hub.Send("bob", newEnvelope(EventPresence, struct{}{})) {
+		t.Fatal("Send to a user without connections returned true")
+	}
+
+	hub.Unregister(first)
+	if !hub.Connected("alice") || hub.Connections("alice") != 1 {
+		t.Fatalf("alice has %d connections after closing one, want 1", hub.Connections("alice"))
+	}
+	hub.Unregister(second)
+	if hub.Connected("alice") {
+		t.Fatal("alice still connected")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(presence, ",") != "alice:true,alice:false" {
+		t.Fatalf("presence changes = %v, want online once and offline once", presence)
+	}
+}
+
+func TestHubSendAfterUnregister(t *testing.T) {
+	server, conns := newTestServer(t)
+	hub := NewHub()
+	socket := dialTestSocket(t, server, conns)
+	client := hub.Register("alice", ProtocolVersion, socket.server)
+
+	hub.Unregister(client)
+	// Unregistering twice, e.g. by the read loop and a failed write, is fine
+	hub.Unregister(client)
+	expectClosedSend(t, client)
+
+	if hub.Send("alice", newEnvelope(EventPresence, struct{}{})) {
+		t.Fatal("Send after unregistering returned true")
+	}
+	if hub.Reply(client, newEnvelope(EventAck, struct{}{})) {
+		t.Fatal("Reply after unregistering returned true")
+	}
+
+	// The write goroutine says goodbye and closes the socket
+	select {
+	case err := <-socket.closed:
+		if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+			t.Fatalf("socket closed with %v, want a normal closure", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("socket not closed")
+	}
+}
+
+// Registers, sends to and unregisters connections of a few users from many
+// goroutines at once, run it with -race
+func TestHubConcurrentUse(t *testing.T) {
+	server, conns := newTestServer(t)
+	hub := NewHub()
+	var online int64
+	hub.onPresence = func(userId string, connected bool) {
+		if connected {
+			atomic.AddInt64(&online, 1)
+		} else {
+			atomic.AddInt64(&online, -1)
+		}
+	}
+	users := []string{"alice", "bob", "carol", "dave"}
+
+	stop := make(chan struct{})
+	var senders sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		senders.Add(1)
+		go func(i int) {
+			defer senders.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				hub.Send(users[(i+n)%len(users)], newEnvelope(EventPresence, struct{}{}))
+				hub.Connections(users[n%len(users)])
+				runtime.Gosched()
+			}
+		}(i)
+	}
+
+	var workers sync.WaitGroup
+	var clients []*hubClient
+	var clientsMu sync.Mutex
+	for i := 0; i < 16; i++ {
+		workers.Add(1)
+		go func(i int) {
+			defer workers.Done()
+			for n := 0; n < 10; n++ {
+				socket, err := openTestSocket(t, server, conns)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				user := users[(i+n)%len(users)]
+				client := hub.Register(user, ProtocolVersion, socket.server)
+				clientsMu.Lock()
+				clients = append(clients, client)
+				clientsMu.Unlock()
+
+				for _, to := range users {
+					hub.Send(to, newEnvelope(EventPresence, struct{}{}))
+				}
+				hub.Reply(client, newEnvelope(EventAck, struct{}{}))
+				// The read loop and a failed write can both unregister
+				workers.Add(1)
+				go func() {
+					defer workers.Done()
+					hub.Unregister(client)
+				}()
+				hub.Unregister(client)
+				hub.Send(user, newEnvelope(EventPresence, struct{}{}))
+			}
+		}(i)
+	}
+	workers.Wait()
+	close(stop)
+	senders.Wait()
+
+	for _, user := range users {
+		if hub.Connected(user) {
+			t.Fatalf("%s still has %d connections", user, hub.Connections(user))
+		}
+	}
+	for _, client := range clients {
+		expectClosedSend(t, client)
+	}
+	if count := atomic.LoadInt64(&online); count != 0 {
+		t.Fatalf("%d users left online", count)
+	}
+}
+
+func TestHubDeliversInOrder(t *testing.T) {
+	server, conns := newTestServer(t)
+	hub := NewHub()
+	socket := dialTestSocket(t, server, conns)
+	client := hub.Register("alice", ProtocolVersion, socket.server)
+	defer hub.Unregister(client)
+
+	for i := 0; i < sendBufferSize/2; i++ {
+		envelope := newEnvelope(EventMessage, i)
+		if !hub.Send("alice", envelope) {
+			t.Fatalf("frame %d not queued", i)
+		}
+	}
+	for i := 0; i < sendBufferSize/2; i++ {
+		var n int
+		envelope := socket.expect(t, EventMessage)
+		if err := json.Unmarshal(envelope.Payload, &n); err != nil || n != i {
+			t.Fatalf("frame %d carried %s", i, envelope.Payload)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	db_handler "chat.app/db"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Presence as seen by contacts, both fields are left empty when the user
+// hides it
+type Presence struct {
+	Online   *bool      `json:"online,omitempty"`
+	LastSeen *time.Time `json:"lastSeen,omitempty"`
+}
+
+func presenceOf(user *User) Presence {
+	if user.HidePresence {
+		return Presence{}
+	}
+	online := hub.Connected(user.Id.Hex())
+	return Presence{Online: &online, LastSeen: user.LastSeen}
+}
+
+// Hub callback, runs when a user's first connection opens or the last one
+// closes. Going offline records lastSeen, then contacts are told.
+func presenceChanged(userId string, online bool) {
+	id, err := primitive.ObjectIDFromHex(userId)
+	if err != nil {
+		return
+	}
+	ctx := context.Background()
+	if !online {
+		if err := db_handler.Storage().SetLastSeen(ctx, id, time.Now().UTC()); err != nil {
+			log.Printf("error: %v", err)
+		}
+	}
+	// Connections can flap, only announce the state the user is still in
+	if hub.Connected(userId) != online {
+		return
+	}
+	user, err := db_handler.Storage().GetUser(ctx, id)
+	if err != nil {
+		log.Printf("error: %v", err)
+		return
+	}
+	if !user.HidePresence {
+		broadcastPresence(ctx, user, presenceOf(user))
+	}
+}
+
+func broadcastPresence(ctx context.Context, user *User, presence Presence) {
+	contactsData, err := db_handler.Storage().GetContactsData(ctx, user.Id)
+	if err != nil || contactsData.Contacts == nil {
+		return
+	}
+	envelope := newEnvelope(EventPresence, PresencePayload{
+		UserId:   user.Id,
+		Presence: presence,
+	})
+	for _, contact := range *contactsData.Contacts {
+		hub.Send(contact.Hex(), envelope)
+	}
+}
+
+func updatePrivacy(w http.ResponseWriter, r *http.Request) {
+	type BodyStruct = struct {
+		HidePresence bool `json:"hidePresence"`
+	}
+	var body BodyStruct
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	user := callerUser(r)
+	err = db_handler.Storage().SetHidePresence(r.Context(), user.Id, body.HidePresence)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Unable to update"))
+		return
+	}
+
+	// Contacts drop or get back the user's presence right away
+	if body.HidePresence != user.HidePresence {
+		user.HidePresence = body.HidePresence
+		broadcastPresence(r.Context(), user, presenceOf(user))
+	}
+	json_data, _ := json.Marshal(&body)
+	w.Write(json_data)
+}
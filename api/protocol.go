@@ -0,0 +1,308 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Version of the WebSocket protocol spoken by this server. Clients offer the
+// versions they support as "simple-chat.v<N>" subprotocols or with the "v"
+// query parameter, the highest one both sides know is used and announced in
+// the hello frame. Clients that offer nothing get the current version.
+const ProtocolVersion = 1
+
+// Oldest protocol version still accepted
+const minProtocolVersion = 1
+
+const subprotocolPrefix = "simple-chat.v"
+
+// Every frame, in both directions, is an Envelope. Id is generated by the
+// server for events it emits and by the client for frames it sends, replies
+// to a client frame (acks, errors) carry the id of that frame. Durable events
+// (message*, reaction, receipt, request-*, conversation-updated,
+// retention-changed) are kept in the user's event log, numbered by Seq in the
+// order they were stored, and can be replayed by passing the last Seq seen to
+// resume or /sync. Events about a message expire with it.
+type Envelope struct {
+	Type      string          `json:"type"`
+	Id        string          `json:"id,omitempty"`
+	Seq       int64           `json:"seq,omitempty"` // Position in the user's event log, durable events only
+	Timestamp int64           `json:"timestamp"`     // Unix milliseconds
+	Payload   json.RawMessage `json:"payload,omitempty"`
+}
+
+// Event types.
+//
+// Client to server:
+//
+//	auth                  AuthPayload, first frame when the token isn't in the upgrade request
+//	relay                 RelayPayload, ephemeral text forwarded to a contact or conversation member, never stored
+//	send                  SendPayload, new message to a user or a group, stored and answered with an ack
+//	read                  ReadPayload, marks a conversation or group read up to a message
+//	typing-started        TypingPayload, the user is typing to a contact, repeat to keep it alive
+//	typing-stopped        TypingPayload, the user stopped typing
+//	resume                ResumePayload, replay durable events missed while offline
+//
+// Server to client:
+//
+//	hello                 HelloPayload, first frame after authentication
+//	ack                   AckPayload, the send frame with the same id was stored
+//	resumed               ResumedPayload, answer to resume, same id as the request
+//	message               Message, a new message sent to or by the user
+//	message-edited        Message, a message of one of the user's conversations was edited
+//	message-deleted       MessageDeletedPayload, a message was deleted for everyone or by the user
+//	reaction              ReactionPayload, a reaction was added to or removed from a message
+//	receipt               ReceiptPayload, messages of the user were delivered or read
+//	relay                 RelayPayload, forwarded from another user
+//	typing-started        TypingPayload, a contact is typing to the user
+//	typing-stopped        TypingPayload, a contact stopped typing or timed out
+//	presence              PresencePayload, a contact came online or went offline
+//	request-received      ContactPayload, someone sent the user a friend request
+//	request-accepted      ContactPayload, a friend request of the user was accepted
+//	conversation-updated  ConversationPayload, a group the user is or was in changed
+//	retention-changed     RetentionPayload, a member changed the retention of one of the user's conversations
+//	error                 ErrorPayload, a client frame was rejected
+const (
+	EventAuth                = "auth"
+	EventRelay               = "relay"
+	EventSend                = "send"
+	EventRead                = "read"
+	EventTypingStarted       = "typing-started"
+	EventTypingStopped       = "typing-stopped"
+	EventPresence            = "presence"
+	EventResume              = "resume"
+	EventResumed             = "resumed"
+	EventHello               = "hello"
+	EventAck                 = "ack"
+	EventMessage             = "message"
+	EventMessageEdited       = "message-edited"
+	EventMessageDeleted      = "message-deleted"
+	EventReaction            = "reaction"
+	EventReceipt             = "receipt"
+	EventRequestReceived     = "request-received"
+	EventRequestAccepted     = "request-accepted"
+	EventConversationUpdated = "conversation-updated"
+	EventRetentionChanged    = "retention-changed"
+	EventError               = "error"
+)
+
+// Payload type of each event, for documentation and client generators
+var EventPayloads = map[string]interface{}{
+	EventAuth:                AuthPayload{},
+	EventRelay:               RelayPayload{},
+	EventSend:                SendPayload{},
+	EventRead:                ReadPayload{},
+	EventTypingStarted:       TypingPayload{},
+	EventTypingStopped:       TypingPayload{},
+	EventPresence:            PresencePayload{},
+	EventResume:              ResumePayload{},
+	EventResumed:             ResumedPayload{},
+	EventHello:               HelloPayload{},
+	EventAck:                 AckPayload{},
+	EventMessage:             Message{},
+	EventMessageEdited:       Message{},
+	EventMessageDeleted:      MessageDeletedPayload{},
+	EventReaction:            ReactionPayload{},
+	EventReceipt:             ReceiptPayload{},
+	EventRequestReceived:     ContactPayload{},
+	EventRequestAccepted:     ContactPayload{},
+	EventConversationUpdated: ConversationPayload{},
+	EventRetentionChanged:    RetentionPayload{},
+	EventError:               ErrorPayload{},
+}
+
+type AuthPayload struct {
+	Token string `json:"token"`
+}
+
+type HelloPayload struct {
+	Version int    `json:"version"`
+	UserId  string `json:"userId"`
+}
+
+type RelayPayload struct {
+	From    string `json:"from"` // Set by the server
+	To      string `json:"to"`
+	Message string `json:"message"`
+}
+
+// Either the conversation or, for direct messages, the other user
+type SendPayload struct {
+	To             primitive.ObjectID  `json:"to"`
+	ConversationId primitive.ObjectID  `json:"conversationId"`
+	Message        string              `json:"message"`
+	Title          string              `json:"title"` // Push notification title
+	ReplyTo        *primitive.ObjectID `json:"replyTo,omitempty"`
+	// Uploaded with /upload-attachment, the text can be empty when set
+	Attachments []primitive.ObjectID `json:"attachments,omitempty"`
+}
+
+type AckPayload struct {
+	MessageId primitive.ObjectID `json:"messageId"`
+	CreatedAt time.Time          `json:"createdAt"`
+}
+
+type ReadPayload struct {
+	With           primitive.ObjectID `json:"with"`           // The other participant
+	ConversationId primitive.ObjectID `json:"conversationId"` // Instead of With
+	UpTo           primitive.ObjectID `json:"upTo"`           // Newest message read, empty for all
+}
+
+// ForEveryone is false when the user deleted it only for themselves, which is
+// only announced to their own devices
+type MessageDeletedPayload struct {
+	MessageId   primitive.ObjectID `json:"messageId"`
+	ForEveryone bool               `json:"forEveryone"`
+	At          time.Time          `json:"at"`
+}
+
+// Counts are the message's reactions after the change
+type ReactionPayload struct {
+	MessageId primitive.ObjectID `json:"messageId"`
+	UserId    primitive.ObjectID `json:"userId"`
+	Emoji     string             `json:"emoji"`
+	Removed   bool               `json:"removed"`
+	Counts    map[string]int     `json:"counts"`
+}
+
+const (
+	ReceiptDelivered = "delivered"
+	ReceiptRead      = "read"
+)
+
+// A conversation with the retention in effect for it
+type ConversationPayload struct {
+	Conversation
+	Retention RetentionPolicy `json:"retention"`
+}
+
+// Announced to every member, Retention is what applies from now on
+type RetentionPayload struct {
+	ConversationId primitive.ObjectID `json:"conversationId"`
+	Retention      RetentionPolicy    `json:"retention"`
+	ChangedBy      primitive.ObjectID `json:"changedBy"`
+	At             time.Time          `json:"at"`
+}
+
+// Every message of the conversation sent to By up to and including UpTo
+// reached the given status
+type ReceiptPayload struct {
+	ConversationId primitive.ObjectID `json:"conversationId"`
+	Status         string             `json:"status"`
+	By             primitive.ObjectID `json:"by"`
+	UpTo           primitive.ObjectID `json:"upTo"`
+	At             time.Time          `json:"at"`
+}
+
+type TypingPayload struct {
+	From string `json:"from"` // Set by the server
+	To   string `json:"to"`
+}
+
+type PresencePayload struct {
+	UserId primitive.ObjectID `json:"userId"`
+	Presence
+}
+
+// AfterSeq is the seq of the last event seen, older clients pass its id in
+// After instead. Neither set replays everything retained.
+type ResumePayload struct {
+	AfterSeq int64  `json:"afterSeq"`
+	After    string `json:"after"`
+	Limit    int64  `json:"limit"`
+}
+
+// Missed events in order, resume again from the last one while HasMore
+type ResumedPayload struct {
+	Events  []Envelope `json:"events"`
+	HasMore bool       `json:"hasMore"`
+}
+
+type ContactPayload struct {
+	Id    primitive.ObjectID `json:"_id"`
+	Email string             `json:"email"`
+	Name  string             `json:"name"`
+}
+
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func newEnvelope(eventType string, payload interface{}) Envelope {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		// Payloads are our own structs, this is a programming error
+		panic(fmt.Sprintf("marshal %s payload: %v", eventType, err))
+	}
+	return Envelope{
+		Type:      eventType,
+		Id:        primitive.NewObjectID().Hex(),
+		Timestamp: time.Now().UnixMilli(),
+		Payload:   data,
+	}
+}
+
+// Error reply to the client frame with the given id
+func errorEnvelope(requestId string, code string, message string) Envelope {
+	envelope := newEnvelope(EventError, ErrorPayload{Code: code, Message: message})
+	if requestId != "" {
+		envelope.Id = requestId
+	}
+	return envelope
+}
+
+func subprotocols() []string {
+	var protocols []string
+	for version := ProtocolVersion; version >= minProtocolVersion; version-- {
+		protocols = append(protocols, subprotocolPrefix+strconv.Itoa(version))
+	}
+	return protocols
+}
+
+// Picks the highest supported version offered by the upgrade request, 0 when
+// the client only offered versions this server doesn't speak.
+func negotiateVersion(r *http.Request) int {
+	var offered []int
+	for _, protocol := range websocketProtocols(r) {
+		if version, err := strconv.Atoi(strings.TrimPrefix(protocol, subprotocolPrefix)); err == nil && strings.HasPrefix(protocol, subprotocolPrefix) {
+			offered = append(offered, version)
+		}
+	}
+	if value := r.URL.Query().Get("v"); value != "" {
+		version, err := strconv.Atoi(value)
+		if err != nil {
+			return 0
+		}
+		offered = append(offered, version)
+	}
+	if len(offered) == 0 {
+		return ProtocolVersion
+	}
+
+	best := 0
+	for _, version := range offered {
+		if version >= minProtocolVersion && version <= ProtocolVersion && version > best {
+			best = version
+		}
+	}
+	return best
+}
+
+func websocketProtocols(r *http.Request) []string {
+	var protocols []string
+	for _, header := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(header, ",") {
+			if protocol = strings.TrimSpace(protocol); protocol != "" {
+				protocols = append(protocols, protocol)
+			}
+		}
+	}
+	return protocols
+}
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"sync"
+	"time"
+)
+
+type limitWindow struct {
+	start time.Time
+	count int
+}
+
+// Allows each key a number of events per fixed window, e.g. frames of a
+// sender. Kept in memory, counts of idle keys are dropped every window.
+type rateLimiter struct {
+	mu       sync.Mutex
+	limit    int
+	window   time.Duration
+	counts   map[string]*limitWindow
+	prunedAt time.Time
+}
+
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:  limit,
+		window: window,
+		counts: make(map[string]*limitWindow),
+	}
+}
+
+// Counts the event, false once the key is over its limit for this window
+func (l *rateLimiter) allow(key string) bool {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.prunedAt) >= l.window {
+		for k, counted := range l.counts {
+			if now.Sub(counted.start) >= l.window {
+				delete(l.counts, k)
+			}
+		}
+		l.prunedAt = now
+	}
+	counted := l.counts[key]
+	if counted == nil || now.Sub(counted.start) >= l.window {
+		counted = &limitWindow{start: now}
+		l.counts[key] = counted
+	}
+	counted.count++
+	return counted.count <= l.limit
+}
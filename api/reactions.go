@@ -0,0 +1,98 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	db_handler "chat.app/db"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Longest reaction accepted, in bytes. Emoji sequences with skin tones and
+// joiners are well below it.
+const maxReactionSize = 32
+
+var reactionRoutes = []AppRoute{
+	{"/add-reaction", addReaction},
+	{"/remove-reaction", removeReaction},
+}
+
+// Fills ReactionCounts from the per-user reactions
+func countReactions(message *Message) {
+	message.ReactionCounts = nil
+	for _, emojis := range message.Reactions {
+		for _, emoji := range emojis {
+			if message.ReactionCounts == nil {
+				message.ReactionCounts = make(map[string]int)
+			}
+			message.ReactionCounts[emoji]++
+		}
+	}
+}
+
+func validReaction(emoji string) bool {
+	return emoji != "" && len(emoji) <= maxReactionSize && utf8.ValidString(emoji) &&
+		!strings.ContainsAny(emoji, " \t\r\n")
+}
+
+func addReaction(w http.ResponseWriter, r *http.Request) {
+	react(w, r, false)
+}
+
+func removeReaction(w http.ResponseWriter, r *http.Request) {
+	react(w, r, true)
+}
+
+// Any participant can react to a message they can see, all of them get the
+// change
+func react(w http.ResponseWriter, r *http.Request, remove bool) {
+	type BodyStruct = struct {
+		Id    primitive.ObjectID `json:"_id"`
+		Emoji string             `json:"emoji"`
+	}
+	var data BodyStruct
+	err := json.NewDecoder(r.Body).Decode(&data)
+	if err != nil || !validReaction(data.Emoji) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Bad request"))
+		return
+	}
+	user := callerUser(r)
+	message, err := db_handler.Storage().GetMessage(r.Context(), data.Id)
+	if err != nil || message.Deleted || !canSee(r.Context(), user.Id, message) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(responseError("Message not found"))
+		return
+	}
+
+	if remove {
+		message, err = db_handler.Storage().RemoveReaction(r.Context(), data.Id, user.Id, data.Emoji)
+	} else {
+		message, err = db_handler.Storage().AddReaction(r.Context(), data.Id, user.Id, data.Emoji)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Unable to update"))
+		return
+	}
+	countReactions(message)
+
+	envelope := newEnvelope(EventReaction, ReactionPayload{
+		MessageId: message.Id,
+		UserId:    user.Id,
+		Emoji:     data.Emoji,
+		Removed:   remove,
+		Counts:    message.ReactionCounts,
+	})
+	publishToParticipants(r.Context(), message, envelope)
+
+	json_data, json_error := json.Marshal(message)
+	if json_error != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Bad data"))
+		return
+	}
+	w.Write(json_data)
+}
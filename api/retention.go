@@ -0,0 +1,208 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	db_handler "chat.app/db"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Retention policies conversations can pick, how long their messages are kept
+const (
+	RetentionDay     = "24h"
+	RetentionWeek    = "7d"
+	RetentionQuarter = "90d"
+	RetentionForever = "forever"
+)
+
+var retentionPolicies = map[string]time.Duration{
+	RetentionDay:     24 * time.Hour,
+	RetentionWeek:    7 * 24 * time.Hour,
+	RetentionQuarter: 90 * 24 * time.Hour,
+	RetentionForever: 0,
+}
+
+// Policy of conversations that don't set their own
+var defaultRetention = RetentionWeek
+
+// How often expired messages and attachments are swept
+var sweepInterval = time.Minute
+
+// Uploads no message claimed within this time are removed
+const unsentAttachmentLifetime = 24 * time.Hour
+
+// Most attachments removed by one sweep, the rest wait for the next one
+const sweepBatch = 500
+
+// The retention in effect for a conversation
+type RetentionPolicy struct {
+	Policy       string `json:"policy"`
+	Disappearing bool   `json:"disappearing,omitempty"`
+	// No member set one, this is the server default
+	Default bool                `json:"default,omitempty"`
+	SetBy   *primitive.ObjectID `json:"setBy,omitempty"`
+	SetAt   *time.Time          `json:"setAt,omitempty"`
+}
+
+// Overrides the defaults with MESSAGE_RETENTION (one of the policies) and
+// RETENTION_SWEEP_INTERVAL (duration). Invalid values are logged and ignored.
+func loadRetentionConfig() {
+	if value := os.Getenv("MESSAGE_RETENTION"); value != "" {
+		if _, ok := retentionPolicies[value]; ok {
+			defaultRetention = value
+		} else {
+			log.Printf("invalid MESSAGE_RETENTION %q, using %s", value, defaultRetention)
+		}
+	}
+	if value := os.Getenv("RETENTION_SWEEP_INTERVAL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			log.Printf("invalid RETENTION_SWEEP_INTERVAL %q, using %v", value, sweepInterval)
+		} else {
+			sweepInterval = parsed
+		}
+	}
+}
+
+func effectiveRetention(setting *db_handler.RetentionSetting) RetentionPolicy {
+	if setting == nil {
+		return RetentionPolicy{Policy: defaultRetention, Default: true}
+	}
+	setBy, setAt := setting.SetBy, setting.SetAt
+	return RetentionPolicy{
+		Policy:       setting.Policy,
+		Disappearing: setting.Disappearing,
+		SetBy:        &setBy,
+		SetAt:        &setAt,
+	}
+}
+
+func conversationPayload(conversation *Conversation) ConversationPayload {
+	return ConversationPayload{
+		Conversation: *conversation,
+		Retention:    effectiveRetention(conversation.Retention),
+	}
+}
+
+// Applies the conversation's retention to a new message. Changing the policy
+// only affects the messages sent after it.
+func applyRetention(conversation *Conversation, message *Message) {
+	policy := effectiveRetention(conversation.Retention)
+	message.ExpireAt = nil
+	message.Disappearing = policy.Disappearing
+	if duration := retentionPolicies[policy.Policy]; duration > 0 {
+		expireAt := message.CreatedAt.Add(duration)
+		message.ExpireAt = &expireAt
+	}
+}
+
+// Any member sets the retention of a conversation, by id or with the other
+// user for direct ones, an empty policy goes back to the server default.
+// Disappearing mode needs a policy that expires. Every member hears about
+// the change. A shorter policy applies to the event logs right away.
+func setRetention(w http.ResponseWriter, r *http.Request) {
+	type BodyStruct = struct {
+		ConversationId primitive.ObjectID `json:"conversationId"`
+		With           primitive.ObjectID `json:"with"`
+		Policy         string             `json:"policy"`
+		Disappearing   bool               `json:"disappearing"`
+	}
+	var body BodyStruct
+	err := json.NewDecoder(r.Body).Decode(&body)
+	duration, known := retentionPolicies[body.Policy]
+	if err != nil || (body.Policy != "" && !known) || (body.Disappearing && (body.Policy == "" || duration == 0)) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Bad request"))
+		return
+	}
+	user := callerUser(r)
+	target := Message{To: body.With, ConversationId: body.ConversationId}
+	conversation, err := conversationOfMessage(r.Context(), user.Id, &target)
+	if errors.Is(err, errInvalidMessage) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(responseError("Conversation not found"))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Unable to get"))
+		return
+	}
+
+	previous := retentionPolicies[effectiveRetention(conversation.Retention).Policy]
+	now := time.Now().UTC()
+	var setting *db_handler.RetentionSetting
+	if body.Policy != "" {
+		setting = &db_handler.RetentionSetting{
+			Policy:       body.Policy,
+			Disappearing: body.Disappearing,
+			SetBy:        user.Id,
+			SetAt:        now,
+		}
+	}
+	conversation, err = db_handler.Storage().SetRetention(r.Context(), conversation.Id, setting, now)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Unable to update"))
+		return
+	}
+	// Forever is 0, longer than anything
+	current := retentionPolicies[effectiveRetention(conversation.Retention).Policy]
+	if current > 0 && (previous == 0 || current < previous) {
+		if _, err = db_handler.Storage().ShortenConversationEvents(r.Context(), conversation.Id, current, now); err != nil {
+			log.Printf("error: %v", err)
+		}
+	}
+	changed := newEnvelope(EventRetentionChanged, RetentionPayload{
+		ConversationId: conversation.Id,
+		Retention:      effectiveRetention(conversation.Retention),
+		ChangedBy:      user.Id,
+		At:             now,
+	})
+	for _, member := range conversation.Members {
+		publish(r.Context(), member, changed)
+	}
+
+	json_data, json_error := json.Marshal(conversationPayload(conversation))
+	if json_error != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Bad data"))
+		return
+	}
+	w.Write(json_data)
+}
+
+// Runs sweepExpired every sweepInterval for as long as the server runs
+func startSweeper() {
+	go func() {
+		ticker := time.NewTicker(sweepInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			sweepExpired(context.Background())
+		}
+	}()
+}
+
+// Removes expired messages from stores without native expiration, then the
+// attachments of expired messages and uploads never sent, with their blobs
+func sweepExpired(ctx context.Context) {
+	now := time.Now().UTC()
+	if sweeper, ok := db_handler.Storage().(db_handler.MessageSweeper); ok {
+		if _, err := sweeper.DeleteExpiredMessages(ctx, now); err != nil {
+			log.Printf("error sweeping messages: %v", err)
+		}
+	}
+	attachments, err := db_handler.Storage().DeleteExpiredAttachments(ctx, now, now.Add(-unsentAttachmentLifetime), sweepBatch)
+	if err != nil {
+		log.Printf("error sweeping attachments: %v", err)
+	}
+	for i := range attachments {
+		deleteBlobs(ctx, &attachments[i])
+	}
+}
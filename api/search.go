@@ -0,0 +1,302 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	db_handler "chat.app/db"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	defaultSearchPage = 20
+	maxSearchPage     = 50
+	// Longest query accepted, in characters
+	maxSearchLength = 200
+	// Text shown around the first match of each result, in characters
+	searchSnippetLength = 120
+)
+
+var searchRoutes = []AppRoute{
+	{"/search-messages", searchMessages},
+}
+
+// Part of a result's snippet, Match is set on the parts that matched the query
+type SnippetPart struct {
+	Text  string `json:"text"`
+	Match bool   `json:"match,omitempty"`
+}
+
+// Splits the query into words and "quoted phrases", words match the start of
+// a word and phrases whole words in a row
+func parseSearch(query string) ([]string, [][]string) {
+	var words []string
+	var phrases [][]string
+	for i, part := range strings.Split(query, `"`) {
+		if i%2 == 0 {
+			words = append(words, db_handler.SearchWords(part)...)
+		} else if phrase := db_handler.SearchWords(part); len(phrase) > 0 {
+			phrases = append(phrases, phrase)
+		}
+	}
+	return words, phrases
+}
+
+type textRange struct {
+	start int
+	end   int
+}
+
+// Rune ranges of the text matching the query, in order and not overlapping
+func searchMatches(text []rune, words []string, phrases [][]string) []textRange {
+	var tokens []textRange
+	for i := 0; i < len(text); {
+		if !unicode.IsLetter(text[i]) && !unicode.IsNumber(text[i]) {
+			i++
+			continue
+		}
+		start := i
+		for i < len(text) && (unicode.IsLetter(text[i]) || unicode.IsNumber(text[i])) {
+			i++
+		}
+		tokens = append(tokens, textRange{start, i})
+	}
+	lower := make([]string, len(tokens))
+	for i, token := range tokens {
+		lower[i] = strings.ToLower(string(text[token.start:token.end]))
+	}
+
+	var matches []textRange
+	for i, token := range tokens {
+		for _, word := range words {
+			if strings.HasPrefix(lower[i], word) {
+				matches = append(matches, token)
+				break
+			}
+		}
+		for _, phrase := range phrases {
+			if i+len(phrase) > len(tokens) {
+				continue
+			}
+			found := true
+			for j, word := range phrase {
+				found = found && lower[i+j] == word
+			}
+			if found {
+				matches = append(matches, textRange{token.start, tokens[i+len(phrase)-1].end})
+			}
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].start < matches[j].start
+	})
+	var merged []textRange
+	for _, match := range matches {
+		if len(merged) > 0 && match.start <= merged[len(merged)-1].end {
+			if match.end > merged[len(merged)-1].end {
+				merged[len(merged)-1].end = match.end
+			}
+			continue
+		}
+		merged = append(merged, match)
+	}
+	return merged
+}
+
+// Part of the text around its first match, split in matching and non
+// matching parts. Cut ends are marked with an ellipsis.
+func highlight(message string, words []string, phrases [][]string) []SnippetPart {
+	text := []rune(message)
+	matches := searchMatches(text, words, phrases)
+
+	start, end := 0, len(text)
+	if len(text) > searchSnippetLength {
+		if len(matches) > 0 {
+			start = matches[0].start - searchSnippetLength/4
+		}
+		if start+searchSnippetLength > len(text) {
+			start = len(text) - searchSnippetLength
+		}
+		if start < 0 {
+			start = 0
+		}
+		end = start + searchSnippetLength
+	}
+
+	var parts []SnippetPart
+	add := func(text string, match bool) {
+		if text != "" {
+			parts = append(parts, SnippetPart{Text: text, Match: match})
+		}
+	}
+	if start > 0 {
+		add("…", false)
+	}
+	position := start
+	for _, match := range matches {
+		if match.end <= start || match.start >= end {
+			continue
+		}
+		matchStart, matchEnd := match.start, match.end
+		if matchStart < position {
+			matchStart = position
+		}
+		if matchEnd > end {
+			matchEnd = end
+		}
+		add(string(text[position:matchStart]), false)
+		add(string(text[matchStart:matchEnd]), true)
+		position = matchEnd
+	}
+	add(string(text[position:end]), false)
+	if end < len(text) {
+		add("…", false)
+	}
+	return parts
+}
+
+// Searches the caller's conversations, or one of them when conversationId or
+// contact is given. Only conversations the caller is a member of are ever
+// searched.
+func searchMessages(w http.ResponseWriter, r *http.Request) {
+	type BodyStruct = struct {
+		Query          string             `json:"query"`
+		ConversationId primitive.ObjectID `json:"conversationId"`
+		Contact        primitive.ObjectID `json:"contact"` // Direct conversation with this user
+		Since          *time.Time         `json:"since"`
+		Until          *time.Time         `json:"until"`
+		Limit          int64              `json:"limit"`
+		Cursor         string             `json:"cursor"`
+	}
+	var body BodyStruct
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || len([]rune(body.Query)) > maxSearchLength || body.Limit < 0 ||
+		(!body.ConversationId.IsZero() && !body.Contact.IsZero()) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Bad request"))
+		return
+	}
+	words, phrases := parseSearch(body.Query)
+	if len(words) == 0 && len(phrases) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Empty query"))
+		return
+	}
+	if body.Limit == 0 {
+		body.Limit = defaultSearchPage
+	}
+	if body.Limit > maxSearchPage {
+		body.Limit = maxSearchPage
+	}
+	user := callerUser(r)
+
+	type Result = struct {
+		Message *Message      `json:"message"`
+		Snippet []SnippetPart `json:"snippet"`
+	}
+	type ResponseStruct = struct {
+		Results []Result `json:"results"`
+		Cursor  string   `json:"cursor,omitempty"` // Next page
+		HasMore bool     `json:"hasMore"`
+	}
+	response := ResponseStruct{Results: []Result{}}
+
+	// Conversations searched, the cursor only works with the same scope
+	var conversations []primitive.ObjectID
+	scope := primitive.NilObjectID
+	if !body.ConversationId.IsZero() {
+		conversation, err := conversationOf(r.Context(), user.Id, body.ConversationId)
+		if errors.Is(err, errNotMember) {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write(responseError("Conversation not found"))
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(responseError("Unable to get"))
+			return
+		}
+		conversations = append(conversations, conversation.Id)
+		scope = conversation.Id
+	} else if !body.Contact.IsZero() {
+		conversation, err := db_handler.Storage().GetDirectConversation(r.Context(), user.Id, body.Contact)
+		if errors.Is(err, db_handler.ErrNotFound) {
+			json_data, _ := json.Marshal(&response)
+			w.Write(json_data)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(responseError("Unable to get"))
+			return
+		}
+		conversations = append(conversations, conversation.Id)
+		scope = conversation.Id
+	} else {
+		all, err := db_handler.Storage().GetConversations(r.Context(), user.Id)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(responseError("Unable to get"))
+			return
+		}
+		for _, conversation := range all {
+			conversations = append(conversations, conversation.Id)
+		}
+	}
+
+	query := db_handler.SearchQuery{
+		Me:            user.Id,
+		Conversations: conversations,
+		Words:         words,
+		Phrases:       phrases,
+		Since:         body.Since,
+		Until:         body.Until,
+		Limit:         body.Limit + 1,
+	}
+	if body.Cursor != "" {
+		query.Before, err = decodeCursor(body.Cursor, scope)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(responseError("Bad cursor"))
+			return
+		}
+	}
+	messages, err := db_handler.Storage().SearchMessages(r.Context(), query)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Unable to get"))
+		return
+	}
+	if int64(len(messages)) > body.Limit {
+		messages = messages[:body.Limit]
+		response.HasMore = true
+	}
+	if len(messages) > 0 {
+		response.Cursor = encodeCursor(scope, messages[len(messages)-1].Id)
+	}
+
+	for i := range messages {
+		countReactions(&messages[i])
+	}
+	addReplyPreviews(r.Context(), messages)
+	for i := range messages {
+		response.Results = append(response.Results, Result{
+			Message: &messages[i],
+			Snippet: highlight(messages[i].Message, words, phrases),
+		})
+	}
+
+	json_data, json_error := json.Marshal(&response)
+	if json_error != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(responseError("Bad data"))
+		return
+	}
+	w.Write(json_data)
+}
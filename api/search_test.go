@@ -0,0 +1,93 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSearch(t *testing.T) {
+	tests := []struct {
+		query   string
+		words   []string
+		phrases [][]string
+	}{
+		{"Pizza tonight", []string{"pizza", "tonight"}, nil},
+		{`"see you" soon`, []string{"soon"}, [][]string{{"see", "you"}}},
+		{`at "the café", "ok`, []string{"at"}, [][]string{{"the", "café"}, {"ok"}}},
+		{`"" , !`, nil, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			words, phrases := parseSearch(test.query)
+			if !reflect.DeepEqual(words, test.words) || !reflect.DeepEqual(phrases, test.phrases) {
+				t.Fatalf("parseSearch = %q, %q, want %q, %q", words, phrases, test.words, test.phrases)
+			}
+		})
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	long := strings.Repeat("a ", 100) + "needle" + strings.Repeat(" b", 100)
+	tests := []struct {
+		name    string
+		message string
+		words   []string
+		phrases [][]string
+		want    []SnippetPart
+	}{
+		{"word prefix", "Pizza tonight?", []string{"piz"}, nil, []SnippetPart{{"Pizza", true}, {" tonight?", false}}},
+		{"inside a word", "spizza", []string{"piz"}, nil, []SnippetPart{{"spizza", false}}},
+		{"phrase", "I'll see you soon", nil, [][]string{{"see", "you"}}, []SnippetPart{{"I'll ", false}, {"see you", true}, {" soon", false}}},
+		{"overlapping matches", "see you", []string{"you"}, [][]string{{"see", "you"}}, []SnippetPart{{"see you", true}}},
+		{"runes", "Café crème", []string{"crè"}, nil, []SnippetPart{{"Café ", false}, {"crème", true}}},
+		{"long text", long, []string{"needle"}, nil, []SnippetPart{
+			{"…", false},
+			{strings.Repeat("a ", searchSnippetLength/8), false},
+			{"needle", true},
+			{strings.Repeat(" b", (searchSnippetLength-searchSnippetLength/4-len("needle"))/2), false},
+			{"…", false},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := highlight(test.message, test.words, test.phrases); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("highlight = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+// Results only come from the caller's conversations
+func TestSearchMessagesScope(t *testing.T) {
+	useTestStore(t)
+	alice, bob, carol, dave := createTestUser(t, "alice"), createTestUser(t, "bob"), createTestUser(t, "carol"), createTestUser(t, "dave")
+	makeContacts(t, alice, bob)
+	makeContacts(t, carol, dave)
+	mine, _ := sendMessage(t, alice, map[string]interface{}{"to": bob.Id, "message": "pizza tonight"})
+	theirs, _ := sendMessage(t, carol, map[string]interface{}{"to": dave.Id, "message": "pizza too"})
+	if mine == nil || theirs == nil {
+		t.Fatal("messages not sent")
+	}
+	route := AppRoute{"/search-messages", searchMessages}
+
+	w := callRoute(t, route, "Bearer "+alice.AuthId, map[string]interface{}{"query": "pizza"})
+	var response struct {
+		Results []struct {
+			Message *Message `json:"message"`
+		} `json:"results"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("search-messages = %d: %s", w.Code, w.Body)
+	}
+	if len(response.Results) != 1 || response.Results[0].Message.Id != mine.Id {
+		t.Fatalf("search found %s", w.Body)
+	}
+
+	w = callRoute(t, route, "Bearer "+alice.AuthId, map[string]interface{}{"query": "pizza", "conversationId": theirs.ConversationId})
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("search in someone else's conversation = %d: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+type SocketConfig struct {
+	// How often the server pings each connection
+	PingInterval time.Duration
+	// A connection is dropped when nothing, pongs included, is received for this long
+	PongTimeout time.Duration
+	// Maximum time to write a single frame
+	WriteTimeout time.Duration
+	// Largest frame accepted from clients, in bytes
+	MaxMessageSize int64
+}
+
+var socketConfig = SocketConfig{
+	PingInterval:   50 * time.Second,
+	PongTimeout:    60 * time.Second,
+	WriteTimeout:   10 * time.Second,
+	MaxMessageSize: 64 * 1024,
+}
+
+// Overrides the socket defaults with WS_PING_INTERVAL, WS_PONG_TIMEOUT,
+// WS_WRITE_TIMEOUT (durations) and WS_MAX_MESSAGE_SIZE (bytes). Invalid
+// values are logged and ignored.
+func loadSocketConfig() {
+	durations := map[string]*time.Duration{
+		"WS_PING_INTERVAL": &socketConfig.PingInterval,
+		"WS_PONG_TIMEOUT":  &socketConfig.PongTimeout,
+		"WS_WRITE_TIMEOUT": &socketConfig.WriteTimeout,
+	}
+	for name, target := range durations {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			log.Printf("invalid %s %q, using %v", name, value, *target)
+			continue
+		}
+		*target = parsed
+	}
+
+	if value := os.Getenv("WS_MAX_MESSAGE_SIZE"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed <= 0 {
+			log.Printf("invalid WS_MAX_MESSAGE_SIZE %q, using %d", value, socketConfig.MaxMessageSize)
+		} else {
+			socketConfig.MaxMessageSize = parsed
+		}
+	}
+
+	// Pings have to arrive before the peer's read deadline runs out
+	if socketConfig.PingInterval >= socketConfig.PongTimeout {
+		socketConfig.PingInterval = socketConfig.PongTimeout * 9 / 10
+		log.Printf("WS_PING_INTERVAL must be shorter than WS_PONG_TIMEOUT, using %v", socketConfig.PingInterval)
+	}
+}
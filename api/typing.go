@@ -0,0 +1,108 @@
+package api
+
+import (
+	"sync"
+	"time"
+)
+
+// A typing indicator is dropped when the sender doesn't refresh it for this long
+var typingTimeout = 6 * time.Second
+
+// Minimum time between two typing-started events relayed for the same pair
+var typingRateLimit = 2 * time.Second
+
+type typingKey struct {
+	from string
+	to   string
+}
+
+type typingState struct {
+	relayedAt time.Time
+	expire    *time.Timer
+}
+
+// Ephemeral typing indicators, kept in memory only. Relays start and stop
+// events between users, throttling starts and expiring stale indicators.
+type typingTracker struct {
+	mu     sync.Mutex
+	active map[typingKey]*typingState
+}
+
+var typing = &typingTracker{
+	active: make(map[typingKey]*typingState),
+}
+
+func relayTyping(eventType string, key typingKey) {
+	hub.Send(key.to, newEnvelope(eventType, TypingPayload{
+		From: key.from,
+		To:   key.to,
+	}))
+}
+
+func (t *typingTracker) start(from string, to string) {
+	key := typingKey{from, to}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state := t.active[key]
+	if state == nil {
+		state = &typingState{}
+		t.active[key] = state
+	} else {
+		state.expire.Stop()
+	}
+	state.expire = time.AfterFunc(typingTimeout, func() {
+		t.mu.Lock()
+		expired := t.active[key] == state
+		if expired {
+			delete(t.active, key)
+		}
+		t.mu.Unlock()
+		if expired {
+			relayTyping(EventTypingStopped, key)
+		}
+	})
+
+	if now.Sub(state.relayedAt) >= typingRateLimit {
+		state.relayedAt = now
+		relayTyping(EventTypingStarted, key)
+	}
+}
+
+func (t *typingTracker) isActive(from string, to string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.active[typingKey{from, to}] != nil
+}
+
+func (t *typingTracker) stop(from string, to string) {
+	key := typingKey{from, to}
+	t.mu.Lock()
+	state := t.active[key]
+	if state != nil {
+		state.expire.Stop()
+		delete(t.active, key)
+	}
+	t.mu.Unlock()
+	if state != nil {
+		relayTyping(EventTypingStopped, key)
+	}
+}
+
+// Stops every indicator of the user, e.g. when their last connection closes
+func (t *typingTracker) stopAll(from string) {
+	var stopped []typingKey
+	t.mu.Lock()
+	for key, state := range t.active {
+		if key.from == from {
+			state.expire.Stop()
+			delete(t.active, key)
+			stopped = append(stopped, key)
+		}
+	}
+	t.mu.Unlock()
+	for _, key := range stopped {
+		relayTyping(EventTypingStopped, key)
+	}
+}
@@ -4,14 +4,13 @@ import (
 	"context"
 	"log"
 	"os"
+	"strconv"
 
 	db_handler "chat.app/db"
 	firebase "firebase.google.com/go"
 	"firebase.google.com/go/messaging"
 	"github.com/joho/godotenv"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo/options"
 	"google.golang.org/api/option"
 )
 
@@ -22,52 +21,86 @@ func SetupFirebase() {
 	// Raw json from:
 	// https://console.firebase.google.com/project/<PROJECT_NAME>/settings/serviceaccounts/adminsdk
 	sdk := os.Getenv("FIREBASE_SDK")
+	if sdk == "" {
+		log.Println("FIREBASE_SDK not set, push notifications and Firebase auth disabled")
+		return
+	}
 	opt := option.WithCredentialsJSON([]byte(sdk))
 
 	//Firebase admin SDK initialization
-	init, _ := firebase.NewApp(context.Background(), nil, opt)
+	init, err := firebase.NewApp(context.Background(), nil, opt)
+	if err != nil {
+		log.Println("Firebase setup failed: " + err.Error())
+		return
+	}
+	client, err := init.Auth(context.Background())
+	if err != nil {
+		log.Println("Firebase auth setup failed: " + err.Error())
+		return
+	}
 	app = init
+	authClient = client
 }
 
 func Notify(to primitive.ObjectID, group primitive.ObjectID, title string, message string) {
+	// Firebase is not configured, e.g. running locally with the memory store
+	if app == nil {
+		return
+	}
 	client, err := app.Messaging(context.TODO())
 	if err != nil {
-		log.Fatalf("error getting Messaging client: %v\n", err)
+		log.Printf("error getting Messaging client: %v\n", err)
+		return
 	}
 
-	type User struct {
-		Id    string `json:"_id" bson:"_id"`
-		Token string `json:"token" bson:"token"`
-	}
-	var user User
-	filter := bson.M{
-		"_id": to,
-	}
-	project := bson.M{
-		"token": 1,
-	}
-	options := options.FindOne().SetProjection(project)
-	collection := db_handler.Client().Collection("users")
-	err = collection.FindOne(context.TODO(), filter, options).Decode(&user)
+	token, err := db_handler.Storage().GetUserToken(context.TODO(), to)
 	if err != nil {
 		log.Println("Failed Notification, No User: " + err.Error())
 	}
 
-	if user.Token != "" {
+	if token != "" {
+		badge := unreadBadge(to)
 		notification := &messaging.Message{
 			Notification: &messaging.Notification{
 				Title: title + ":",
 				Body:  message,
 			},
-			Token: user.Token,
+			Token: token,
 			Data: map[string]string{
-				"tag": group.Hex(),
+				"tag":   group.Hex(),
+				"badge": strconv.Itoa(badge),
+			},
+			Android: &messaging.AndroidConfig{
+				Notification: &messaging.AndroidNotification{
+					NotificationCount: &badge,
+				},
+			},
+			APNS: &messaging.APNSConfig{
+				Payload: &messaging.APNSPayload{
+					Aps: &messaging.Aps{
+						Badge: &badge,
+					},
+				},
 			},
 		}
 		_, err = client.Send(context.TODO(), notification)
 		if err != nil {
-			log.Fatalln("Failed Notification, Firebase", err)
+			log.Println("Failed Notification, Firebase", err)
 		}
 	}
 
 }
+
+// Total unread messages of the user, shown as the app icon badge
+func unreadBadge(user primitive.ObjectID) int {
+	counts, err := db_handler.Storage().UnreadCounts(context.TODO(), user)
+	if err != nil {
+		log.Println("Failed Notification badge: " + err.Error())
+		return 0
+	}
+	total := 0
+	for _, count := range counts {
+		total += int(count)
+	}
+	return total
+}
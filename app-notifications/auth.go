@@ -0,0 +1,42 @@
+package app_notifications
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"firebase.google.com/go/auth"
+)
+
+var authClient *auth.Client
+
+func FirebaseEnabled() bool {
+	return app != nil
+}
+
+// Verifies Firebase ID tokens with the app initialised by SetupFirebase
+type FirebaseVerifier struct{}
+
+// Returns the Firebase uid the token was issued for and its expiration
+func (FirebaseVerifier) Verify(ctx context.Context, idToken string) (string, time.Time, error) {
+	if authClient == nil {
+		return "", time.Time{}, errors.New("firebase auth not configured")
+	}
+	token, err := authClient.VerifyIDToken(ctx, idToken)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token.UID, time.Unix(token.Expires, 0), nil
+}
+
+func (FirebaseVerifier) Revoked(ctx context.Context, idToken string) (bool, error) {
+	if authClient == nil {
+		return false, errors.New("firebase auth not configured")
+	}
+	_, err := authClient.VerifyIDTokenAndCheckRevoked(ctx, idToken)
+	// Deleted accounts can't keep using their tokens either
+	if auth.IsIDTokenRevoked(err) || auth.IsUserNotFound(err) {
+		return true, nil
+	}
+	return false, err
+}
@@ -0,0 +1,69 @@
+package blob_store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+var ErrNotFound = errors.New("blob not found")
+
+// Where attachment contents are kept, addressed by key
+type BlobStore interface {
+	Put(ctx context.Context, key string, content io.Reader, size int64, contentType string) error
+	// The caller closes the reader, ErrNotFound when there is no such blob
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Deleting a missing blob is not an error
+	Delete(ctx context.Context, key string) error
+}
+
+var blobs BlobStore
+
+func Blobs() BlobStore {
+	return blobs
+}
+
+func SetBlobs(store BlobStore) {
+	blobs = store
+}
+
+// Picks the blob store from the environment:
+//
+//	BLOB_STORE     "local" (default) or "s3"
+//	BLOB_DIR       directory of the local store, defaults to "attachments"
+//	S3_ENDPOINT    e.g. https://s3.eu-west-1.amazonaws.com, or http://localhost:9000 for MinIO
+//	S3_REGION      defaults to us-east-1
+//	S3_BUCKET      bucket holding the blobs, it must exist
+//	S3_ACCESS_KEY
+//	S3_SECRET_KEY
+func Setup() error {
+	switch os.Getenv("BLOB_STORE") {
+	case "", "local":
+		dir := os.Getenv("BLOB_DIR")
+		if dir == "" {
+			dir = "attachments"
+		}
+		store, err := NewLocalStore(dir)
+		if err != nil {
+			return err
+		}
+		SetBlobs(store)
+	case "s3":
+		store, err := NewS3Store(S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+		})
+		if err != nil {
+			return err
+		}
+		SetBlobs(store)
+	default:
+		return fmt.Errorf("unknown BLOB_STORE %q", os.Getenv("BLOB_STORE"))
+	}
+	return nil
+}
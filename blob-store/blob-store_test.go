@@ -0,0 +1,129 @@
+package blob_store
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalStore(t *testing.T) {
+	store, err := NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBlobStore(t, store, "")
+}
+
+// Runs against a real bucket when S3_ENDPOINT is set, with the S3_* variables
+// Setup reads. Blobs are written under a prefix of their own and removed.
+func TestS3Store(t *testing.T) {
+	if os.Getenv("S3_ENDPOINT") == "" {
+		t.Skip("S3_ENDPOINT not set")
+	}
+	store, err := NewS3Store(S3Config{
+		Endpoint:  os.Getenv("S3_ENDPOINT"),
+		Region:    os.Getenv("S3_REGION"),
+		Bucket:    os.Getenv("S3_BUCKET"),
+		AccessKey: os.Getenv("S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("S3_SECRET_KEY"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := make([]byte, 8)
+	rand.Read(prefix)
+	testBlobStore(t, store, "test-"+hex.EncodeToString(prefix)+"/")
+}
+
+func testBlobStore(t *testing.T, store BlobStore, prefix string) {
+	ctx := context.Background()
+	key := prefix + "conversation/attachment"
+	content := []byte("attachment content")
+
+	if err := store.Put(ctx, key, bytes.NewReader(content), int64(len(content)), "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Delete(ctx, key) })
+	reader, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || !bytes.Equal(got, content) {
+		t.Fatalf("Get = %q, %v, want %q", got, err, content)
+	}
+
+	// Putting again replaces the content
+	replaced := []byte("replaced")
+	if err = store.Put(ctx, key, bytes.NewReader(replaced), int64(len(replaced)), "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	if reader, err = store.Get(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	got, err = io.ReadAll(reader)
+	reader.Close()
+	if err != nil || !bytes.Equal(got, replaced) {
+		t.Fatalf("Get after replacing = %q, %v, want %q", got, err, replaced)
+	}
+
+	if _, err = store.Get(ctx, prefix+"missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get of a missing blob = %v, want ErrNotFound", err)
+	}
+
+	if err = store.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Get(ctx, key); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get after Delete = %v, want ErrNotFound", err)
+	}
+	if err = store.Delete(ctx, key); err != nil {
+		t.Fatalf("deleting twice = %v", err)
+	}
+	if err = store.Delete(ctx, prefix+"missing"); err != nil {
+		t.Fatalf("deleting a missing blob = %v", err)
+	}
+}
+
+// Keys can't reach outside the store's directory
+func TestLocalStorePath(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewLocalStore(filepath.Join(dir, "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"", ".", "..", "../x", "a/../../x", "/abs", "/"} {
+		if path, err := store.path(key); err == nil {
+			t.Errorf("key %q maps to %s", key, path)
+		}
+	}
+	for _, key := range []string{"x", "a/b", "a/../x", "./x"} {
+		path, err := store.path(key)
+		if err != nil || !strings.HasPrefix(path, store.dir+string(filepath.Separator)) {
+			t.Errorf("key %q maps to %s, %v", key, path, err)
+		}
+	}
+
+	// Nothing is written next to the store either
+	ctx := context.Background()
+	if err = store.Put(ctx, "../x", strings.NewReader("x"), 1, ""); err == nil {
+		t.Fatal("Put of ../x succeeded")
+	}
+	if _, err = os.Stat(filepath.Join(dir, "x")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("../x written: %v", err)
+	}
+	if _, err = store.Get(ctx, "/abs"); err == nil || errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get of /abs = %v, want an invalid key", err)
+	}
+	if err = store.Delete(ctx, ""); err == nil {
+		t.Fatal("Delete of an empty key succeeded")
+	}
+}
@@ -7,6 +7,7 @@ import (
 
 	api "chat.app/api"
 	app_notifications "chat.app/app-notifications"
+	blob_store "chat.app/blob-store"
 	db_handler "chat.app/db"
 	"github.com/joho/godotenv"
 )
@@ -15,8 +16,25 @@ func main() {
 	godotenv.Load()
 
 	app_notifications.SetupFirebase()
+	if app_notifications.FirebaseEnabled() {
+		api.SetTokenVerifier(app_notifications.FirebaseVerifier{})
+	} else if os.Getenv("LOCAL") == "true" {
+		log.Println("Firebase not configured, bearer tokens are used as user authIds")
+		api.SetTokenVerifier(api.LocalTokenVerifier{})
+	} else {
+		log.Fatal("FIREBASE_SDK is required to verify ID tokens")
+	}
 
-	db_handler.MongoConnection()
+	// STORAGE=memory runs the whole server without a MongoDB cluster
+	if os.Getenv("STORAGE") == "memory" {
+		db_handler.UseMemoryStore()
+	} else if err := db_handler.MongoConnection(); err != nil {
+		log.Fatal("MongoConnection: ", err)
+	}
+	// Attachments go to a local directory unless BLOB_STORE=s3
+	if err := blob_store.Setup(); err != nil {
+		log.Fatal("blob store: ", err)
+	}
 	api.InitRouterFunctions()
 
 	log.Println("http server started on :" + os.Getenv("PORT"))
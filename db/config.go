@@ -0,0 +1,86 @@
+package db_handler
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+type Config struct {
+	URI            string
+	Database       string
+	MaxPoolSize    uint64
+	MinPoolSize    uint64
+	ConnectTimeout time.Duration
+	// Server selection and per-operation timeout used for startup tasks
+	Timeout time.Duration
+}
+
+// Reads the MongoDB settings from the environment:
+//
+//	MONGO_URI              connection string, defaults to a local mongod
+//	MONGO_PASSWORD         legacy, builds the Atlas URI when MONGO_URI is empty
+//	MONGO_DATABASE         defaults to "simple-chat"
+//	MONGO_MAX_POOL_SIZE    defaults to 100
+//	MONGO_MIN_POOL_SIZE    defaults to 0
+//	MONGO_CONNECT_TIMEOUT  duration, defaults to 10s
+//	MONGO_TIMEOUT          duration, defaults to 10s
+func LoadConfig() (Config, error) {
+	config := Config{
+		URI:            os.Getenv("MONGO_URI"),
+		Database:       os.Getenv("MONGO_DATABASE"),
+		MaxPoolSize:    100,
+		ConnectTimeout: 10 * time.Second,
+		Timeout:        10 * time.Second,
+	}
+	if config.URI == "" {
+		if password := os.Getenv("MONGO_PASSWORD"); password != "" {
+			config.URI = "mongodb+srv://admin:" + password + "@cluster0.ceyoj.gcp.mongodb.net/?retryWrites=true&w=majority"
+		} else {
+			config.URI = "mongodb://localhost:27017"
+		}
+	}
+	if config.Database == "" {
+		config.Database = "simple-chat"
+	}
+
+	var err error
+	if config.MaxPoolSize, err = envUint("MONGO_MAX_POOL_SIZE", config.MaxPoolSize); err != nil {
+		return config, err
+	}
+	if config.MinPoolSize, err = envUint("MONGO_MIN_POOL_SIZE", config.MinPoolSize); err != nil {
+		return config, err
+	}
+	if config.ConnectTimeout, err = envDuration("MONGO_CONNECT_TIMEOUT", config.ConnectTimeout); err != nil {
+		return config, err
+	}
+	if config.Timeout, err = envDuration("MONGO_TIMEOUT", config.Timeout); err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+func envUint(name string, fallback uint64) (uint64, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	parsed, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return fallback, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return parsed, nil
+}
+
+func envDuration(name string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return fallback, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return parsed, nil
+}
@@ -3,27 +3,71 @@ package db_handler
 import (
 	"context"
 	"fmt"
-	"os"
 
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
 var (
-	db *mongo.Client
+	db       *mongo.Client
+	database string
 )
 
-func MongoConnection() {
-	var mongouri = "mongodb+srv://admin:" + os.Getenv("MONGO_PASSWORD") + "@cluster0.ceyoj.gcp.mongodb.net/?retryWrites=true&w=majority"
-	fmt.Println(mongouri)
-	client, err := mongo.Connect(context.TODO(), options.Client().ApplyURI(mongouri))
+// Connects to MongoDB using LoadConfig, checks the server is reachable,
+// creates the indexes the store relies on and migrates older data.
+func MongoConnection() error {
+	config, err := LoadConfig()
 	if err != nil {
-		panic(err)
+		return err
+	}
+
+	opts := options.Client().
+		ApplyURI(config.URI).
+		SetMaxPoolSize(config.MaxPoolSize).
+		SetMinPoolSize(config.MinPoolSize).
+		SetConnectTimeout(config.ConnectTimeout).
+		SetServerSelectionTimeout(config.Timeout)
+	client, err := mongo.Connect(context.TODO(), opts)
+	if err != nil {
+		return fmt.Errorf("mongo connect: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.Timeout)
+	defer cancel()
+	if err = client.Ping(ctx, readpref.Primary()); err != nil {
+		client.Disconnect(context.Background())
+		return fmt.Errorf("mongo ping: %w", err)
 	}
 
 	db = client
+	database = config.Database
+	mongoStore := NewMongoStore(Client())
+	// Data the indexes can't be created on without. Not bound to the
+	// connection timeout either, like the migrations below.
+	if err = mongoStore.MigrateUsers(context.Background()); err != nil {
+		return fmt.Errorf("mongo migration: %w", err)
+	}
+	if err = mongoStore.MigrateEvents(context.Background()); err != nil {
+		return fmt.Errorf("mongo migration: %w", err)
+	}
+	if err = mongoStore.MigrateMessagesTTL(context.Background()); err != nil {
+		return fmt.Errorf("mongo migration: %w", err)
+	}
+	// The migrations above may have used up the first timeout
+	indexCtx, cancelIndexes := context.WithTimeout(context.Background(), config.Timeout)
+	defer cancelIndexes()
+	if err = EnsureIndexes(indexCtx, Client()); err != nil {
+		return fmt.Errorf("mongo indexes: %w", err)
+	}
+	// Not bound to the connection timeout, large collections take a while
+	if err = mongoStore.MigrateConversations(context.Background()); err != nil {
+		return fmt.Errorf("mongo migration: %w", err)
+	}
+	store = mongoStore
+	return nil
 }
 
 func Client() *mongo.Database {
-	return db.Database("simple-chat")
+	return db.Database(database)
 }
@@ -0,0 +1,145 @@
+package db_handler
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Seconds expired messages are left to the sweeper before the TTL index
+// removes them
+const messagesTTLDelay = 24 * 60 * 60
+
+// Indexes the queries in MongoStore depend on, keyed by collection
+var indexes = map[string][]mongo.IndexModel{
+	"users": {
+		{
+			// Used by SearchUsers ($text requires exactly one text index)
+			Keys:    bson.D{{Key: "name", Value: "text"}, {Key: "email", Value: "text"}},
+			Options: options.Index().SetName("users_text"),
+		},
+		{
+			// One user per Firebase uid, even when the first sign-ins race.
+			// Accounts of old sign-ins without one are left out.
+			Keys: bson.D{{Key: "authId", Value: 1}},
+			Options: options.Index().SetName("users_authId").SetUnique(true).
+				SetPartialFilterExpression(bson.M{"authId": bson.M{"$gt": ""}}),
+		},
+	},
+	"messages": {
+		{
+			// Expired messages are swept by the api, which keeps the
+			// summaries right. MongoDB removes the ones it missed, e.g.
+			// while no server ran, a day later.
+			Keys:    bson.D{{Key: "expireAt", Value: 1}},
+			Options: options.Index().SetName("messages_ttl").SetExpireAfterSeconds(messagesTTLDelay),
+		},
+		{
+			// Pages of a conversation, receipts and unread counts
+			Keys:    bson.D{{Key: "conversationId", Value: 1}, {Key: "_id", Value: -1}},
+			Options: options.Index().SetName("messages_conversationId_id"),
+		},
+		{
+			// SearchMessages, words are matched as prefixes of the terms
+			Keys:    bson.D{{Key: "terms", Value: 1}, {Key: "conversationId", Value: 1}, {Key: "_id", Value: -1}},
+			Options: options.Index().SetName("messages_terms"),
+		},
+	},
+	"conversations": {
+		{
+			Keys:    bson.D{{Key: "members", Value: 1}},
+			Options: options.Index().SetName("conversations_members"),
+		},
+		{
+			Keys:    bson.D{{Key: "directKey", Value: 1}},
+			Options: options.Index().SetName("conversations_directKey").SetUnique(true).SetSparse(true),
+		},
+	},
+	"summaries": {
+		{
+			Keys:    bson.D{{Key: "user", Value: 1}, {Key: "conversationId", Value: 1}},
+			Options: options.Index().SetName("summaries_user_conversationId").SetUnique(true),
+		},
+		{
+			// Conversation lists, most recently active first
+			Keys:    bson.D{{Key: "user", Value: 1}, {Key: "updatedAt", Value: -1}, {Key: "conversationId", Value: -1}},
+			Options: options.Index().SetName("summaries_user_updatedAt"),
+		},
+		{
+			// Edits, deletions and renames touch every summary of a conversation
+			Keys:    bson.D{{Key: "conversationId", Value: 1}},
+			Options: options.Index().SetName("summaries_conversationId"),
+		},
+	},
+	"attachments": {
+		{
+			// Claimed and deleted together with their message
+			Keys:    bson.D{{Key: "messageId", Value: 1}},
+			Options: options.Index().SetName("attachments_messageId").SetSparse(true),
+		},
+		{
+			// Swept with their blobs, no TTL
+			Keys:    bson.D{{Key: "expireAt", Value: 1}},
+			Options: options.Index().SetName("attachments_expireAt").SetSparse(true),
+		},
+		{
+			// Uploads never sent are swept too
+			Keys:    bson.D{{Key: "createdAt", Value: 1}},
+			Options: options.Index().SetName("attachments_createdAt"),
+		},
+	},
+	"events": {
+		{
+			Keys:    bson.D{{Key: "expireAt", Value: 1}},
+			Options: options.Index().SetName("events_ttl").SetExpireAfterSeconds(0),
+		},
+		{
+			Keys:    bson.D{{Key: "user", Value: 1}, {Key: "_id", Value: 1}},
+			Options: options.Index().SetName("events_user_id"),
+		},
+		{
+			Keys:    bson.D{{Key: "user", Value: 1}, {Key: "seq", Value: 1}},
+			Options: options.Index().SetName("events_user_seq").SetUnique(true),
+		},
+		{
+			// Shortened conversation retentions
+			Keys:    bson.D{{Key: "conversationId", Value: 1}},
+			Options: options.Index().SetName("events_conversationId").SetSparse(true),
+		},
+		{
+			// Messages deleted for everyone
+			Keys:    bson.D{{Key: "messageId", Value: 1}},
+			Options: options.Index().SetName("events_messageId").SetSparse(true),
+		},
+	},
+}
+
+// Index option or key conflicts mean an equivalent index already exists under
+// another name, which is left alone.
+func isIndexConflict(err error) bool {
+	var commandErr mongo.CommandError
+	if errors.As(err, &commandErr) {
+		return commandErr.Code == 85 || commandErr.Code == 86
+	}
+	return false
+}
+
+func EnsureIndexes(ctx context.Context, database *mongo.Database) error {
+	for collection, models := range indexes {
+		for _, model := range models {
+			_, err := database.Collection(collection).Indexes().CreateOne(ctx, model)
+			if isIndexConflict(err) {
+				log.Printf("index on %s already exists with different options: %v", collection, err)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
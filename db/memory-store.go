@@ -0,0 +1,1060 @@
+package db_handler
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type memoryUser struct {
+	User
+	Token            string
+	Props            map[string]string
+	Contacts         []primitive.ObjectID
+	ReceivedRequests []primitive.ObjectID
+	SentRequests     []primitive.ObjectID
+	ReadCursors      map[primitive.ObjectID]primitive.ObjectID
+}
+
+// Store implementation that keeps everything in process memory. Safe for
+// concurrent use, meant for tests and running the server without MongoDB.
+type MemoryStore struct {
+	mu            sync.RWMutex
+	users         map[primitive.ObjectID]*memoryUser
+	messages      []Message
+	conversations map[primitive.ObjectID]*Conversation
+	summaries     map[summaryKey]*ConversationSummary
+	attachments   map[primitive.ObjectID]*Attachment
+	events        []Event
+	eventSeqs     map[primitive.ObjectID]int64
+}
+
+type summaryKey struct {
+	user         primitive.ObjectID
+	conversation primitive.ObjectID
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:         make(map[primitive.ObjectID]*memoryUser),
+		conversations: make(map[primitive.ObjectID]*Conversation),
+		summaries:     make(map[summaryKey]*ConversationSummary),
+		attachments:   make(map[primitive.ObjectID]*Attachment),
+		eventSeqs:     make(map[primitive.ObjectID]int64),
+	}
+}
+
+func addId(ids []primitive.ObjectID, id primitive.ObjectID) []primitive.ObjectID {
+	for _, existing := range ids {
+		if existing == id {
+			return ids
+		}
+	}
+	return append(ids, id)
+}
+
+func removeId(ids []primitive.ObjectID, id primitive.ObjectID) []primitive.ObjectID {
+	result := ids[:0]
+	for _, existing := range ids {
+		if existing != id {
+			result = append(result, existing)
+		}
+	}
+	return result
+}
+
+func compareIds(a primitive.ObjectID, b primitive.ObjectID) int {
+	return bytes.Compare(a[:], b[:])
+}
+
+func copyIds(ids []primitive.ObjectID) *[]primitive.ObjectID {
+	if ids == nil {
+		return nil
+	}
+	result := append([]primitive.ObjectID{}, ids...)
+	return &result
+}
+
+func (s *MemoryStore) CreateUser(ctx context.Context, user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.users[user.Id]; exists {
+		return ErrExists
+	}
+	for _, existing := range s.users {
+		if existing.AuthId == user.AuthId {
+			return ErrExists
+		}
+	}
+	s.users[user.Id] = &memoryUser{
+		User:        *user,
+		Props:       make(map[string]string),
+		ReadCursors: make(map[primitive.ObjectID]primitive.ObjectID),
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetUser(ctx context.Context, id primitive.ObjectID) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	user, exists := s.users[id]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	result := user.User
+	return &result, nil
+}
+
+func (s *MemoryStore) GetUserByAuthId(ctx context.Context, authId string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, user := range s.users {
+		if user.AuthId == authId {
+			result := user.User
+			return &result, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryStore) GetUsers(ctx context.Context, ids []primitive.ObjectID) ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var users []User
+	for _, id := range ids {
+		if user, exists := s.users[id]; exists {
+			users = append(users, user.User)
+		}
+	}
+	return users, nil
+}
+
+// Approximates the users text index: any word of the term contained in the
+// user's name or email, ignoring case.
+func (s *MemoryStore) SearchUsers(ctx context.Context, term string) ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	words := strings.Fields(strings.ToLower(term))
+	var users []User
+	for _, user := range s.users {
+		name := strings.ToLower(user.Name)
+		email := strings.ToLower(user.Email)
+		for _, word := range words {
+			if strings.Contains(name, word) || strings.Contains(email, word) {
+				users = append(users, user.User)
+				break
+			}
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return compareIds(users[i].Id, users[j].Id) < 0
+	})
+	return users, nil
+}
+
+func (s *MemoryStore) SetUserProperty(ctx context.Context, id primitive.ObjectID, prop string, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, exists := s.users[id]
+	if !exists {
+		return nil
+	}
+	switch prop {
+	case "name":
+		user.Name = value
+	case "email":
+		user.Email = value
+	case "token":
+		user.Token = value
+	default:
+		user.Props[prop] = value
+	}
+	return nil
+}
+
+func (s *MemoryStore) SetLastSeen(ctx context.Context, id primitive.ObjectID, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if user, exists := s.users[id]; exists {
+		user.LastSeen = &at
+	}
+	return nil
+}
+
+func (s *MemoryStore) SetHidePresence(ctx context.Context, id primitive.ObjectID, hide bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if user, exists := s.users[id]; exists {
+		user.HidePresence = hide
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetContactsData(ctx context.Context, id primitive.ObjectID) (*ContactsData, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	user, exists := s.users[id]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	return &ContactsData{
+		Contacts:         copyIds(user.Contacts),
+		ReceivedRequests: copyIds(user.ReceivedRequests),
+		SentRequests:     copyIds(user.SentRequests),
+	}, nil
+}
+
+func (s *MemoryStore) SendFriendRequest(ctx context.Context, from primitive.ObjectID, to primitive.ObjectID) ([]primitive.ObjectID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sender, exists := s.users[from]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	if receiver, exists := s.users[to]; exists {
+		receiver.ReceivedRequests = addId(receiver.ReceivedRequests, from)
+	}
+	sender.SentRequests = addId(sender.SentRequests, to)
+	return *copyIds(sender.SentRequests), nil
+}
+
+func (s *MemoryStore) AcceptFriendRequest(ctx context.Context, from primitive.ObjectID, to primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if receiver, exists := s.users[to]; exists {
+		receiver.ReceivedRequests = removeId(receiver.ReceivedRequests, from)
+		receiver.Contacts = addId(receiver.Contacts, from)
+	}
+	if sender, exists := s.users[from]; exists {
+		sender.SentRequests = removeId(sender.SentRequests, to)
+		sender.Contacts = addId(sender.Contacts, to)
+	}
+	return nil
+}
+
+func copyMessage(message *Message) Message {
+	result := *message
+	result.Edits = append([]MessageEdit(nil), message.Edits...)
+	result.HiddenFor = append([]primitive.ObjectID(nil), message.HiddenFor...)
+	result.Attachments = append([]AttachmentRef(nil), message.Attachments...)
+	if message.Reactions != nil {
+		result.Reactions = make(map[string][]string, len(message.Reactions))
+		for user, emojis := range message.Reactions {
+			result.Reactions[user] = append([]string(nil), emojis...)
+		}
+	}
+	if message.Receipts != nil {
+		result.Receipts = make(map[string]Receipt, len(message.Receipts))
+		for user, receipt := range message.Receipts {
+			result.Receipts[user] = receipt
+		}
+	}
+	return result
+}
+
+func (s *MemoryStore) SaveMessage(ctx context.Context, message *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, copyMessage(message))
+	s.refreshLastMessage(message)
+	s.addToSummaries(message)
+	return nil
+}
+
+// Same as MongoStore.refreshLastMessage, the lock must be held
+func (s *MemoryStore) refreshLastMessage(message *Message) {
+	conversation := s.conversations[message.ConversationId]
+	if conversation == nil {
+		return
+	}
+	if conversation.LastMessage == nil || compareIds(conversation.LastMessage.Id, message.Id) <= 0 {
+		copied := copyMessage(message)
+		conversation.LastMessage = snapshotOf(&copied)
+	}
+	if message.CreatedAt.After(conversation.UpdatedAt) {
+		conversation.UpdatedAt = message.CreatedAt
+	}
+}
+
+// The new message in the summary of every member, the lock must be held
+func (s *MemoryStore) addToSummaries(message *Message) {
+	conversation := s.conversations[message.ConversationId]
+	if conversation == nil {
+		return
+	}
+	for _, member := range conversation.Members {
+		key := summaryKey{member, conversation.Id}
+		summary := s.summaries[key]
+		if summary == nil {
+			summary = newSummary(member, conversation, message.CreatedAt)
+			s.summaries[key] = summary
+		}
+		if summary.LastMessage == nil || compareIds(summary.LastMessage.Id, message.Id) <= 0 {
+			copied := copyMessage(message)
+			summary.LastMessage = snapshotOf(&copied)
+		}
+		if message.CreatedAt.After(summary.UpdatedAt) {
+			summary.UpdatedAt = message.CreatedAt
+		}
+		if member != message.From {
+			summary.UnreadCount++
+		}
+	}
+}
+
+// Summaries showing the message get its new state, or the previous message
+// for users who deleted it for themselves. The lock must be held.
+func (s *MemoryStore) refreshSummaries(message *Message) {
+	for _, summary := range s.summaries {
+		if summary.ConversationId != message.ConversationId || summary.LastMessage == nil || summary.LastMessage.Id != message.Id {
+			continue
+		}
+		last := message
+		if isHiddenFor(message, summary.User) {
+			last = s.findLastMessage(summary.User, message.ConversationId)
+		}
+		summary.LastMessage = nil
+		if last != nil {
+			copied := copyMessage(last)
+			summary.LastMessage = snapshotOf(&copied)
+		}
+	}
+}
+
+func isHiddenFor(message *Message, user primitive.ObjectID) bool {
+	for _, id := range message.HiddenFor {
+		if id == user {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *MemoryStore) findMessage(id primitive.ObjectID) *Message {
+	for i := range s.messages {
+		if s.messages[i].Id == id {
+			return &s.messages[i]
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetMessage(ctx context.Context, id primitive.ObjectID) (*Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	message := s.findMessage(id)
+	if message == nil {
+		return nil, ErrNotFound
+	}
+	result := copyMessage(message)
+	return &result, nil
+}
+
+func (s *MemoryStore) GetMessagesByIds(ctx context.Context, ids []primitive.ObjectID) ([]Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	wanted := make(map[primitive.ObjectID]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	var messages []Message
+	for i := range s.messages {
+		if wanted[s.messages[i].Id] {
+			messages = append(messages, copyMessage(&s.messages[i]))
+		}
+	}
+	return messages, nil
+}
+
+func (s *MemoryStore) EditMessage(ctx context.Context, id primitive.ObjectID, text string, at time.Time) (*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	message := s.findMessage(id)
+	if message == nil || message.Deleted {
+		return nil, ErrNotFound
+	}
+	message.Edits = append(message.Edits, MessageEdit{Message: message.Message, ReplacedAt: at})
+	message.Message = text
+	message.EditedAt = &at
+	s.refreshLastMessage(message)
+	s.refreshSummaries(message)
+	result := copyMessage(message)
+	return &result, nil
+}
+
+func (s *MemoryStore) DeleteMessage(ctx context.Context, id primitive.ObjectID, at time.Time) (*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	message := s.findMessage(id)
+	if message == nil {
+		return nil, ErrNotFound
+	}
+	message.Deleted = true
+	message.DeletedAt = &at
+	message.Message = ""
+	message.Title = ""
+	message.Edits = nil
+	message.Reactions = nil
+	message.Attachments = nil
+	s.refreshLastMessage(message)
+	s.refreshSummaries(message)
+	s.recountUnread(message.ConversationId)
+	kept := s.events[:0]
+	for _, event := range s.events {
+		if event.MessageId != id {
+			kept = append(kept, event)
+		}
+	}
+	s.events = kept
+	result := copyMessage(message)
+	return &result, nil
+}
+
+func (s *MemoryStore) AddReaction(ctx context.Context, id primitive.ObjectID, user primitive.ObjectID, emoji string) (*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	message := s.findMessage(id)
+	if message == nil {
+		return nil, ErrNotFound
+	}
+	if message.Reactions == nil {
+		message.Reactions = make(map[string][]string)
+	}
+	emojis := message.Reactions[user.Hex()]
+	found := false
+	for _, existing := range emojis {
+		found = found || existing == emoji
+	}
+	if !found {
+		message.Reactions[user.Hex()] = append(emojis, emoji)
+	}
+	result := copyMessage(message)
+	return &result, nil
+}
+
+func (s *MemoryStore) RemoveReaction(ctx context.Context, id primitive.ObjectID, user primitive.ObjectID, emoji string) (*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	message := s.findMessage(id)
+	if message == nil {
+		return nil, ErrNotFound
+	}
+	var emojis []string
+	for _, existing := range message.Reactions[user.Hex()] {
+		if existing != emoji {
+			emojis = append(emojis, existing)
+		}
+	}
+	if len(emojis) == 0 {
+		delete(message.Reactions, user.Hex())
+	} else {
+		message.Reactions[user.Hex()] = emojis
+	}
+	if len(message.Reactions) == 0 {
+		message.Reactions = nil
+	}
+	result := copyMessage(message)
+	return &result, nil
+}
+
+func (s *MemoryStore) HideMessage(ctx context.Context, id primitive.ObjectID, user primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	message := s.findMessage(id)
+	if message != nil {
+		message.HiddenFor = addId(message.HiddenFor, user)
+		s.refreshLastMessage(message)
+		s.refreshSummaries(message)
+		s.recountUnread(message.ConversationId)
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetMessages(ctx context.Context, query MessageQuery) ([]Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var messages []Message
+	for i := range s.messages {
+		message := &s.messages[i]
+		if message.ConversationId != query.Conversation || isHiddenFor(message, query.Me) {
+			continue
+		}
+		if query.Before != nil && compareIds(message.Id, *query.Before) >= 0 {
+			continue
+		}
+		if query.After != nil && compareIds(message.Id, *query.After) <= 0 {
+			continue
+		}
+		messages = append(messages, copyMessage(message))
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return compareIds(messages[i].Id, messages[j].Id) > 0
+	})
+	if query.Limit > 0 && int64(len(messages)) > query.Limit {
+		// Walking forward from After the closest messages are the oldest ones
+		if query.After != nil && query.Before == nil {
+			messages = messages[int64(len(messages))-query.Limit:]
+		} else {
+			messages = messages[:query.Limit]
+		}
+	}
+	return messages, nil
+}
+
+func (s *MemoryStore) SearchMessages(ctx context.Context, query SearchQuery) ([]Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var messages []Message
+	for i := range s.messages {
+		message := &s.messages[i]
+		if !containsId(query.Conversations, message.ConversationId) || message.Deleted || isHiddenFor(message, query.Me) {
+			continue
+		}
+		if query.Since != nil && message.CreatedAt.Before(*query.Since) {
+			continue
+		}
+		if query.Until != nil && !message.CreatedAt.Before(*query.Until) {
+			continue
+		}
+		if query.Before != nil && compareIds(message.Id, *query.Before) >= 0 {
+			continue
+		}
+		if matchesSearch(message.Message, query.Words, query.Phrases) {
+			messages = append(messages, copyMessage(message))
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return compareIds(messages[i].Id, messages[j].Id) > 0
+	})
+	if query.Limit > 0 && int64(len(messages)) > query.Limit {
+		messages = messages[:query.Limit]
+	}
+	return messages, nil
+}
+
+func (s *MemoryStore) findLastMessage(me primitive.ObjectID, conversation primitive.ObjectID) *Message {
+	var last *Message
+	for i := range s.messages {
+		message := &s.messages[i]
+		if message.ConversationId == conversation && !isHiddenFor(message, me) && (last == nil || compareIds(message.Id, last.Id) > 0) {
+			last = message
+		}
+	}
+	return last
+}
+
+func (s *MemoryStore) GetLastMessage(ctx context.Context, me primitive.ObjectID, conversation primitive.ObjectID) (*Message, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	last := s.findLastMessage(me, conversation)
+	if last == nil {
+		return nil, ErrNotFound
+	}
+	result := copyMessage(last)
+	return &result, nil
+}
+
+func (s *MemoryStore) markReceipt(read bool, recipient primitive.ObjectID, conversation primitive.ObjectID, upTo primitive.ObjectID, at time.Time) int64 {
+	var changed int64
+	key := recipient.Hex()
+	for i := range s.messages {
+		message := &s.messages[i]
+		if message.ConversationId != conversation || message.From == recipient || compareIds(message.Id, upTo) > 0 {
+			continue
+		}
+		if message.Receipts == nil {
+			message.Receipts = make(map[string]Receipt)
+		}
+		receipt := message.Receipts[key]
+		stamp := at
+		if read && receipt.ReadAt == nil {
+			receipt.ReadAt = &stamp
+		} else if !read && receipt.DeliveredAt == nil {
+			receipt.DeliveredAt = &stamp
+		} else {
+			continue
+		}
+		message.Receipts[key] = receipt
+		changed++
+	}
+	return changed
+}
+
+func (s *MemoryStore) MarkDelivered(ctx context.Context, recipient primitive.ObjectID, conversation primitive.ObjectID, upTo primitive.ObjectID, at time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.markReceipt(false, recipient, conversation, upTo, at), nil
+}
+
+func (s *MemoryStore) MarkRead(ctx context.Context, recipient primitive.ObjectID, conversation primitive.ObjectID, upTo primitive.ObjectID, at time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.markReceipt(false, recipient, conversation, upTo, at)
+	return s.markReceipt(true, recipient, conversation, upTo, at), nil
+}
+
+func (s *MemoryStore) SetReadCursor(ctx context.Context, user primitive.ObjectID, conversation primitive.ObjectID, upTo primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reader, exists := s.users[user]
+	if !exists {
+		return nil
+	}
+	if current, exists := reader.ReadCursors[conversation]; !exists || compareIds(upTo, current) > 0 {
+		reader.ReadCursors[conversation] = upTo
+	}
+	if summary := s.summaries[summaryKey{user, conversation}]; summary != nil {
+		summary.UnreadCount = s.countUnread(user, conversation, reader.ReadCursors[conversation])
+	}
+	return nil
+}
+
+// Messages from others after the cursor the user can still see
+func (s *MemoryStore) countUnread(user primitive.ObjectID, conversation primitive.ObjectID, cursor primitive.ObjectID) int64 {
+	var count int64
+	for i := range s.messages {
+		message := &s.messages[i]
+		if message.ConversationId == conversation && message.From != user && compareIds(message.Id, cursor) > 0 &&
+			!message.Deleted && !isHiddenFor(message, user) {
+			count++
+		}
+	}
+	return count
+}
+
+// Unread counts of the conversation's summaries counted again, after messages
+// were removed, deleted or hidden. The lock must be held.
+func (s *MemoryStore) recountUnread(conversation primitive.ObjectID) {
+	for _, summary := range s.summaries {
+		if summary.ConversationId != conversation {
+			continue
+		}
+		cursor := primitive.NilObjectID
+		if user := s.users[summary.User]; user != nil {
+			cursor = user.ReadCursors[conversation]
+		}
+		summary.UnreadCount = s.countUnread(summary.User, conversation, cursor)
+	}
+}
+
+func (s *MemoryStore) UnreadCounts(ctx context.Context, user primitive.ObjectID) (map[primitive.ObjectID]int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, exists := s.users[user]; !exists {
+		return nil, ErrNotFound
+	}
+	counts := make(map[primitive.ObjectID]int64)
+	for _, summary := range s.summaries {
+		if summary.User == user && summary.UnreadCount > 0 {
+			counts[summary.ConversationId] = summary.UnreadCount
+		}
+	}
+	return counts, nil
+}
+
+func containsId(ids []primitive.ObjectID, id primitive.ObjectID) bool {
+	for _, existing := range ids {
+		if existing == id {
+			return true
+		}
+	}
+	return false
+}
+
+func copyConversation(conversation *Conversation) *Conversation {
+	result := *conversation
+	result.Members = append([]primitive.ObjectID(nil), conversation.Members...)
+	result.Admins = append([]primitive.ObjectID(nil), conversation.Admins...)
+	if conversation.LastMessage != nil {
+		lastMessage := copyMessage(conversation.LastMessage)
+		result.LastMessage = &lastMessage
+	}
+	return &result
+}
+
+func (s *MemoryStore) CreateConversation(ctx context.Context, conversation *Conversation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conversations[conversation.Id] = copyConversation(conversation)
+	for _, member := range conversation.Members {
+		s.summaries[summaryKey{member, conversation.Id}] = newSummary(member, conversation, conversation.CreatedAt)
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetConversation(ctx context.Context, id primitive.ObjectID) (*Conversation, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	conversation, exists := s.conversations[id]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	return copyConversation(conversation), nil
+}
+
+func (s *MemoryStore) findDirectConversation(id1 primitive.ObjectID, id2 primitive.ObjectID) *Conversation {
+	key := DirectKey(id1, id2)
+	for _, conversation := range s.conversations {
+		if conversation.DirectKey == key {
+			return conversation
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetDirectConversation(ctx context.Context, id1 primitive.ObjectID, id2 primitive.ObjectID) (*Conversation, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	conversation := s.findDirectConversation(id1, id2)
+	if conversation == nil {
+		return nil, ErrNotFound
+	}
+	return copyConversation(conversation), nil
+}
+
+func (s *MemoryStore) EnsureDirectConversation(ctx context.Context, id1 primitive.ObjectID, id2 primitive.ObjectID, at time.Time) (*Conversation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conversation := s.findDirectConversation(id1, id2)
+	if conversation == nil {
+		conversation = &Conversation{
+			Id:        primitive.NewObjectID(),
+			Type:      ConversationDirect,
+			Members:   []primitive.ObjectID{id1, id2},
+			CreatedBy: id1,
+			CreatedAt: at,
+			UpdatedAt: at,
+			DirectKey: DirectKey(id1, id2),
+		}
+		s.conversations[conversation.Id] = conversation
+	}
+	return copyConversation(conversation), nil
+}
+
+func (s *MemoryStore) GetConversations(ctx context.Context, member primitive.ObjectID) ([]Conversation, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var conversations []Conversation
+	for _, conversation := range s.conversations {
+		if containsId(conversation.Members, member) {
+			conversations = append(conversations, *copyConversation(conversation))
+		}
+	}
+	return conversations, nil
+}
+
+func (s *MemoryStore) updateConversation(id primitive.ObjectID, at time.Time, update func(*Conversation)) (*Conversation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conversation, exists := s.conversations[id]
+	if !exists {
+		return nil, ErrNotFound
+	}
+	update(conversation)
+	conversation.UpdatedAt = at
+	return copyConversation(conversation), nil
+}
+
+func (s *MemoryStore) AddMembers(ctx context.Context, id primitive.ObjectID, members []primitive.ObjectID, at time.Time) (*Conversation, error) {
+	return s.updateConversation(id, at, func(conversation *Conversation) {
+		for _, member := range members {
+			conversation.Members = addId(conversation.Members, member)
+			key := summaryKey{member, conversation.Id}
+			if s.summaries[key] == nil {
+				summary := newSummary(member, conversation, at)
+				if conversation.LastMessage != nil {
+					lastMessage := copyMessage(conversation.LastMessage)
+					summary.LastMessage = &lastMessage
+				}
+				s.summaries[key] = summary
+			}
+		}
+	})
+}
+
+func (s *MemoryStore) RemoveMember(ctx context.Context, id primitive.ObjectID, member primitive.ObjectID, at time.Time) (*Conversation, error) {
+	return s.updateConversation(id, at, func(conversation *Conversation) {
+		conversation.Members = removeId(conversation.Members, member)
+		conversation.Admins = removeId(conversation.Admins, member)
+		delete(s.summaries, summaryKey{member, conversation.Id})
+	})
+}
+
+func (s *MemoryStore) RenameConversation(ctx context.Context, id primitive.ObjectID, name string, at time.Time) (*Conversation, error) {
+	return s.updateConversation(id, at, func(conversation *Conversation) {
+		conversation.Name = name
+		for _, member := range conversation.Members {
+			if summary := s.summaries[summaryKey{member, conversation.Id}]; summary != nil {
+				summary.Name = name
+			}
+		}
+	})
+}
+
+func (s *MemoryStore) SetRetention(ctx context.Context, id primitive.ObjectID, retention *RetentionSetting, at time.Time) (*Conversation, error) {
+	return s.updateConversation(id, at, func(conversation *Conversation) {
+		conversation.Retention = retention
+		for _, member := range conversation.Members {
+			if summary := s.summaries[summaryKey{member, conversation.Id}]; summary != nil {
+				summary.Retention = retention
+			}
+		}
+	})
+}
+
+func (s *MemoryStore) SetAdmin(ctx context.Context, id primitive.ObjectID, member primitive.ObjectID, admin bool, at time.Time) (*Conversation, error) {
+	return s.updateConversation(id, at, func(conversation *Conversation) {
+		if admin {
+			conversation.Admins = addId(conversation.Admins, member)
+		} else {
+			conversation.Admins = removeId(conversation.Admins, member)
+		}
+	})
+}
+
+// Whether the summary comes after the given position in a conversation list
+func isOlderThan(summary *ConversationSummary, at time.Time, conversation primitive.ObjectID) bool {
+	if !summary.UpdatedAt.Equal(at) {
+		return summary.UpdatedAt.Before(at)
+	}
+	return compareIds(summary.ConversationId, conversation) < 0
+}
+
+func (s *MemoryStore) GetSummaries(ctx context.Context, query SummaryQuery) ([]ConversationSummary, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var summaries []ConversationSummary
+	for _, summary := range s.summaries {
+		if summary.User != query.User {
+			continue
+		}
+		if query.Before != nil && !isOlderThan(summary, *query.Before, query.BeforeConversation) {
+			continue
+		}
+		result := *summary
+		if summary.LastMessage != nil {
+			lastMessage := copyMessage(summary.LastMessage)
+			result.LastMessage = &lastMessage
+		}
+		summaries = append(summaries, result)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return isOlderThan(&summaries[j], summaries[i].UpdatedAt, summaries[i].ConversationId)
+	})
+	if query.Limit > 0 && int64(len(summaries)) > query.Limit {
+		summaries = summaries[:query.Limit]
+	}
+	return summaries, nil
+}
+
+func (s *MemoryStore) SaveAttachment(ctx context.Context, attachment *Attachment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	saved := *attachment
+	s.attachments[attachment.Id] = &saved
+	return nil
+}
+
+func (s *MemoryStore) GetAttachment(ctx context.Context, id primitive.ObjectID) (*Attachment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	attachment, ok := s.attachments[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	result := *attachment
+	return &result, nil
+}
+
+func (s *MemoryStore) ClaimAttachments(ctx context.Context, ids []primitive.ObjectID, message *Message) ([]Attachment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var claimed []Attachment
+	for _, id := range ids {
+		attachment, ok := s.attachments[id]
+		if ok && attachment.MessageId != nil && *attachment.MessageId == message.Id {
+			// Repeated id
+			continue
+		}
+		if !ok || attachment.UploadedBy != message.From || attachment.ConversationId != message.ConversationId || attachment.MessageId != nil {
+			s.releaseAttachments(message.Id)
+			return nil, ErrNotFound
+		}
+		claim := message.Id
+		attachment.MessageId = &claim
+		attachment.ExpireAt = message.ExpireAt
+		claimed = append(claimed, *attachment)
+	}
+	return claimed, nil
+}
+
+// Must be called with the lock held
+func (s *MemoryStore) releaseAttachments(message primitive.ObjectID) {
+	for _, attachment := range s.attachments {
+		if attachment.MessageId != nil && *attachment.MessageId == message {
+			attachment.MessageId = nil
+			attachment.ExpireAt = nil
+		}
+	}
+}
+
+func (s *MemoryStore) ReleaseAttachments(ctx context.Context, message primitive.ObjectID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.releaseAttachments(message)
+	return nil
+}
+
+func (s *MemoryStore) DeleteMessageAttachments(ctx context.Context, message primitive.ObjectID) ([]Attachment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var deleted []Attachment
+	for id, attachment := range s.attachments {
+		if attachment.MessageId != nil && *attachment.MessageId == message {
+			deleted = append(deleted, *attachment)
+			delete(s.attachments, id)
+		}
+	}
+	return deleted, nil
+}
+
+func (s *MemoryStore) DeleteExpiredAttachments(ctx context.Context, now time.Time, unclaimedBefore time.Time, limit int) ([]Attachment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var deleted []Attachment
+	for id, attachment := range s.attachments {
+		if len(deleted) >= limit {
+			break
+		}
+		expired := attachment.ExpireAt != nil && !attachment.ExpireAt.After(now)
+		unclaimed := attachment.MessageId == nil && attachment.CreatedAt.Before(unclaimedBefore)
+		if expired || unclaimed {
+			deleted = append(deleted, *attachment)
+			delete(s.attachments, id)
+		}
+	}
+	return deleted, nil
+}
+
+func (s *MemoryStore) DeleteExpiredMessages(ctx context.Context, now time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	affected := make(map[primitive.ObjectID]bool)
+	kept := make([]Message, 0, len(s.messages))
+	for _, message := range s.messages {
+		if message.ExpireAt != nil && !message.ExpireAt.After(now) {
+			affected[message.ConversationId] = true
+			continue
+		}
+		kept = append(kept, message)
+	}
+	removed := int64(len(s.messages) - len(kept))
+	if removed == 0 {
+		return 0, nil
+	}
+	s.messages = kept
+
+	for id := range affected {
+		conversation := s.conversations[id]
+		if conversation == nil {
+			continue
+		}
+		conversation.LastMessage = nil
+		if last := s.findLastMessage(primitive.NilObjectID, id); last != nil {
+			copied := copyMessage(last)
+			conversation.LastMessage = snapshotOf(&copied)
+		}
+	}
+	for _, summary := range s.summaries {
+		if !affected[summary.ConversationId] {
+			continue
+		}
+		summary.LastMessage = nil
+		if last := s.findLastMessage(summary.User, summary.ConversationId); last != nil {
+			copied := copyMessage(last)
+			summary.LastMessage = snapshotOf(&copied)
+		}
+	}
+	for id := range affected {
+		s.recountUnread(id)
+	}
+	return removed, nil
+}
+
+func (s *MemoryStore) AppendEvent(ctx context.Context, event *Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.eventSeqs[event.User]++
+	event.Seq = s.eventSeqs[event.User]
+	s.events = append(s.events, *event)
+	return nil
+}
+
+func (s *MemoryStore) GetEvents(ctx context.Context, user primitive.ObjectID, after int64, limit int64) ([]Event, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var events []Event
+	now := time.Now()
+	// Appended in sequence order already
+	for _, event := range s.events {
+		if event.User == user && event.Seq > after && event.ExpireAt.After(now) {
+			events = append(events, event)
+		}
+	}
+	if limit > 0 && int64(len(events)) > limit {
+		events = events[:limit]
+	}
+	return events, nil
+}
+
+func (s *MemoryStore) ShortenConversationEvents(ctx context.Context, conversation primitive.ObjectID, retention time.Duration, now time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.events[:0]
+	for _, event := range s.events {
+		if !conversation.IsZero() && event.ConversationId == conversation {
+			expireAt := time.UnixMilli(event.Timestamp).Add(retention)
+			if !expireAt.After(now) {
+				continue
+			}
+			if expireAt.Before(event.ExpireAt) {
+				event.ExpireAt = expireAt
+			}
+		}
+		kept = append(kept, event)
+	}
+	removed := int64(len(s.events) - len(kept))
+	s.events = kept
+	return removed, nil
+}
+
+func (s *MemoryStore) EventSeqAt(ctx context.Context, user primitive.ObjectID, id primitive.ObjectID) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var seq int64
+	for _, event := range s.events {
+		if event.User == user && compareIds(event.Id, id) <= 0 && event.Seq > seq {
+			seq = event.Seq
+		}
+	}
+	return seq, nil
+}
+
+func (s *MemoryStore) GetUserToken(ctx context.Context, id primitive.ObjectID) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	user, exists := s.users[id]
+	if !exists {
+		return "", ErrNotFound
+	}
+	return user.Token, nil
+}
+
+func (s *MemoryStore) SetUserToken(ctx context.Context, id primitive.ObjectID, token string) error {
+	return s.SetUserProperty(ctx, id, "token", token)
+}
@@ -0,0 +1,397 @@
+package db_handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Backfills data written before every message belonged to a conversation:
+// direct messages get their conversation and read cursors keyed by the other
+// user move to the conversation. Then every member gets the summary of their
+// conversations and messages get the words searches look for. Only touches
+// documents that weren't migrated yet, so it runs on every start.
+func (s *MongoStore) MigrateConversations(ctx context.Context) error {
+	// Groups were the only conversations before types existed
+	_, err := s.conversations().UpdateMany(ctx,
+		bson.M{"type": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"type": ConversationGroup}},
+	)
+	if err != nil {
+		return err
+	}
+
+	migrated, err := s.migrateDirectMessages(ctx)
+	if err != nil {
+		return err
+	}
+	cursors, err := s.migrateReadCursors(ctx)
+	if err != nil {
+		return err
+	}
+	if migrated > 0 || cursors > 0 {
+		log.Printf("migrated %d messages and %d read cursors to conversations", migrated, cursors)
+	}
+
+	summaries, err := s.migrateSummaries(ctx)
+	if err != nil {
+		return err
+	}
+	if summaries > 0 {
+		log.Printf("created %d conversation summaries", summaries)
+	}
+
+	terms, err := s.migrateSearchTerms(ctx)
+	if err != nil {
+		return err
+	}
+	if terms > 0 {
+		log.Printf("indexed the words of %d messages for search", terms)
+	}
+	return nil
+}
+
+func (s *MongoStore) migrateDirectMessages(ctx context.Context) (int64, error) {
+	pipeline := bson.A{
+		bson.M{"$match": bson.M{
+			"conversationId": bson.M{"$exists": false},
+		}},
+		bson.M{"$group": bson.M{
+			"_id":   bson.M{"from": "$from", "to": "$to"},
+			"first": bson.M{"$min": "$createdAt"},
+		}},
+	}
+	cursor, err := s.messages().Aggregate(ctx, pipeline)
+	if err != nil {
+		return 0, err
+	}
+	var pairs []struct {
+		Users struct {
+			From primitive.ObjectID `bson:"from"`
+			To   primitive.ObjectID `bson:"to"`
+		} `bson:"_id"`
+		First time.Time `bson:"first"`
+	}
+	if err = cursor.All(ctx, &pairs); err != nil {
+		return 0, err
+	}
+
+	var migrated int64
+	for _, pair := range pairs {
+		conversation, err := s.EnsureDirectConversation(ctx, pair.Users.From, pair.Users.To, pair.First)
+		if err != nil {
+			return migrated, err
+		}
+		filter := bson.M{
+			"conversationId": bson.M{"$exists": false},
+			"from":           pair.Users.From,
+			"to":             pair.Users.To,
+		}
+		result, err := s.messages().UpdateMany(ctx, filter, bson.M{
+			"$set": bson.M{"conversationId": conversation.Id},
+		})
+		if err != nil {
+			return migrated, err
+		}
+		migrated += result.ModifiedCount
+
+		last, err := s.GetLastMessage(ctx, primitive.NilObjectID, conversation.Id)
+		if err != nil {
+			return migrated, err
+		}
+		if err = s.refreshLastMessage(ctx, last); err != nil {
+			return migrated, err
+		}
+	}
+	return migrated, nil
+}
+
+// Cursors whose key isn't a conversation were keyed by the other user
+func (s *MongoStore) migrateReadCursors(ctx context.Context) (int, error) {
+	opts := options.Find().SetProjection(bson.M{"readCursors": 1})
+	cursor, err := s.users().Find(ctx, bson.M{"readCursors": bson.M{"$exists": true}}, opts)
+	if err != nil {
+		return 0, err
+	}
+	var users []struct {
+		Id          primitive.ObjectID            `bson:"_id"`
+		ReadCursors map[string]primitive.ObjectID `bson:"readCursors"`
+	}
+	if err = cursor.All(ctx, &users); err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, user := range users {
+		for key, upTo := range user.ReadCursors {
+			other, err := primitive.ObjectIDFromHex(key)
+			if err != nil {
+				continue
+			}
+			count, err := s.conversations().CountDocuments(ctx, bson.M{"_id": other})
+			if err != nil {
+				return migrated, err
+			}
+			if count > 0 {
+				continue
+			}
+
+			update := bson.M{
+				"$unset": bson.M{"readCursors." + key: ""},
+			}
+			conversation, err := s.GetDirectConversation(ctx, user.Id, other)
+			if err == nil {
+				update["$max"] = bson.M{"readCursors." + conversation.Id.Hex(): upTo}
+			} else if !errors.Is(err, ErrNotFound) {
+				return migrated, err
+			}
+			if _, err = s.users().UpdateOne(ctx, bson.M{"_id": user.Id}, update); err != nil {
+				return migrated, err
+			}
+			migrated++
+		}
+	}
+	return migrated, nil
+}
+
+// Summaries are written along with every message since they exist, so they
+// are only built from scratch when there are none. Emptying the collection
+// rebuilds them on the next start.
+func (s *MongoStore) migrateSummaries(ctx context.Context) (int, error) {
+	count, err := s.summaries().EstimatedDocumentCount(ctx)
+	if err != nil || count > 0 {
+		return 0, err
+	}
+	cursor, err := s.conversations().Find(ctx, bson.M{})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	created := 0
+	for cursor.Next(ctx) {
+		var conversation Conversation
+		if err = cursor.Decode(&conversation); err != nil {
+			return created, err
+		}
+		for _, member := range conversation.Members {
+			summary, err := s.buildSummary(ctx, member, &conversation)
+			if err != nil {
+				return created, err
+			}
+			fields := summaryFields(summary)
+			fields["updatedAt"] = summary.UpdatedAt
+			fields["unreadCount"] = summary.UnreadCount
+			if summary.LastMessage != nil {
+				fields["lastMessage"] = summary.LastMessage
+			}
+			opts := options.Update().SetUpsert(true)
+			_, err = s.summaries().UpdateOne(ctx, summaryFilter(member, conversation.Id), bson.M{"$setOnInsert": fields}, opts)
+			if err != nil {
+				return created, err
+			}
+			created++
+		}
+	}
+	return created, cursor.Err()
+}
+
+// Summary of the conversation for the member computed from its messages
+func (s *MongoStore) buildSummary(ctx context.Context, member primitive.ObjectID, conversation *Conversation) (*ConversationSummary, error) {
+	summary := newSummary(member, conversation, conversation.CreatedAt)
+	last, err := s.GetLastMessage(ctx, member, conversation.Id)
+	if err == nil {
+		summary.LastMessage = snapshotOf(last)
+		summary.UpdatedAt = last.CreatedAt
+	} else if !errors.Is(err, ErrNotFound) {
+		return nil, err
+	}
+
+	key := "readCursors." + conversation.Id.Hex()
+	var cursors struct {
+		ReadCursors map[string]primitive.ObjectID `bson:"readCursors"`
+	}
+	opts := options.FindOne().SetProjection(bson.M{key: 1})
+	err = s.users().FindOne(ctx, bson.M{"_id": member}, opts).Decode(&cursors)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, err
+	}
+	summary.UnreadCount, err = s.countUnread(ctx, member, conversation.Id, cursors.ReadCursors[conversation.Id.Hex()])
+	if err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// Messages saved before searches existed, written in batches
+func (s *MongoStore) migrateSearchTerms(ctx context.Context) (int, error) {
+	opts := options.Find().SetProjection(bson.M{"message": 1})
+	cursor, err := s.messages().Find(ctx, bson.M{"terms": bson.M{"$exists": false}}, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	migrated := 0
+	var models []mongo.WriteModel
+	write := func() error {
+		if len(models) == 0 {
+			return nil
+		}
+		_, err := s.messages().BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		migrated += len(models)
+		models = nil
+		return err
+	}
+	for cursor.Next(ctx) {
+		var message Message
+		if err = cursor.Decode(&message); err != nil {
+			return migrated, err
+		}
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": message.Id}).
+			SetUpdate(bson.M{"$set": bson.M{"terms": searchTerms(message.Message)}}))
+		if len(models) == 500 {
+			if err = write(); err != nil {
+				return migrated, err
+			}
+		}
+	}
+	if err = cursor.Err(); err != nil {
+		return migrated, err
+	}
+	return migrated, write()
+}
+
+// Runs before the indexes are created: the unique users_authId index can't
+// be built while several users share an authId, and which of them requests
+// resolved to was never defined. Startup stops with the duplicates listed so
+// they are merged by hand, their contacts, messages and conversations point
+// to different ids. Also drops that index if it was created before it was
+// unique.
+func (s *MongoStore) MigrateUsers(ctx context.Context) error {
+	pipeline := bson.A{
+		bson.M{"$match": bson.M{
+			"authId": bson.M{"$gt": ""},
+		}},
+		bson.M{"$group": bson.M{
+			"_id":   "$authId",
+			"ids":   bson.M{"$push": "$_id"},
+			"count": bson.M{"$sum": 1},
+		}},
+		bson.M{"$match": bson.M{
+			"count": bson.M{"$gt": 1},
+		}},
+	}
+	cursor, err := s.users().Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return err
+	}
+	var duplicates []struct {
+		AuthId string               `bson:"_id"`
+		Ids    []primitive.ObjectID `bson:"ids"`
+	}
+	if err = cursor.All(ctx, &duplicates); err != nil {
+		return err
+	}
+	if len(duplicates) > 0 {
+		authIds := make([]string, 0, len(duplicates))
+		for _, duplicate := range duplicates {
+			ids := make([]string, 0, len(duplicate.Ids))
+			for _, id := range duplicate.Ids {
+				ids = append(ids, id.Hex())
+			}
+			log.Printf("users %s share the authId %q", strings.Join(ids, ", "), duplicate.AuthId)
+			authIds = append(authIds, duplicate.AuthId)
+		}
+		sort.Strings(authIds)
+		return fmt.Errorf("%d authIds belong to more than one user, merge them first: %s", len(authIds), strings.Join(authIds, ", "))
+	}
+
+	cursor, err = s.users().Indexes().List(ctx)
+	if err != nil {
+		return err
+	}
+	var specs []struct {
+		Name   string `bson:"name"`
+		Unique bool   `bson:"unique"`
+	}
+	if err = cursor.All(ctx, &specs); err != nil {
+		return err
+	}
+	for _, spec := range specs {
+		if spec.Name == "users_authId" && !spec.Unique {
+			if _, err = s.users().Indexes().DropOne(ctx, spec.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Runs before the indexes are created: numbers the events stored before they
+// had sequence numbers, in id order, as the unique events_user_seq index
+// needs. They expire within days, so there are few.
+func (s *MongoStore) MigrateEvents(ctx context.Context) error {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "user", Value: 1}, {Key: "_id", Value: 1}}).
+		SetProjection(bson.M{"user": 1})
+	cursor, err := s.events().Find(ctx, bson.M{"seq": bson.M{"$exists": false}}, opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	migrated := 0
+	for cursor.Next(ctx) {
+		var event Event
+		if err = cursor.Decode(&event); err != nil {
+			return err
+		}
+		seq, err := s.nextEventSeq(ctx, event.User)
+		if err != nil {
+			return err
+		}
+		_, err = s.events().UpdateOne(ctx, bson.M{"_id": event.Id}, bson.M{"$set": bson.M{"seq": seq}})
+		if err != nil {
+			return err
+		}
+		migrated++
+	}
+	if err = cursor.Err(); err != nil {
+		return err
+	}
+	if migrated > 0 {
+		log.Printf("numbered %d events", migrated)
+	}
+	return nil
+}
+
+// Runs before the indexes are created: the messages_ttl index removed
+// messages as soon as they expired before the sweeper did it, its delay is
+// changed in place since an index can't be created again with other options.
+func (s *MongoStore) MigrateMessagesTTL(ctx context.Context) error {
+	command := bson.D{
+		{Key: "collMod", Value: "messages"},
+		{Key: "index", Value: bson.M{
+			"name":               "messages_ttl",
+			"expireAfterSeconds": messagesTTLDelay,
+		}},
+	}
+	err := s.db.RunCommand(ctx, command).Err()
+	var commandErr mongo.CommandError
+	// No messages collection or index yet, EnsureIndexes creates it
+	if errors.As(err, &commandErr) && (commandErr.Code == 26 || commandErr.Code == 27) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,138 @@
+package db_handler
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func (s *MongoStore) attachments() *mongo.Collection {
+	return s.db.Collection("attachments")
+}
+
+// Attachments in the order of ids, duplicates left out
+func orderAttachments(ids []primitive.ObjectID, attachments []Attachment) []Attachment {
+	byId := make(map[primitive.ObjectID]Attachment, len(attachments))
+	for _, attachment := range attachments {
+		byId[attachment.Id] = attachment
+	}
+	ordered := make([]Attachment, 0, len(attachments))
+	for _, id := range ids {
+		if attachment, ok := byId[id]; ok {
+			ordered = append(ordered, attachment)
+			delete(byId, id)
+		}
+	}
+	return ordered
+}
+
+func (s *MongoStore) SaveAttachment(ctx context.Context, attachment *Attachment) error {
+	_, err := s.attachments().InsertOne(ctx, attachment)
+	return err
+}
+
+func (s *MongoStore) GetAttachment(ctx context.Context, id primitive.ObjectID) (*Attachment, error) {
+	var attachment Attachment
+	err := s.attachments().FindOne(ctx, bson.M{"_id": id}).Decode(&attachment)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &attachment, nil
+}
+
+// A single update claims them so two messages can't get the same attachment,
+// when only some match the claim is rolled back
+func (s *MongoStore) ClaimAttachments(ctx context.Context, ids []primitive.ObjectID, message *Message) ([]Attachment, error) {
+	unique := make([]primitive.ObjectID, 0, len(ids))
+	for _, id := range ids {
+		unique = addId(unique, id)
+	}
+	filter := bson.M{
+		"_id":            bson.M{"$in": unique},
+		"uploadedBy":     message.From,
+		"conversationId": message.ConversationId,
+		"messageId":      bson.M{"$exists": false},
+	}
+	claim := bson.M{"messageId": message.Id}
+	if message.ExpireAt != nil {
+		claim["expireAt"] = *message.ExpireAt
+	}
+	update := bson.M{
+		"$set": claim,
+	}
+	result, err := s.attachments().UpdateMany(ctx, filter, update)
+	if err != nil {
+		return nil, err
+	}
+	if result.ModifiedCount != int64(len(unique)) {
+		if err = s.ReleaseAttachments(ctx, message.Id); err != nil {
+			return nil, err
+		}
+		return nil, ErrNotFound
+	}
+
+	var attachments []Attachment
+	cursor, err := s.attachments().Find(ctx, bson.M{"messageId": message.Id})
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &attachments); err != nil {
+		return nil, err
+	}
+	return orderAttachments(ids, attachments), nil
+}
+
+func (s *MongoStore) ReleaseAttachments(ctx context.Context, message primitive.ObjectID) error {
+	update := bson.M{
+		"$unset": bson.M{"messageId": "", "expireAt": ""},
+	}
+	_, err := s.attachments().UpdateMany(ctx, bson.M{"messageId": message}, update)
+	return err
+}
+
+func (s *MongoStore) DeleteMessageAttachments(ctx context.Context, message primitive.ObjectID) ([]Attachment, error) {
+	var attachments []Attachment
+	cursor, err := s.attachments().Find(ctx, bson.M{"messageId": message})
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &attachments); err != nil {
+		return nil, err
+	}
+	if len(attachments) == 0 {
+		return nil, nil
+	}
+	ids := make([]primitive.ObjectID, len(attachments))
+	for i, attachment := range attachments {
+		ids[i] = attachment.Id
+	}
+	_, err = s.attachments().DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	return attachments, err
+}
+
+// One at a time so an upload claimed while the sweep runs is never removed
+func (s *MongoStore) DeleteExpiredAttachments(ctx context.Context, now time.Time, unclaimedBefore time.Time, limit int) ([]Attachment, error) {
+	filter := bson.M{
+		"$or": bson.A{
+			bson.M{"expireAt": bson.M{"$lte": now}},
+			bson.M{"messageId": bson.M{"$exists": false}, "createdAt": bson.M{"$lt": unclaimedBefore}},
+		},
+	}
+	var deleted []Attachment
+	for len(deleted) < limit {
+		var attachment Attachment
+		err := s.attachments().FindOneAndDelete(ctx, filter).Decode(&attachment)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			break
+		}
+		if err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, attachment)
+	}
+	return deleted, nil
+}
@@ -0,0 +1,982 @@
+package db_handler
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type MongoStore struct {
+	db *mongo.Database
+}
+
+func NewMongoStore(database *mongo.Database) *MongoStore {
+	return &MongoStore{db: database}
+}
+
+func (s *MongoStore) users() *mongo.Collection {
+	return s.db.Collection("users")
+}
+
+func (s *MongoStore) messages() *mongo.Collection {
+	return s.db.Collection("messages")
+}
+
+func (s *MongoStore) conversations() *mongo.Collection {
+	return s.db.Collection("conversations")
+}
+
+func (s *MongoStore) events() *mongo.Collection {
+	return s.db.Collection("events")
+}
+
+// One document per user holding the last sequence number of their events
+func (s *MongoStore) eventCounters() *mongo.Collection {
+	return s.db.Collection("eventCounters")
+}
+
+func notFound(err error) error {
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *MongoStore) CreateUser(ctx context.Context, user *User) error {
+	_, err := s.users().InsertOne(ctx, user)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrExists
+	}
+	return err
+}
+
+func (s *MongoStore) GetUser(ctx context.Context, id primitive.ObjectID) (*User, error) {
+	var user User
+	err := s.users().FindOne(ctx, bson.M{"_id": id}).Decode(&user)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &user, nil
+}
+
+func (s *MongoStore) GetUserByAuthId(ctx context.Context, authId string) (*User, error) {
+	var user User
+	err := s.users().FindOne(ctx, bson.M{"authId": authId}).Decode(&user)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &user, nil
+}
+
+func (s *MongoStore) GetUsers(ctx context.Context, ids []primitive.ObjectID) ([]User, error) {
+	filter := bson.M{
+		"_id": bson.M{
+			"$in": ids,
+		},
+	}
+	var users []User
+	cursor, err := s.users().Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (s *MongoStore) SearchUsers(ctx context.Context, term string) ([]User, error) {
+	filter := bson.M{
+		"$text": bson.M{
+			"$search":             term,
+			"$caseSensitive":      false,
+			"$diacriticSensitive": false,
+		},
+	}
+	var users []User
+	cursor, err := s.users().Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+func (s *MongoStore) SetUserProperty(ctx context.Context, id primitive.ObjectID, prop string, value string) error {
+	setter := bson.M{
+		"$set": bson.M{
+			prop: value,
+		},
+	}
+	_, err := s.users().UpdateOne(ctx, bson.M{"_id": id}, setter)
+	return err
+}
+
+func (s *MongoStore) SetLastSeen(ctx context.Context, id primitive.ObjectID, at time.Time) error {
+	setter := bson.M{
+		"$set": bson.M{
+			"lastSeen": at,
+		},
+	}
+	_, err := s.users().UpdateOne(ctx, bson.M{"_id": id}, setter)
+	return err
+}
+
+func (s *MongoStore) SetHidePresence(ctx context.Context, id primitive.ObjectID, hide bool) error {
+	setter := bson.M{
+		"$set": bson.M{
+			"hidePresence": hide,
+		},
+	}
+	_, err := s.users().UpdateOne(ctx, bson.M{"_id": id}, setter)
+	return err
+}
+
+func (s *MongoStore) GetContactsData(ctx context.Context, id primitive.ObjectID) (*ContactsData, error) {
+	var contactsData ContactsData
+	project := bson.M{
+		"contacts":         1,
+		"receivedRequests": 1,
+		"sentRequests":     1,
+	}
+	opts := options.FindOne().SetProjection(project)
+	err := s.users().FindOne(ctx, bson.M{"_id": id}, opts).Decode(&contactsData)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &contactsData, nil
+}
+
+func (s *MongoStore) SendFriendRequest(ctx context.Context, from primitive.ObjectID, to primitive.ObjectID) ([]primitive.ObjectID, error) {
+	receiverUpdate := bson.M{
+		"$addToSet": bson.M{
+			"receivedRequests": from,
+		},
+	}
+	_, err := s.users().UpdateOne(ctx, bson.M{"_id": to}, receiverUpdate)
+	if err != nil {
+		return nil, err
+	}
+
+	senderUpdate := bson.M{
+		"$addToSet": bson.M{
+			"sentRequests": to,
+		},
+	}
+	var results struct {
+		SentRequests []primitive.ObjectID `bson:"sentRequests"`
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err = s.users().FindOneAndUpdate(ctx, bson.M{"_id": from}, senderUpdate, opts).Decode(&results)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return results.SentRequests, nil
+}
+
+func (s *MongoStore) AcceptFriendRequest(ctx context.Context, from primitive.ObjectID, to primitive.ObjectID) error {
+	receiverUpdate := bson.M{
+		"$pull": bson.M{
+			"receivedRequests": from,
+		},
+		"$addToSet": bson.M{
+			"contacts": from,
+		},
+	}
+	_, err := s.users().UpdateOne(ctx, bson.M{"_id": to}, receiverUpdate)
+	if err != nil {
+		return err
+	}
+
+	senderUpdate := bson.M{
+		"$pull": bson.M{
+			"sentRequests": to,
+		},
+		"$addToSet": bson.M{
+			"contacts": to,
+		},
+	}
+	_, err = s.users().UpdateOne(ctx, bson.M{"_id": from}, senderUpdate)
+	return err
+}
+
+func (s *MongoStore) SaveMessage(ctx context.Context, message *Message) error {
+	message.Terms = searchTerms(message.Message)
+	_, err := s.messages().InsertOne(ctx, message)
+	if err != nil {
+		return err
+	}
+	if err = s.refreshLastMessage(ctx, message); err != nil {
+		return err
+	}
+	return s.addToSummaries(ctx, message)
+}
+
+// Makes the message its conversation's LastMessage unless a newer one is
+// there already, which also refreshes it after an edit or deletion
+func (s *MongoStore) refreshLastMessage(ctx context.Context, message *Message) error {
+	filter := bson.M{
+		"_id": message.ConversationId,
+		"$or": bson.A{
+			bson.M{"lastMessage": bson.M{"$exists": false}},
+			bson.M{"lastMessage._id": bson.M{"$lte": message.Id}},
+		},
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"lastMessage": snapshotOf(message),
+		},
+		"$max": bson.M{
+			"updatedAt": message.CreatedAt,
+		},
+	}
+	_, err := s.conversations().UpdateOne(ctx, filter, update)
+	return err
+}
+
+func (s *MongoStore) GetMessage(ctx context.Context, id primitive.ObjectID) (*Message, error) {
+	var message Message
+	err := s.messages().FindOne(ctx, bson.M{"_id": id}).Decode(&message)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &message, nil
+}
+
+func (s *MongoStore) GetMessagesByIds(ctx context.Context, ids []primitive.ObjectID) ([]Message, error) {
+	filter := bson.M{
+		"_id": bson.M{
+			"$in": ids,
+		},
+	}
+	var messages []Message
+	cursor, err := s.messages().Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+func visibleTo(user primitive.ObjectID) bson.M {
+	return bson.M{
+		"hiddenFor": bson.M{
+			"$ne": user,
+		},
+	}
+}
+
+func (s *MongoStore) GetMessages(ctx context.Context, query MessageQuery) ([]Message, error) {
+	conditions := bson.A{
+		bson.M{"conversationId": query.Conversation},
+		visibleTo(query.Me),
+	}
+	if query.Before != nil {
+		conditions = append(conditions, bson.M{"_id": bson.M{"$lt": *query.Before}})
+	}
+	if query.After != nil {
+		conditions = append(conditions, bson.M{"_id": bson.M{"$gt": *query.After}})
+	}
+
+	// Walking forward from After the closest messages are the oldest ones
+	forward := query.After != nil && query.Before == nil
+	sort := -1
+	if forward {
+		sort = 1
+	}
+	var messages []Message
+	opts := options.Find().SetLimit(query.Limit)
+	opts.SetSort(bson.M{"_id": sort})
+	cursor, err := s.messages().Find(ctx, bson.M{"$and": conditions}, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+	if forward {
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
+		}
+	}
+	return messages, nil
+}
+
+func (s *MongoStore) SearchMessages(ctx context.Context, query SearchQuery) ([]Message, error) {
+	conditions := bson.A{
+		bson.M{"conversationId": bson.M{"$in": query.Conversations}},
+		bson.M{"deleted": bson.M{"$ne": true}},
+		visibleTo(query.Me),
+	}
+	for _, word := range query.Words {
+		// Anchored so the terms index is read as a range
+		conditions = append(conditions, bson.M{"terms": primitive.Regex{Pattern: "^" + regexp.QuoteMeta(word)}})
+	}
+	for _, phrase := range query.Phrases {
+		// The terms narrow it down, the text has them in order
+		conditions = append(conditions,
+			bson.M{"terms": bson.M{"$all": phrase}},
+			bson.M{"message": primitive.Regex{Pattern: phrasePattern(phrase), Options: "i"}},
+		)
+	}
+	if query.Since != nil {
+		conditions = append(conditions, bson.M{"createdAt": bson.M{"$gte": *query.Since}})
+	}
+	if query.Until != nil {
+		conditions = append(conditions, bson.M{"createdAt": bson.M{"$lt": *query.Until}})
+	}
+	if query.Before != nil {
+		conditions = append(conditions, bson.M{"_id": bson.M{"$lt": *query.Before}})
+	}
+
+	var messages []Message
+	opts := options.Find().SetLimit(query.Limit)
+	opts.SetSort(bson.M{"_id": -1})
+	cursor, err := s.messages().Find(ctx, bson.M{"$and": conditions}, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+func (s *MongoStore) GetLastMessage(ctx context.Context, me primitive.ObjectID, conversation primitive.ObjectID) (*Message, error) {
+	var message Message
+	filter := bson.M{
+		"$and": bson.A{
+			bson.M{"conversationId": conversation},
+			visibleTo(me),
+		},
+	}
+	opts := options.FindOne().SetSort(bson.M{"_id": -1})
+	err := s.messages().FindOne(ctx, filter, opts).Decode(&message)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &message, nil
+}
+
+func (s *MongoStore) EditMessage(ctx context.Context, id primitive.ObjectID, text string, at time.Time) (*Message, error) {
+	filter := bson.M{
+		"_id": id,
+		"deleted": bson.M{
+			"$ne": true,
+		},
+	}
+	// Pipeline update so the current text is moved to the history atomically
+	update := bson.A{
+		bson.M{"$set": bson.M{
+			"edits": bson.M{
+				"$concatArrays": bson.A{
+					bson.M{"$ifNull": bson.A{"$edits", bson.A{}}},
+					bson.A{bson.M{"message": "$message", "replacedAt": at}},
+				},
+			},
+			"message":  bson.M{"$literal": text},
+			"terms":    bson.M{"$literal": searchTerms(text)},
+			"editedAt": at,
+		}},
+	}
+	var message Message
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := s.messages().FindOneAndUpdate(ctx, filter, update, opts).Decode(&message)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &message, s.refreshMessage(ctx, &message)
+}
+
+func (s *MongoStore) DeleteMessage(ctx context.Context, id primitive.ObjectID, at time.Time) (*Message, error) {
+	update := bson.M{
+		"$set": bson.M{
+			"deleted":   true,
+			"deletedAt": at,
+			"message":   "",
+			"terms":     bson.A{},
+		},
+		"$unset": bson.M{
+			"edits":       "",
+			"title":       "",
+			"reactions":   "",
+			"attachments": "",
+		},
+	}
+	var message Message
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := s.messages().FindOneAndUpdate(ctx, bson.M{"_id": id}, update, opts).Decode(&message)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	if err = s.refreshMessage(ctx, &message); err != nil {
+		return nil, err
+	}
+	conversation, err := s.GetConversation(ctx, message.ConversationId)
+	if err != nil {
+		return nil, err
+	}
+	for _, member := range conversation.Members {
+		if member == message.From {
+			continue
+		}
+		if err = s.recountUnread(ctx, member, message.ConversationId); err != nil {
+			return nil, err
+		}
+	}
+	// Their payloads still hold the text
+	if _, err = s.events().DeleteMany(ctx, bson.M{"messageId": id}); err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+func (s *MongoStore) HideMessage(ctx context.Context, id primitive.ObjectID, user primitive.ObjectID) error {
+	update := bson.M{
+		"$addToSet": bson.M{
+			"hiddenFor": user,
+		},
+	}
+	var message Message
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := s.messages().FindOneAndUpdate(ctx, bson.M{"_id": id}, update, opts).Decode(&message)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err = s.refreshMessage(ctx, &message); err != nil {
+		return err
+	}
+	return s.recountUnread(ctx, user, message.ConversationId)
+}
+
+// Most expired messages removed at once, the summaries are brought up to date
+// after each batch
+const expiredMessagesBatch = 500
+
+func (s *MongoStore) DeleteExpiredMessages(ctx context.Context, now time.Time) (int64, error) {
+	filter := bson.M{
+		"expireAt": bson.M{
+			"$lte": now,
+		},
+	}
+	opts := options.Find().SetLimit(expiredMessagesBatch).SetProjection(bson.M{"conversationId": 1})
+	var removed int64
+	for {
+		var expired []Message
+		cursor, err := s.messages().Find(ctx, filter, opts)
+		if err != nil {
+			return removed, err
+		}
+		if err = cursor.All(ctx, &expired); err != nil {
+			return removed, err
+		}
+		if len(expired) == 0 {
+			return removed, nil
+		}
+
+		ids := make([]primitive.ObjectID, 0, len(expired))
+		byConversation := make(map[primitive.ObjectID][]primitive.ObjectID)
+		for _, message := range expired {
+			ids = append(ids, message.Id)
+			byConversation[message.ConversationId] = append(byConversation[message.ConversationId], message.Id)
+		}
+		result, err := s.messages().DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+		if err != nil {
+			return removed, err
+		}
+		removed += result.DeletedCount
+		for conversation, ids := range byConversation {
+			if err = s.afterExpiry(ctx, conversation, ids); err != nil {
+				return removed, err
+			}
+		}
+		if len(expired) < expiredMessagesBatch {
+			return removed, nil
+		}
+	}
+}
+
+// The conversation and the summaries showing one of the removed messages get
+// the newest one left, unread counts are counted again. Filtered on the
+// removed ids, a message sent meanwhile isn't replaced.
+func (s *MongoStore) afterExpiry(ctx context.Context, conversation primitive.ObjectID, removed []primitive.ObjectID) error {
+	showsRemoved := bson.M{"$in": removed}
+	update := bson.M{
+		"$unset": bson.M{"lastMessage": ""},
+	}
+	last, err := s.GetLastMessage(ctx, primitive.NilObjectID, conversation)
+	if err == nil {
+		update = bson.M{
+			"$set": bson.M{"lastMessage": snapshotOf(last)},
+		}
+	} else if !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	_, err = s.conversations().UpdateOne(ctx, bson.M{"_id": conversation, "lastMessage._id": showsRemoved}, update)
+	if err != nil {
+		return err
+	}
+
+	cursor, err := s.summaries().Find(ctx, bson.M{"conversationId": conversation}, options.Find().SetProjection(bson.M{"user": 1}))
+	if err != nil {
+		return err
+	}
+	var summaries []ConversationSummary
+	if err = cursor.All(ctx, &summaries); err != nil {
+		return err
+	}
+	for _, summary := range summaries {
+		update := bson.M{
+			"$unset": bson.M{"lastMessage": ""},
+		}
+		last, err := s.GetLastMessage(ctx, summary.User, conversation)
+		if err == nil {
+			update = bson.M{
+				"$set": bson.M{"lastMessage": snapshotOf(last)},
+			}
+		} else if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		filter := summaryFilter(summary.User, conversation)
+		filter["lastMessage._id"] = showsRemoved
+		if _, err = s.summaries().UpdateOne(ctx, filter, update); err != nil {
+			return err
+		}
+		if err = s.recountUnread(ctx, summary.User, conversation); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Counts the user's unread messages of the conversation again, after some
+// were removed, deleted or hidden
+func (s *MongoStore) recountUnread(ctx context.Context, user primitive.ObjectID, conversation primitive.ObjectID) error {
+	var cursors struct {
+		ReadCursors map[string]primitive.ObjectID `bson:"readCursors"`
+	}
+	key := "readCursors." + conversation.Hex()
+	err := s.users().FindOne(ctx, bson.M{"_id": user}, options.FindOne().SetProjection(bson.M{key: 1})).Decode(&cursors)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return err
+	}
+	unread, err := s.countUnread(ctx, user, conversation, cursors.ReadCursors[conversation.Hex()])
+	if err != nil {
+		return err
+	}
+	_, err = s.summaries().UpdateOne(ctx, summaryFilter(user, conversation), bson.M{
+		"$set": bson.M{"unreadCount": unread},
+	})
+	return err
+}
+
+// After a change to the message, wherever it shows as the last one
+func (s *MongoStore) refreshMessage(ctx context.Context, message *Message) error {
+	if err := s.refreshLastMessage(ctx, message); err != nil {
+		return err
+	}
+	return s.refreshSummaries(ctx, message)
+}
+
+func (s *MongoStore) AddReaction(ctx context.Context, id primitive.ObjectID, user primitive.ObjectID, emoji string) (*Message, error) {
+	update := bson.M{
+		"$addToSet": bson.M{
+			"reactions." + user.Hex(): emoji,
+		},
+	}
+	var message Message
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := s.messages().FindOneAndUpdate(ctx, bson.M{"_id": id}, update, opts).Decode(&message)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &message, nil
+}
+
+func (s *MongoStore) RemoveReaction(ctx context.Context, id primitive.ObjectID, user primitive.ObjectID, emoji string) (*Message, error) {
+	key := "reactions." + user.Hex()
+	update := bson.M{
+		"$pull": bson.M{
+			key: emoji,
+		},
+	}
+	_, err := s.messages().UpdateOne(ctx, bson.M{"_id": id}, update)
+	if err != nil {
+		return nil, err
+	}
+	// Users without reactions left are dropped from the map
+	filter := bson.M{
+		"_id": id,
+		key: bson.M{
+			"$size": 0,
+		},
+	}
+	_, err = s.messages().UpdateOne(ctx, filter, bson.M{"$unset": bson.M{key: ""}})
+	if err != nil {
+		return nil, err
+	}
+	return s.GetMessage(ctx, id)
+}
+
+func (s *MongoStore) markReceipt(ctx context.Context, field string, recipient primitive.ObjectID, conversation primitive.ObjectID, upTo primitive.ObjectID, at time.Time) (int64, error) {
+	key := "receipts." + recipient.Hex() + "." + field
+	filter := bson.M{
+		"conversationId": conversation,
+		"from": bson.M{
+			"$ne": recipient,
+		},
+		"_id": bson.M{
+			"$lte": upTo,
+		},
+		key: bson.M{
+			"$exists": false,
+		},
+	}
+	setter := bson.M{
+		"$set": bson.M{
+			key: at,
+		},
+	}
+	result, err := s.messages().UpdateMany(ctx, filter, setter)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+func (s *MongoStore) MarkDelivered(ctx context.Context, recipient primitive.ObjectID, conversation primitive.ObjectID, upTo primitive.ObjectID, at time.Time) (int64, error) {
+	return s.markReceipt(ctx, "deliveredAt", recipient, conversation, upTo, at)
+}
+
+func (s *MongoStore) MarkRead(ctx context.Context, recipient primitive.ObjectID, conversation primitive.ObjectID, upTo primitive.ObjectID, at time.Time) (int64, error) {
+	if _, err := s.MarkDelivered(ctx, recipient, conversation, upTo, at); err != nil {
+		return 0, err
+	}
+	return s.markReceipt(ctx, "readAt", recipient, conversation, upTo, at)
+}
+
+func (s *MongoStore) SetReadCursor(ctx context.Context, user primitive.ObjectID, conversation primitive.ObjectID, upTo primitive.ObjectID) error {
+	key := "readCursors." + conversation.Hex()
+	setter := bson.M{
+		"$max": bson.M{
+			key: upTo,
+		},
+	}
+	var cursors struct {
+		ReadCursors map[string]primitive.ObjectID `bson:"readCursors"`
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(bson.M{key: 1})
+	err := s.users().FindOneAndUpdate(ctx, bson.M{"_id": user}, setter, opts).Decode(&cursors)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// The cursor may be further than upTo already
+	unread, err := s.countUnread(ctx, user, conversation, cursors.ReadCursors[conversation.Hex()])
+	if err != nil {
+		return err
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"unreadCount": unread,
+		},
+	}
+	_, err = s.summaries().UpdateOne(ctx, summaryFilter(user, conversation), update)
+	return err
+}
+
+func (s *MongoStore) UnreadCounts(ctx context.Context, user primitive.ObjectID) (map[primitive.ObjectID]int64, error) {
+	count, err := s.users().CountDocuments(ctx, bson.M{"_id": user})
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, ErrNotFound
+	}
+	filter := bson.M{
+		"user": user,
+		"unreadCount": bson.M{
+			"$gt": 0,
+		},
+	}
+	opts := options.Find().SetProjection(bson.M{"conversationId": 1, "unreadCount": 1})
+	cursor, err := s.summaries().Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	var summaries []ConversationSummary
+	if err = cursor.All(ctx, &summaries); err != nil {
+		return nil, err
+	}
+	counts := make(map[primitive.ObjectID]int64)
+	for _, summary := range summaries {
+		counts[summary.ConversationId] = summary.UnreadCount
+	}
+	return counts, nil
+}
+
+func (s *MongoStore) CreateConversation(ctx context.Context, conversation *Conversation) error {
+	_, err := s.conversations().InsertOne(ctx, conversation)
+	if err != nil {
+		return err
+	}
+	return s.createSummaries(ctx, conversation, conversation.Members, conversation.CreatedAt)
+}
+
+func (s *MongoStore) GetConversation(ctx context.Context, id primitive.ObjectID) (*Conversation, error) {
+	var conversation Conversation
+	err := s.conversations().FindOne(ctx, bson.M{"_id": id}).Decode(&conversation)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &conversation, nil
+}
+
+func (s *MongoStore) GetDirectConversation(ctx context.Context, id1 primitive.ObjectID, id2 primitive.ObjectID) (*Conversation, error) {
+	var conversation Conversation
+	filter := bson.M{"directKey": DirectKey(id1, id2)}
+	err := s.conversations().FindOne(ctx, filter).Decode(&conversation)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &conversation, nil
+}
+
+func (s *MongoStore) EnsureDirectConversation(ctx context.Context, id1 primitive.ObjectID, id2 primitive.ObjectID, at time.Time) (*Conversation, error) {
+	filter := bson.M{"directKey": DirectKey(id1, id2)}
+	update := bson.M{
+		"$setOnInsert": bson.M{
+			"_id":       primitive.NewObjectID(),
+			"type":      ConversationDirect,
+			"members":   bson.A{id1, id2},
+			"createdBy": id1,
+			"createdAt": at,
+			"updatedAt": at,
+		},
+	}
+	var conversation Conversation
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	err := s.conversations().FindOneAndUpdate(ctx, filter, update, opts).Decode(&conversation)
+	// Two upserts racing, the unique index lets only one insert
+	if mongo.IsDuplicateKeyError(err) {
+		return s.GetDirectConversation(ctx, id1, id2)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &conversation, nil
+}
+
+func (s *MongoStore) GetConversations(ctx context.Context, member primitive.ObjectID) ([]Conversation, error) {
+	var conversations []Conversation
+	cursor, err := s.conversations().Find(ctx, bson.M{"members": member})
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &conversations); err != nil {
+		return nil, err
+	}
+	return conversations, nil
+}
+
+func (s *MongoStore) updateConversation(ctx context.Context, id primitive.ObjectID, update bson.M, at time.Time) (*Conversation, error) {
+	if update["$set"] == nil {
+		update["$set"] = bson.M{}
+	}
+	update["$set"].(bson.M)["updatedAt"] = at
+	var conversation Conversation
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := s.conversations().FindOneAndUpdate(ctx, bson.M{"_id": id}, update, opts).Decode(&conversation)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	return &conversation, nil
+}
+
+func (s *MongoStore) AddMembers(ctx context.Context, id primitive.ObjectID, members []primitive.ObjectID, at time.Time) (*Conversation, error) {
+	conversation, err := s.updateConversation(ctx, id, bson.M{
+		"$addToSet": bson.M{
+			"members": bson.M{"$each": members},
+		},
+	}, at)
+	if err != nil {
+		return nil, err
+	}
+	return conversation, s.createSummaries(ctx, conversation, members, at)
+}
+
+func (s *MongoStore) RemoveMember(ctx context.Context, id primitive.ObjectID, member primitive.ObjectID, at time.Time) (*Conversation, error) {
+	conversation, err := s.updateConversation(ctx, id, bson.M{
+		"$pull": bson.M{
+			"members": member,
+			"admins":  member,
+		},
+	}, at)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.summaries().DeleteOne(ctx, summaryFilter(member, id))
+	return conversation, err
+}
+
+func (s *MongoStore) RenameConversation(ctx context.Context, id primitive.ObjectID, name string, at time.Time) (*Conversation, error) {
+	conversation, err := s.updateConversation(ctx, id, bson.M{
+		"$set": bson.M{
+			"name": name,
+		},
+	}, at)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.summaries().UpdateMany(ctx, bson.M{"conversationId": id}, bson.M{
+		"$set": bson.M{
+			"name": name,
+		},
+	})
+	return conversation, err
+}
+
+func (s *MongoStore) SetRetention(ctx context.Context, id primitive.ObjectID, retention *RetentionSetting, at time.Time) (*Conversation, error) {
+	update := func() bson.M {
+		if retention == nil {
+			return bson.M{"$unset": bson.M{"retention": ""}}
+		}
+		return bson.M{"$set": bson.M{"retention": retention}}
+	}
+	conversation, err := s.updateConversation(ctx, id, update(), at)
+	if err != nil {
+		return nil, err
+	}
+	_, err = s.summaries().UpdateMany(ctx, bson.M{"conversationId": id}, update())
+	return conversation, err
+}
+
+func (s *MongoStore) SetAdmin(ctx context.Context, id primitive.ObjectID, member primitive.ObjectID, admin bool, at time.Time) (*Conversation, error) {
+	operator := "$pull"
+	if admin {
+		operator = "$addToSet"
+	}
+	return s.updateConversation(ctx, id, bson.M{
+		operator: bson.M{
+			"admins": member,
+		},
+	}, at)
+}
+
+// Increments the user's counter, atomically, so every event gets its own
+// number even with several servers publishing
+func (s *MongoStore) nextEventSeq(ctx context.Context, user primitive.ObjectID) (int64, error) {
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	err := s.eventCounters().FindOneAndUpdate(ctx,
+		bson.M{"_id": user},
+		bson.M{"$inc": bson.M{"seq": 1}},
+		opts,
+	).Decode(&counter)
+	return counter.Seq, err
+}
+
+func (s *MongoStore) AppendEvent(ctx context.Context, event *Event) error {
+	seq, err := s.nextEventSeq(ctx, event.User)
+	if err != nil {
+		return err
+	}
+	event.Seq = seq
+	_, err = s.events().InsertOne(ctx, event)
+	return err
+}
+
+func (s *MongoStore) GetEvents(ctx context.Context, user primitive.ObjectID, after int64, limit int64) ([]Event, error) {
+	// The TTL monitor only runs every minute
+	filter := bson.M{
+		"user": user,
+		"seq": bson.M{
+			"$gt": after,
+		},
+		"expireAt": bson.M{
+			"$gt": time.Now(),
+		},
+	}
+	opts := options.Find().SetLimit(limit).SetSort(bson.M{"seq": 1})
+	var events []Event
+	cursor, err := s.events().Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (s *MongoStore) ShortenConversationEvents(ctx context.Context, conversation primitive.ObjectID, retention time.Duration, now time.Time) (int64, error) {
+	result, err := s.events().DeleteMany(ctx, bson.M{
+		"conversationId": conversation,
+		"timestamp": bson.M{
+			"$lte": now.Add(-retention).UnixMilli(),
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	update := bson.A{
+		bson.M{"$set": bson.M{
+			"expireAt": bson.M{"$min": bson.A{
+				"$expireAt",
+				bson.M{"$toDate": bson.M{"$add": bson.A{"$timestamp", retention.Milliseconds()}}},
+			}},
+		}},
+	}
+	_, err = s.events().UpdateMany(ctx, bson.M{"conversationId": conversation}, update)
+	return result.DeletedCount, err
+}
+
+func (s *MongoStore) EventSeqAt(ctx context.Context, user primitive.ObjectID, id primitive.ObjectID) (int64, error) {
+	var event Event
+	filter := bson.M{
+		"user": user,
+		"_id": bson.M{
+			"$lte": id,
+		},
+	}
+	opts := options.FindOne().SetSort(bson.M{"_id": -1}).SetProjection(bson.M{"seq": 1})
+	err := s.events().FindOne(ctx, filter, opts).Decode(&event)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, nil
+	}
+	return event.Seq, err
+}
+
+func (s *MongoStore) GetUserToken(ctx context.Context, id primitive.ObjectID) (string, error) {
+	var user struct {
+		Token string `bson:"token"`
+	}
+	opts := options.FindOne().SetProjection(bson.M{"token": 1})
+	err := s.users().FindOne(ctx, bson.M{"_id": id}, opts).Decode(&user)
+	if err != nil {
+		return "", notFound(err)
+	}
+	return user.Token, nil
+}
+
+func (s *MongoStore) SetUserToken(ctx context.Context, id primitive.ObjectID, token string) error {
+	return s.SetUserProperty(ctx, id, "token", token)
+}
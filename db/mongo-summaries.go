@@ -0,0 +1,197 @@
+package db_handler
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+func (s *MongoStore) summaries() *mongo.Collection {
+	return s.db.Collection("summaries")
+}
+
+func summaryFilter(user primitive.ObjectID, conversation primitive.ObjectID) bson.M {
+	return bson.M{
+		"user":           user,
+		"conversationId": conversation,
+	}
+}
+
+// Fields of a new summary that never change with messages
+func summaryFields(summary *ConversationSummary) bson.M {
+	fields := bson.M{
+		"type": summary.Type,
+	}
+	if summary.Name != "" {
+		fields["name"] = summary.Name
+	}
+	if summary.With != nil {
+		fields["with"] = *summary.With
+	}
+	if summary.Retention != nil {
+		fields["retention"] = summary.Retention
+	}
+	return fields
+}
+
+// Puts the new message in the summary of every member, creating the ones that
+// don't exist yet. Pipeline updates so an older message arriving late doesn't
+// replace a newer LastMessage.
+func (s *MongoStore) addToSummaries(ctx context.Context, message *Message) error {
+	conversation, err := s.GetConversation(ctx, message.ConversationId)
+	if err != nil {
+		return err
+	}
+	var models []mongo.WriteModel
+	for _, member := range conversation.Members {
+		set := summaryFields(newSummary(member, conversation, message.CreatedAt))
+		set["lastMessage"] = bson.M{"$cond": bson.A{
+			bson.M{"$lte": bson.A{"$lastMessage._id", message.Id}},
+			bson.M{"$literal": snapshotOf(message)},
+			"$lastMessage",
+		}}
+		set["updatedAt"] = bson.M{"$max": bson.A{"$updatedAt", message.CreatedAt}}
+		unread := 0
+		if member != message.From {
+			unread = 1
+		}
+		set["unreadCount"] = bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$unreadCount", 0}}, unread}}
+
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(summaryFilter(member, conversation.Id)).
+			SetUpdate(bson.A{bson.M{"$set": set}}).
+			SetUpsert(true))
+	}
+	opts := options.BulkWrite().SetOrdered(false)
+	_, err = s.summaries().BulkWrite(ctx, models, opts)
+	// Another message created the same summary first, it exists now
+	if mongo.IsDuplicateKeyError(err) {
+		_, err = s.summaries().BulkWrite(ctx, models, opts)
+	}
+	return err
+}
+
+// Summaries showing the message get its new state, or the previous message
+// for users who deleted it for themselves
+func (s *MongoStore) refreshSummaries(ctx context.Context, message *Message) error {
+	hidden := append([]primitive.ObjectID{}, message.HiddenFor...)
+	filter := bson.M{
+		"conversationId":  message.ConversationId,
+		"lastMessage._id": message.Id,
+		"user":            bson.M{"$nin": hidden},
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"lastMessage": snapshotOf(message),
+		},
+	}
+	_, err := s.summaries().UpdateMany(ctx, filter, update)
+	if err != nil || len(hidden) == 0 {
+		return err
+	}
+
+	filter["user"] = bson.M{"$in": hidden}
+	cursor, err := s.summaries().Find(ctx, filter, options.Find().SetProjection(bson.M{"user": 1}))
+	if err != nil {
+		return err
+	}
+	var summaries []ConversationSummary
+	if err = cursor.All(ctx, &summaries); err != nil {
+		return err
+	}
+	for _, summary := range summaries {
+		update := bson.M{
+			"$unset": bson.M{"lastMessage": ""},
+		}
+		last, err := s.GetLastMessage(ctx, summary.User, message.ConversationId)
+		if err == nil {
+			update = bson.M{
+				"$set": bson.M{"lastMessage": snapshotOf(last)},
+			}
+		} else if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		_, err = s.summaries().UpdateOne(ctx, summaryFilter(summary.User, message.ConversationId), update)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Messages from others in the conversation after the cursor, the user can
+// still see
+func (s *MongoStore) countUnread(ctx context.Context, user primitive.ObjectID, conversation primitive.ObjectID, cursor primitive.ObjectID) (int64, error) {
+	filter := bson.M{
+		"conversationId": conversation,
+		"from": bson.M{
+			"$ne": user,
+		},
+		"deleted": bson.M{
+			"$ne": true,
+		},
+		"hiddenFor": bson.M{
+			"$ne": user,
+		},
+	}
+	if !cursor.IsZero() {
+		filter["_id"] = bson.M{"$gt": cursor}
+	}
+	return s.messages().CountDocuments(ctx, filter)
+}
+
+// Summaries for members who don't have one, showing the conversation's
+// current last message
+func (s *MongoStore) createSummaries(ctx context.Context, conversation *Conversation, members []primitive.ObjectID, at time.Time) error {
+	var models []mongo.WriteModel
+	for _, member := range members {
+		fields := summaryFields(newSummary(member, conversation, at))
+		fields["updatedAt"] = at
+		fields["unreadCount"] = 0
+		if conversation.LastMessage != nil {
+			fields["lastMessage"] = conversation.LastMessage
+		}
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(summaryFilter(member, conversation.Id)).
+			SetUpdate(bson.M{"$setOnInsert": fields}).
+			SetUpsert(true))
+	}
+	if len(models) == 0 {
+		return nil
+	}
+	_, err := s.summaries().BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *MongoStore) GetSummaries(ctx context.Context, query SummaryQuery) ([]ConversationSummary, error) {
+	filter := bson.M{
+		"user": query.User,
+	}
+	if query.Before != nil {
+		filter["$or"] = bson.A{
+			bson.M{"updatedAt": bson.M{"$lt": *query.Before}},
+			bson.M{"updatedAt": *query.Before, "conversationId": bson.M{"$lt": query.BeforeConversation}},
+		}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "updatedAt", Value: -1}, {Key: "conversationId", Value: -1}})
+	if query.Limit > 0 {
+		opts.SetLimit(query.Limit)
+	}
+	var summaries []ConversationSummary
+	cursor, err := s.summaries().Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = cursor.All(ctx, &summaries); err != nil {
+		return nil, err
+	}
+	return summaries, nil
+}
@@ -0,0 +1,64 @@
+package db_handler
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r)
+}
+
+// Lowercase words of the text in order, made of letters and digits
+func SearchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !isWordRune(r)
+	})
+}
+
+// Each word of the text once, stored with every message so searches match
+// word prefixes on an index
+func searchTerms(text string) []string {
+	seen := make(map[string]bool)
+	terms := []string{}
+	for _, word := range SearchWords(text) {
+		if !seen[word] {
+			seen[word] = true
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
+
+// Case insensitive pattern for the words one after the other, both for Go and
+// MongoDB regular expressions
+func phrasePattern(phrase []string) string {
+	words := make([]string, len(phrase))
+	for i, word := range phrase {
+		words[i] = regexp.QuoteMeta(word)
+	}
+	return `(^|[^\p{L}\p{N}])` + strings.Join(words, `[^\p{L}\p{N}]+`) + `($|[^\p{L}\p{N}])`
+}
+
+// Whether the text matches every word as a prefix and every phrase, as
+// MongoStore.SearchMessages does
+func matchesSearch(text string, words []string, phrases [][]string) bool {
+	terms := searchTerms(text)
+	for _, word := range words {
+		found := false
+		for _, term := range terms {
+			found = found || strings.HasPrefix(term, word)
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, phrase := range phrases {
+		matched, err := regexp.MatchString("(?i)"+phrasePattern(phrase), text)
+		if err != nil || !matched {
+			return false
+		}
+	}
+	return true
+}
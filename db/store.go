@@ -0,0 +1,448 @@
+package db_handler
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// A unique field, like a user's authId, is taken already
+var ErrExists = errors.New("already exists")
+
+type User struct {
+	Id     primitive.ObjectID `json:"_id" bson:"_id"`
+	AuthId string             `json:"authId" bson:"authId"`
+	Email  string             `json:"email" bson:"email"`
+	Name   string             `json:"name" bson:"name"`
+	// Presence is private, the api decides who gets to see it
+	LastSeen     *time.Time `json:"-" bson:"lastSeen,omitempty"`
+	HidePresence bool       `json:"-" bson:"hidePresence,omitempty"`
+}
+
+type ContactsData struct {
+	Contacts         *[]primitive.ObjectID `json:"contacts" bson:"contacts"`
+	ReceivedRequests *[]primitive.ObjectID `json:"receivedRequests" bson:"receivedRequests"`
+	SentRequests     *[]primitive.ObjectID `json:"sentRequests" bson:"sentRequests"`
+}
+
+type Message struct {
+	Id      primitive.ObjectID `json:"_id" bson:"_id"`
+	Message string             `json:"message" bson:"message"`
+	Title   string             `json:"title,omitempty" bson:"title,omitempty"`
+	From    primitive.ObjectID `json:"from" bson:"from"`
+	To      primitive.ObjectID `json:"to" bson:"to"` // Empty for group messages
+	// Direct or group conversation the message belongs to
+	ConversationId primitive.ObjectID `json:"conversationId" bson:"conversationId"`
+	CreatedAt      time.Time          `json:"createdAt" bson:"createdAt"`
+	// From the conversation's retention when sent, never for "forever"
+	ExpireAt *time.Time `json:"expireAt,omitempty" bson:"expireAt,omitempty"`
+	// Sent in disappearing mode, clients drop their copy at ExpireAt too
+	Disappearing bool `json:"disappearing,omitempty" bson:"disappearing,omitempty"`
+	// Message of the same conversation this one answers
+	ReplyTo *primitive.ObjectID `json:"replyTo,omitempty" bson:"replyTo,omitempty"`
+	// Preview of ReplyTo, filled by the api and never stored
+	Reply *MessagePreview `json:"reply,omitempty" bson:"-"`
+	// Delivery status for each recipient, keyed by the recipient's hex id
+	Receipts map[string]Receipt `json:"receipts,omitempty" bson:"receipts,omitempty"`
+	EditedAt *time.Time         `json:"editedAt,omitempty" bson:"editedAt,omitempty"`
+	// Previous versions of the text, oldest first
+	Edits []MessageEdit `json:"edits,omitempty" bson:"edits,omitempty"`
+	// Deleted for everyone, the text, edit history and reactions are gone
+	Deleted   bool       `json:"deleted,omitempty" bson:"deleted,omitempty"`
+	DeletedAt *time.Time `json:"deletedAt,omitempty" bson:"deletedAt,omitempty"`
+	// Participants that deleted the message only for themselves
+	HiddenFor []primitive.ObjectID `json:"-" bson:"hiddenFor,omitempty"`
+	// Emoji each participant reacted with, keyed by the user's hex id
+	Reactions map[string][]string `json:"reactions,omitempty" bson:"reactions,omitempty"`
+	// Users per emoji, filled by the api from Reactions and never stored
+	ReactionCounts map[string]int `json:"reactionCounts,omitempty" bson:"-"`
+	// Words of the text for searches, set by MongoStore
+	Terms []string `json:"-" bson:"terms"`
+	// Files sent with the message, gone when it's deleted for everyone
+	Attachments []AttachmentRef `json:"attachments,omitempty" bson:"attachments,omitempty"`
+}
+
+// File uploaded to a conversation, its content is kept in the blob store
+// under Key. MessageId is set once a message claims it, an attachment belongs
+// to a single message.
+type Attachment struct {
+	Id             primitive.ObjectID  `json:"_id" bson:"_id"`
+	ConversationId primitive.ObjectID  `json:"conversationId" bson:"conversationId"`
+	UploadedBy     primitive.ObjectID  `json:"uploadedBy" bson:"uploadedBy"`
+	MessageId      *primitive.ObjectID `json:"messageId,omitempty" bson:"messageId,omitempty"`
+	Name           string              `json:"name,omitempty" bson:"name,omitempty"`
+	MimeType       string              `json:"mimeType" bson:"mimeType"`
+	Size           int64               `json:"size" bson:"size"`
+	Checksum       string              `json:"checksum" bson:"checksum"` // SHA-256, hex
+	Key            string              `json:"-" bson:"key"`
+	CreatedAt      time.Time           `json:"createdAt" bson:"createdAt"`
+	Image          *ImageInfo          `json:"image,omitempty" bson:"image,omitempty"`
+	// Same as the message's once claimed
+	ExpireAt *time.Time `json:"-" bson:"expireAt,omitempty"`
+}
+
+// Made on upload for the image types the server can decode. Width and Height
+// are as displayed, after the EXIF orientation.
+type ImageInfo struct {
+	Width    int    `json:"width" bson:"width"`
+	Height   int    `json:"height" bson:"height"`
+	Blurhash string `json:"blurhash,omitempty" bson:"blurhash,omitempty"`
+	// Smaller copies, always a "thumbnail" and a "preview" for large images
+	Variants []AttachmentVariant `json:"variants,omitempty" bson:"variants,omitempty"`
+}
+
+// Stored next to the attachment's blob, fetched with its name
+type AttachmentVariant struct {
+	Name     string `json:"name" bson:"name"`
+	MimeType string `json:"mimeType" bson:"mimeType"`
+	Width    int    `json:"width" bson:"width"`
+	Height   int    `json:"height" bson:"height"`
+	Size     int64  `json:"size" bson:"size"`
+}
+
+// What a message keeps of each of its attachments
+type AttachmentRef struct {
+	Id       primitive.ObjectID `json:"_id" bson:"_id"`
+	Name     string             `json:"name,omitempty" bson:"name,omitempty"`
+	MimeType string             `json:"mimeType" bson:"mimeType"`
+	Size     int64              `json:"size" bson:"size"`
+	Checksum string             `json:"checksum" bson:"checksum"`
+	Image    *ImageInfo         `json:"image,omitempty" bson:"image,omitempty"`
+}
+
+func (attachment *Attachment) Ref() AttachmentRef {
+	return AttachmentRef{
+		Id:       attachment.Id,
+		Name:     attachment.Name,
+		MimeType: attachment.MimeType,
+		Size:     attachment.Size,
+		Checksum: attachment.Checksum,
+		Image:    attachment.Image,
+	}
+}
+
+const (
+	ConversationDirect = "direct"
+	ConversationGroup  = "group"
+)
+
+// Every message belongs to a conversation, either direct between two users or
+// a group chat. Only groups have a name and admins, admins are members too and
+// leaving or being removed drops both. UpdatedAt moves with every change and
+// every new message.
+type Conversation struct {
+	Id        primitive.ObjectID   `json:"_id" bson:"_id"`
+	Type      string               `json:"type" bson:"type"`
+	Name      string               `json:"name,omitempty" bson:"name,omitempty"`
+	Members   []primitive.ObjectID `json:"members" bson:"members"`
+	Admins    []primitive.ObjectID `json:"admins,omitempty" bson:"admins,omitempty"`
+	CreatedBy primitive.ObjectID   `json:"createdBy" bson:"createdBy"`
+	CreatedAt time.Time            `json:"createdAt" bson:"createdAt"`
+	UpdatedAt time.Time            `json:"updatedAt" bson:"updatedAt"`
+	// Unique for each pair of users, only set on direct conversations
+	DirectKey string `json:"-" bson:"directKey,omitempty"`
+	// Newest message, without its receipts, edits and reactions
+	LastMessage *Message `json:"lastMessage,omitempty" bson:"lastMessage,omitempty"`
+	// Set by a member, the server default applies otherwise
+	Retention *RetentionSetting `json:"-" bson:"retention,omitempty"`
+}
+
+// How long the messages of a conversation are kept, as set by one of its
+// members. Policy is one of the api's retention policies, Disappearing asks
+// clients to remove their copies when messages expire.
+type RetentionSetting struct {
+	Policy       string             `json:"policy" bson:"policy"`
+	Disappearing bool               `json:"disappearing,omitempty" bson:"disappearing,omitempty"`
+	SetBy        primitive.ObjectID `json:"setBy" bson:"setBy"`
+	SetAt        time.Time          `json:"setAt" bson:"setAt"`
+}
+
+// Same key whatever the order of the users
+func DirectKey(id1 primitive.ObjectID, id2 primitive.ObjectID) string {
+	if id1.Hex() > id2.Hex() {
+		id1, id2 = id2, id1
+	}
+	return id1.Hex() + ":" + id2.Hex()
+}
+
+// Copy of the message kept as a conversation's LastMessage
+func snapshotOf(message *Message) *Message {
+	snapshot := *message
+	snapshot.Receipts = nil
+	snapshot.Edits = nil
+	snapshot.Reactions = nil
+	snapshot.ReactionCounts = nil
+	snapshot.Reply = nil
+	snapshot.Terms = nil
+	return &snapshot
+}
+
+// A member's entry in their conversation list, kept up to date by every write
+// that affects it so listing conversations is a single query. UpdatedAt is the
+// last activity: the newest message, or when the user joined.
+type ConversationSummary struct {
+	User           primitive.ObjectID  `json:"-" bson:"user"`
+	ConversationId primitive.ObjectID  `json:"conversationId" bson:"conversationId"`
+	Type           string              `json:"type" bson:"type"`
+	Name           string              `json:"name,omitempty" bson:"name,omitempty"` // Groups only
+	With           *primitive.ObjectID `json:"with,omitempty" bson:"with,omitempty"` // The other user of direct conversations
+	// Newest message the user didn't delete for themselves, same as the
+	// conversation's LastMessage otherwise
+	LastMessage *Message  `json:"lastMessage,omitempty" bson:"lastMessage,omitempty"`
+	UnreadCount int64     `json:"unreadCount" bson:"unreadCount"`
+	UpdatedAt   time.Time `json:"updatedAt" bson:"updatedAt"`
+	// Same as the conversation's
+	Retention *RetentionSetting `json:"-" bson:"retention,omitempty"`
+}
+
+// Summary of the conversation for the given member, with nothing in it yet
+func newSummary(user primitive.ObjectID, conversation *Conversation, at time.Time) *ConversationSummary {
+	summary := &ConversationSummary{
+		User:           user,
+		ConversationId: conversation.Id,
+		Type:           conversation.Type,
+		Name:           conversation.Name,
+		UpdatedAt:      at,
+		Retention:      conversation.Retention,
+	}
+	if conversation.Type == ConversationDirect {
+		for _, member := range conversation.Members {
+			if member != user {
+				with := member
+				summary.With = &with
+			}
+		}
+	}
+	return summary
+}
+
+type MessagePreview struct {
+	Id      primitive.ObjectID `json:"_id"`
+	From    primitive.ObjectID `json:"from"`
+	Snippet string             `json:"snippet"`
+	Deleted bool               `json:"deleted,omitempty"`
+}
+
+type MessageEdit struct {
+	Message    string    `json:"message" bson:"message"`
+	ReplacedAt time.Time `json:"replacedAt" bson:"replacedAt"`
+}
+
+type Receipt struct {
+	DeliveredAt *time.Time `json:"deliveredAt,omitempty" bson:"deliveredAt,omitempty"`
+	ReadAt      *time.Time `json:"readAt,omitempty" bson:"readAt,omitempty"`
+}
+
+// Entry of a user's event log, replayed to clients that were offline. Seq
+// numbers the events of each user in the order they were stored, so
+// "everything after seq" is a simple range even when concurrent writers
+// created their ids in another order.
+type Event struct {
+	Id        primitive.ObjectID `bson:"_id"`
+	User      primitive.ObjectID `bson:"user"`
+	Seq       int64              `bson:"seq"` // Set by AppendEvent
+	Type      string             `bson:"type"`
+	Timestamp int64              `bson:"timestamp"`
+	Payload   []byte             `bson:"payload"` // JSON
+	ExpireAt  time.Time          `bson:"expireAt"`
+	// Message the event is about and its conversation, if any
+	ConversationId primitive.ObjectID `bson:"conversationId,omitempty"`
+	MessageId      primitive.ObjectID `bson:"messageId,omitempty"`
+}
+
+// Page of messages of a conversation, newest first. Before and After keep
+// only messages older or newer than the given id, the page is then made of
+// the Limit messages closest to it. Messages Me deleted for themselves are
+// left out.
+type MessageQuery struct {
+	Me           primitive.ObjectID
+	Conversation primitive.ObjectID
+	Before       *primitive.ObjectID
+	After        *primitive.ObjectID
+	Limit        int64
+}
+
+// Page of a user's conversation summaries, most recently active first. When
+// Before is set only conversations last active before it are returned,
+// BeforeConversation breaks ties between conversations active at that same
+// time. A zero Limit returns them all.
+type SummaryQuery struct {
+	User               primitive.ObjectID
+	Before             *time.Time
+	BeforeConversation primitive.ObjectID
+	Limit              int64
+}
+
+// Messages of the given conversations containing every word, as the start of
+// one of their words, and every phrase, as consecutive words. Words and
+// phrases come from SearchWords. Newest first, Before continues from a
+// previous page, Since and Until bound the creation date. Messages deleted
+// for everyone or by Me for themselves are left out.
+type SearchQuery struct {
+	Me            primitive.ObjectID
+	Conversations []primitive.ObjectID
+	Words         []string
+	Phrases       [][]string
+	Since         *time.Time
+	Until         *time.Time
+	Before        *primitive.ObjectID
+	Limit         int64
+}
+
+type UserStore interface {
+	// ErrExists when another user has the same id or authId
+	CreateUser(ctx context.Context, user *User) error
+	GetUser(ctx context.Context, id primitive.ObjectID) (*User, error)
+	GetUserByAuthId(ctx context.Context, authId string) (*User, error)
+	GetUsers(ctx context.Context, ids []primitive.ObjectID) ([]User, error)
+	SearchUsers(ctx context.Context, term string) ([]User, error)
+	SetUserProperty(ctx context.Context, id primitive.ObjectID, prop string, value string) error
+	SetLastSeen(ctx context.Context, id primitive.ObjectID, at time.Time) error
+	SetHidePresence(ctx context.Context, id primitive.ObjectID, hide bool) error
+}
+
+type ContactStore interface {
+	GetContactsData(ctx context.Context, id primitive.ObjectID) (*ContactsData, error)
+	// Returns the sender's sent requests after the new one is added
+	SendFriendRequest(ctx context.Context, from primitive.ObjectID, to primitive.ObjectID) ([]primitive.ObjectID, error)
+	AcceptFriendRequest(ctx context.Context, from primitive.ObjectID, to primitive.ObjectID) error
+}
+
+type MessageStore interface {
+	// Also makes the message its conversation's LastMessage and updates the
+	// summaries of every member
+	SaveMessage(ctx context.Context, message *Message) error
+	GetMessage(ctx context.Context, id primitive.ObjectID) (*Message, error)
+	// Messages with the given ids, in no particular order, missing ones are skipped
+	GetMessagesByIds(ctx context.Context, ids []primitive.ObjectID) ([]Message, error)
+	GetMessages(ctx context.Context, query MessageQuery) ([]Message, error)
+	SearchMessages(ctx context.Context, query SearchQuery) ([]Message, error)
+	// Last message of the conversation that me didn't delete for themselves.
+	// Returns ErrNotFound when there is none.
+	GetLastMessage(ctx context.Context, me primitive.ObjectID, conversation primitive.ObjectID) (*Message, error)
+	// Edits, deletions and hiding below keep the conversation's LastMessage
+	// and the summaries up to date.
+	// Replaces the text keeping the previous one in Edits. Returns the updated
+	// message, ErrNotFound when it doesn't exist or was deleted.
+	EditMessage(ctx context.Context, id primitive.ObjectID, text string, at time.Time) (*Message, error)
+	// Deletes the message for everyone, returns the updated message. Its
+	// attachment references and the events about it go too, their metadata
+	// and blobs are left to the caller.
+	DeleteMessage(ctx context.Context, id primitive.ObjectID, at time.Time) (*Message, error)
+	// Deletes the message only for the given user
+	HideMessage(ctx context.Context, id primitive.ObjectID, user primitive.ObjectID) error
+	// Add or remove one of the user's reactions, both return the updated message
+	AddReaction(ctx context.Context, id primitive.ObjectID, user primitive.ObjectID, emoji string) (*Message, error)
+	RemoveReaction(ctx context.Context, id primitive.ObjectID, user primitive.ObjectID, emoji string) (*Message, error)
+	// Set the recipient's delivered or read time on every message of the
+	// conversation from someone else, up to and including upTo, that doesn't
+	// have it yet. Reading implies delivery. Both return how many messages
+	// changed.
+	MarkDelivered(ctx context.Context, recipient primitive.ObjectID, conversation primitive.ObjectID, upTo primitive.ObjectID, at time.Time) (int64, error)
+	MarkRead(ctx context.Context, recipient primitive.ObjectID, conversation primitive.ObjectID, upTo primitive.ObjectID, at time.Time) (int64, error)
+	// Moves the user's read cursor in the conversation forward to upTo, never
+	// backwards, and recounts the unread messages of their summary
+	SetReadCursor(ctx context.Context, user primitive.ObjectID, conversation primitive.ObjectID, upTo primitive.ObjectID) error
+	// Messages from others after the user's read cursor, counted by
+	// conversation from the summaries. Conversations without unread messages
+	// are left out.
+	UnreadCounts(ctx context.Context, user primitive.ObjectID) (map[primitive.ObjectID]int64, error)
+}
+
+type ConversationStore interface {
+	// Also creates the summaries of its members
+	CreateConversation(ctx context.Context, conversation *Conversation) error
+	GetConversation(ctx context.Context, id primitive.ObjectID) (*Conversation, error)
+	// Direct conversation between the users, ErrNotFound if they never talked
+	GetDirectConversation(ctx context.Context, id1 primitive.ObjectID, id2 primitive.ObjectID) (*Conversation, error)
+	// Same, creating it when needed
+	EnsureDirectConversation(ctx context.Context, id1 primitive.ObjectID, id2 primitive.ObjectID, at time.Time) (*Conversation, error)
+	// Direct and group conversations the user is a member of
+	GetConversations(ctx context.Context, member primitive.ObjectID) ([]Conversation, error)
+	// The changes below return the updated group, ErrNotFound if it doesn't
+	// exist. Members added or removed gain or lose their summary.
+	AddMembers(ctx context.Context, id primitive.ObjectID, members []primitive.ObjectID, at time.Time) (*Conversation, error)
+	RemoveMember(ctx context.Context, id primitive.ObjectID, member primitive.ObjectID, at time.Time) (*Conversation, error)
+	RenameConversation(ctx context.Context, id primitive.ObjectID, name string, at time.Time) (*Conversation, error)
+	SetAdmin(ctx context.Context, id primitive.ObjectID, member primitive.ObjectID, admin bool, at time.Time) (*Conversation, error)
+	// Direct conversations too, nil goes back to the server default. The
+	// summaries follow.
+	SetRetention(ctx context.Context, id primitive.ObjectID, retention *RetentionSetting, at time.Time) (*Conversation, error)
+	GetSummaries(ctx context.Context, query SummaryQuery) ([]ConversationSummary, error)
+}
+
+type AttachmentStore interface {
+	SaveAttachment(ctx context.Context, attachment *Attachment) error
+	GetAttachment(ctx context.Context, id primitive.ObjectID) (*Attachment, error)
+	// Gives the attachments to the message, all or none: each one must have
+	// been uploaded by its sender to its conversation and not be claimed yet.
+	// They expire with it. Returns them in the order of ids, ErrNotFound when
+	// any can't be claimed.
+	ClaimAttachments(ctx context.Context, ids []primitive.ObjectID, message *Message) ([]Attachment, error)
+	// Undoes ClaimAttachments, for messages that couldn't be saved
+	ReleaseAttachments(ctx context.Context, message primitive.ObjectID) error
+	// Removes and returns the metadata of the message's attachments
+	DeleteMessageAttachments(ctx context.Context, message primitive.ObjectID) ([]Attachment, error)
+	// Removes and returns the metadata of attachments expired by now, and of
+	// uploads created before unclaimedBefore that no message claimed, at most
+	// limit of them
+	DeleteExpiredAttachments(ctx context.Context, now time.Time, unclaimedBefore time.Time, limit int) ([]Attachment, error)
+}
+
+// Stores the api sweeps of their expired messages periodically. MongoStore's
+// TTL index only removes what the sweeps missed, a while later.
+type MessageSweeper interface {
+	// Removes messages expired by now, keeping the conversations' LastMessage
+	// and the summaries up to date. Returns how many were removed.
+	DeleteExpiredMessages(ctx context.Context, now time.Time) (int64, error)
+}
+
+type EventStore interface {
+	// Stores the event with the sequence number following the user's last one
+	AppendEvent(ctx context.Context, event *Event) error
+	// Events of the user after the given sequence number, oldest first
+	GetEvents(ctx context.Context, user primitive.ObjectID, after int64, limit int64) ([]Event, error)
+	// Sequence number of the user's newest event with an id up to the given
+	// one, 0 when there is none. For clients that resume from an event id.
+	EventSeqAt(ctx context.Context, user primitive.ObjectID, id primitive.ObjectID) (int64, error)
+	// Applies a shorter retention to the events about the conversation's
+	// messages: those older than it by now are removed, the others expire at
+	// the end of it. Returns how many were removed.
+	ShortenConversationEvents(ctx context.Context, conversation primitive.ObjectID, retention time.Duration, now time.Time) (int64, error)
+}
+
+type TokenStore interface {
+	// Push notification token, empty when the user never registered a device
+	GetUserToken(ctx context.Context, id primitive.ObjectID) (string, error)
+	SetUserToken(ctx context.Context, id primitive.ObjectID, token string) error
+}
+
+type Store interface {
+	UserStore
+	ContactStore
+	MessageStore
+	ConversationStore
+	AttachmentStore
+	EventStore
+	TokenStore
+}
+
+var store Store
+
+// Storage used by the rest of the app, set by MongoConnection or UseMemoryStore
+func Storage() Store {
+	return store
+}
+
+func SetStorage(s Store) {
+	store = s
+}
+
+// In-memory storage for tests and local development, nothing is persisted
+func UseMemoryStore() {
+	store = NewMemoryStore()
+}
@@ -0,0 +1,835 @@
+package db_handler
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Both stores must pass the same contract. The MongoDB one only runs when
+// MONGO_TEST_URI points to a server, each test gets a database of its own
+// that is dropped afterwards.
+func TestMemoryStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		return NewMemoryStore()
+	})
+}
+
+func TestMongoStore(t *testing.T) {
+	uri := os.Getenv("MONGO_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGO_TEST_URI not set")
+	}
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Disconnect(ctx) })
+
+	testStore(t, func(t *testing.T) Store {
+		database := client.Database("simple-chat-test-" + primitive.NewObjectID().Hex())
+		t.Cleanup(func() { database.Drop(ctx) })
+		if err := EnsureIndexes(ctx, database); err != nil {
+			t.Fatal(err)
+		}
+		return NewMongoStore(database)
+	})
+}
+
+func testStore(t *testing.T, open func(t *testing.T) Store) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, s Store)
+	}{
+		{"Users", testUsers},
+		{"FriendRequests", testFriendRequests},
+		{"Messages", testMessages},
+		{"EditDeleteHide", testEditDeleteHide},
+		{"Reactions", testReactions},
+		{"Receipts", testReceipts},
+		{"Groups", testGroups},
+		{"Attachments", testAttachments},
+		{"Events", testEvents},
+		{"Expiry", testExpiry},
+		{"Search", testSearch},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.run(t, open(t))
+		})
+	}
+}
+
+// MongoDB keeps milliseconds only
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
+
+func newUser(t *testing.T, s Store, name string) *User {
+	t.Helper()
+	user := &User{
+		Id:     primitive.NewObjectID(),
+		AuthId: "auth-" + primitive.NewObjectID().Hex(),
+		Email:  name + "@example.com",
+		Name:   name,
+	}
+	if err := s.CreateUser(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func saveMessage(t *testing.T, s Store, from primitive.ObjectID, conversation primitive.ObjectID, text string) *Message {
+	t.Helper()
+	message := &Message{
+		Id:             primitive.NewObjectID(),
+		Message:        text,
+		From:           from,
+		ConversationId: conversation,
+		CreatedAt:      now(),
+	}
+	if err := s.SaveMessage(context.Background(), message); err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+func summaryOf(t *testing.T, s Store, user primitive.ObjectID, conversation primitive.ObjectID) *ConversationSummary {
+	t.Helper()
+	summaries, err := s.GetSummaries(context.Background(), SummaryQuery{User: user})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range summaries {
+		if summaries[i].ConversationId == conversation {
+			return &summaries[i]
+		}
+	}
+	return nil
+}
+
+func messageIds(messages []Message) []primitive.ObjectID {
+	ids := make([]primitive.ObjectID, len(messages))
+	for i, message := range messages {
+		ids[i] = message.Id
+	}
+	return ids
+}
+
+func sameIds(got []primitive.ObjectID, want ...primitive.ObjectID) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func testUsers(t *testing.T, s Store) {
+	ctx := context.Background()
+	alice := newUser(t, s, "alice")
+	bob := newUser(t, s, "bob")
+
+	user, err := s.GetUser(ctx, alice.Id)
+	if err != nil || user.Name != "alice" || user.AuthId != alice.AuthId {
+		t.Fatalf("GetUser = %+v, %v", user, err)
+	}
+	user, err = s.GetUserByAuthId(ctx, bob.AuthId)
+	if err != nil || user.Id != bob.Id {
+		t.Fatalf("GetUserByAuthId = %+v, %v", user, err)
+	}
+	if _, err = s.GetUser(ctx, primitive.NewObjectID()); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetUser of a missing user = %v, want ErrNotFound", err)
+	}
+	if _, err = s.GetUserByAuthId(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetUserByAuthId of a missing user = %v, want ErrNotFound", err)
+	}
+
+	// Racing first sign-ins, only one user per authId gets created
+	var wg sync.WaitGroup
+	created := make(chan error, 8)
+	for i := 0; i < cap(created); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			created <- s.CreateUser(ctx, &User{Id: primitive.NewObjectID(), AuthId: "racing"})
+		}()
+	}
+	wg.Wait()
+	close(created)
+	succeeded := 0
+	for err := range created {
+		if err == nil {
+			succeeded++
+		} else if !errors.Is(err, ErrExists) {
+			t.Fatalf("CreateUser with a taken authId = %v, want ErrExists", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Fatalf("%d users created for the same authId", succeeded)
+	}
+
+	users, err := s.GetUsers(ctx, []primitive.ObjectID{alice.Id, bob.Id, primitive.NewObjectID()})
+	if err != nil || len(users) != 2 {
+		t.Fatalf("GetUsers = %d users, %v", len(users), err)
+	}
+	users, err = s.SearchUsers(ctx, "alice")
+	if err != nil || len(users) != 1 || users[0].Id != alice.Id {
+		t.Fatalf("SearchUsers = %+v, %v", users, err)
+	}
+
+	if err = s.SetUserProperty(ctx, alice.Id, "name", "Alice"); err != nil {
+		t.Fatal(err)
+	}
+	seen := now()
+	if err = s.SetLastSeen(ctx, alice.Id, seen); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SetHidePresence(ctx, alice.Id, true); err != nil {
+		t.Fatal(err)
+	}
+	user, err = s.GetUser(ctx, alice.Id)
+	if err != nil || user.Name != "Alice" || user.LastSeen == nil || !user.LastSeen.Equal(seen) || !user.HidePresence {
+		t.Fatalf("GetUser after updates = %+v, %v", user, err)
+	}
+
+	if token, err := s.GetUserToken(ctx, alice.Id); err != nil || token != "" {
+		t.Fatalf("GetUserToken = %q, %v", token, err)
+	}
+	if err = s.SetUserToken(ctx, alice.Id, "device"); err != nil {
+		t.Fatal(err)
+	}
+	if token, err := s.GetUserToken(ctx, alice.Id); err != nil || token != "device" {
+		t.Fatalf("GetUserToken = %q, %v", token, err)
+	}
+}
+
+func testFriendRequests(t *testing.T, s Store) {
+	ctx := context.Background()
+	alice := newUser(t, s, "alice")
+	bob := newUser(t, s, "bob")
+
+	sent, err := s.SendFriendRequest(ctx, alice.Id, bob.Id)
+	if err != nil || !sameIds(sent, bob.Id) {
+		t.Fatalf("SendFriendRequest = %v, %v", sent, err)
+	}
+	// Sending again changes nothing
+	if sent, err = s.SendFriendRequest(ctx, alice.Id, bob.Id); err != nil || !sameIds(sent, bob.Id) {
+		t.Fatalf("SendFriendRequest again = %v, %v", sent, err)
+	}
+	data, err := s.GetContactsData(ctx, bob.Id)
+	if err != nil || data.ReceivedRequests == nil || !sameIds(*data.ReceivedRequests, alice.Id) {
+		t.Fatalf("receiver's contacts data = %+v, %v", data, err)
+	}
+
+	if err = s.AcceptFriendRequest(ctx, alice.Id, bob.Id); err != nil {
+		t.Fatal(err)
+	}
+	for _, pair := range [][2]*User{{alice, bob}, {bob, alice}} {
+		data, err := s.GetContactsData(ctx, pair[0].Id)
+		if err != nil || data.Contacts == nil || !sameIds(*data.Contacts, pair[1].Id) {
+			t.Fatalf("contacts of %s = %+v, %v", pair[0].Name, data, err)
+		}
+		if (data.SentRequests != nil && len(*data.SentRequests) > 0) || (data.ReceivedRequests != nil && len(*data.ReceivedRequests) > 0) {
+			t.Fatalf("requests of %s left after accepting: %+v", pair[0].Name, data)
+		}
+	}
+	if _, err = s.GetContactsData(ctx, primitive.NewObjectID()); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetContactsData of a missing user = %v, want ErrNotFound", err)
+	}
+}
+
+func testMessages(t *testing.T, s Store) {
+	ctx := context.Background()
+	alice := newUser(t, s, "alice")
+	bob := newUser(t, s, "bob")
+
+	conversation, err := s.EnsureDirectConversation(ctx, alice.Id, bob.Id, now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Same conversation whatever the order of the users
+	again, err := s.EnsureDirectConversation(ctx, bob.Id, alice.Id, now())
+	if err != nil || again.Id != conversation.Id || again.Type != ConversationDirect {
+		t.Fatalf("EnsureDirectConversation again = %+v, %v", again, err)
+	}
+	if found, err := s.GetDirectConversation(ctx, bob.Id, alice.Id); err != nil || found.Id != conversation.Id {
+		t.Fatalf("GetDirectConversation = %+v, %v", found, err)
+	}
+	if _, err = s.GetDirectConversation(ctx, alice.Id, primitive.NewObjectID()); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetDirectConversation of strangers = %v, want ErrNotFound", err)
+	}
+
+	first := saveMessage(t, s, alice.Id, conversation.Id, "one")
+	second := saveMessage(t, s, alice.Id, conversation.Id, "two")
+	third := saveMessage(t, s, alice.Id, conversation.Id, "three")
+
+	message, err := s.GetMessage(ctx, second.Id)
+	if err != nil || message.Message != "two" || message.ConversationId != conversation.Id {
+		t.Fatalf("GetMessage = %+v, %v", message, err)
+	}
+	if _, err = s.GetMessage(ctx, primitive.NewObjectID()); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetMessage of a missing message = %v, want ErrNotFound", err)
+	}
+	messages, err := s.GetMessagesByIds(ctx, []primitive.ObjectID{first.Id, third.Id, primitive.NewObjectID()})
+	if err != nil || len(messages) != 2 {
+		t.Fatalf("GetMessagesByIds = %d messages, %v", len(messages), err)
+	}
+
+	pages := []struct {
+		name  string
+		query MessageQuery
+		want  []primitive.ObjectID
+	}{
+		{"newest", MessageQuery{Limit: 2}, []primitive.ObjectID{third.Id, second.Id}},
+		{"before", MessageQuery{Before: &third.Id, Limit: 5}, []primitive.ObjectID{second.Id, first.Id}},
+		{"after", MessageQuery{After: &first.Id, Limit: 1}, []primitive.ObjectID{second.Id}},
+		{"between", MessageQuery{After: &first.Id, Before: &third.Id, Limit: 5}, []primitive.ObjectID{second.Id}},
+	}
+	for _, page := range pages {
+		page.query.Me = bob.Id
+		page.query.Conversation = conversation.Id
+		messages, err := s.GetMessages(ctx, page.query)
+		if err != nil || !sameIds(messageIds(messages), page.want...) {
+			t.Fatalf("GetMessages %s = %v, %v, want %v", page.name, messageIds(messages), err, page.want)
+		}
+	}
+
+	last, err := s.GetLastMessage(ctx, bob.Id, conversation.Id)
+	if err != nil || last.Id != third.Id {
+		t.Fatalf("GetLastMessage = %+v, %v", last, err)
+	}
+	stored, err := s.GetConversation(ctx, conversation.Id)
+	if err != nil || stored.LastMessage == nil || stored.LastMessage.Id != third.Id {
+		t.Fatalf("conversation's LastMessage = %+v, %v", stored, err)
+	}
+
+	summary := summaryOf(t, s, bob.Id, conversation.Id)
+	if summary == nil || summary.LastMessage == nil || summary.LastMessage.Id != third.Id || summary.UnreadCount != 3 {
+		t.Fatalf("recipient's summary = %+v", summary)
+	}
+	if summary.With == nil || *summary.With != alice.Id || summary.Type != ConversationDirect {
+		t.Fatalf("recipient's summary = %+v, want one with alice", summary)
+	}
+	if summary := summaryOf(t, s, alice.Id, conversation.Id); summary == nil || summary.UnreadCount != 0 {
+		t.Fatalf("sender's summary = %+v", summary)
+	}
+
+	if err = s.SetReadCursor(ctx, bob.Id, conversation.Id, second.Id); err != nil {
+		t.Fatal(err)
+	}
+	// Cursors never move backwards
+	if err = s.SetReadCursor(ctx, bob.Id, conversation.Id, first.Id); err != nil {
+		t.Fatal(err)
+	}
+	counts, err := s.UnreadCounts(ctx, bob.Id)
+	if err != nil || len(counts) != 1 || counts[conversation.Id] != 1 {
+		t.Fatalf("UnreadCounts = %v, %v", counts, err)
+	}
+	if _, err = s.UnreadCounts(ctx, primitive.NewObjectID()); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("UnreadCounts of a missing user = %v, want ErrNotFound", err)
+	}
+}
+
+func testEditDeleteHide(t *testing.T, s Store) {
+	ctx := context.Background()
+	alice := newUser(t, s, "alice")
+	bob := newUser(t, s, "bob")
+	conversation, err := s.EnsureDirectConversation(ctx, alice.Id, bob.Id, now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := saveMessage(t, s, alice.Id, conversation.Id, "first")
+	second := saveMessage(t, s, alice.Id, conversation.Id, "second")
+
+	edited, err := s.EditMessage(ctx, second.Id, "second, edited", now())
+	if err != nil || edited.Message != "second, edited" || edited.EditedAt == nil {
+		t.Fatalf("EditMessage = %+v, %v", edited, err)
+	}
+	if len(edited.Edits) != 1 || edited.Edits[0].Message != "second" {
+		t.Fatalf("edit history = %+v", edited.Edits)
+	}
+	if summary := summaryOf(t, s, bob.Id, conversation.Id); summary.LastMessage == nil || summary.LastMessage.Message != "second, edited" {
+		t.Fatalf("summary after the edit = %+v", summary.LastMessage)
+	}
+	if _, err = s.EditMessage(ctx, primitive.NewObjectID(), "text", now()); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("EditMessage of a missing message = %v, want ErrNotFound", err)
+	}
+	// Text that looks like an expression is stored as written
+	edited, err = s.EditMessage(ctx, first.Id, "$message", now())
+	if err != nil || edited.Message != "$message" || len(edited.Edits) != 1 || edited.Edits[0].Message != "first" {
+		t.Fatalf("EditMessage to $message = %+v, %v", edited, err)
+	}
+
+	// Deleted only for bob, who sees the previous message last
+	if err = s.HideMessage(ctx, second.Id, bob.Id); err != nil {
+		t.Fatal(err)
+	}
+	messages, err := s.GetMessages(ctx, MessageQuery{Me: bob.Id, Conversation: conversation.Id, Limit: 10})
+	if err != nil || !sameIds(messageIds(messages), first.Id) {
+		t.Fatalf("GetMessages after hiding = %v, %v", messageIds(messages), err)
+	}
+	if summary := summaryOf(t, s, bob.Id, conversation.Id); summary.LastMessage == nil || summary.LastMessage.Id != first.Id {
+		t.Fatalf("hider's summary = %+v", summary.LastMessage)
+	}
+	if summary := summaryOf(t, s, alice.Id, conversation.Id); summary.LastMessage == nil || summary.LastMessage.Id != second.Id {
+		t.Fatalf("other member's summary = %+v", summary.LastMessage)
+	}
+	if summary := summaryOf(t, s, bob.Id, conversation.Id); summary.UnreadCount != 1 {
+		t.Fatalf("hider's unread count = %d, want 1", summary.UnreadCount)
+	}
+
+	event := &Event{Id: primitive.NewObjectID(), User: bob.Id, Type: "message", ExpireAt: now().Add(time.Hour), ConversationId: conversation.Id, MessageId: first.Id}
+	if err = s.AppendEvent(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := s.DeleteMessage(ctx, first.Id, now())
+	if err != nil || !deleted.Deleted || deleted.DeletedAt == nil || deleted.Message != "" {
+		t.Fatalf("DeleteMessage = %+v, %v", deleted, err)
+	}
+	if summary := summaryOf(t, s, bob.Id, conversation.Id); summary.LastMessage == nil || !summary.LastMessage.Deleted || summary.UnreadCount != 0 {
+		t.Fatalf("summary after deleting = %+v, %d unread", summary.LastMessage, summary.UnreadCount)
+	}
+	// Counted again from the cursor, still without the deleted and hidden ones
+	if err = s.SetReadCursor(ctx, bob.Id, conversation.Id, primitive.NilObjectID); err != nil {
+		t.Fatal(err)
+	}
+	if summary := summaryOf(t, s, bob.Id, conversation.Id); summary.UnreadCount != 0 {
+		t.Fatalf("unread count from the start = %d, want 0", summary.UnreadCount)
+	}
+	if events, err := s.GetEvents(ctx, bob.Id, 0, 0); err != nil || len(events) != 0 {
+		t.Fatalf("events about the deleted message = %d, %v", len(events), err)
+	}
+	if _, err = s.EditMessage(ctx, first.Id, "again", now()); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("EditMessage of a deleted message = %v, want ErrNotFound", err)
+	}
+}
+
+func testReactions(t *testing.T, s Store) {
+	ctx := context.Background()
+	alice := newUser(t, s, "alice")
+	bob := newUser(t, s, "bob")
+	conversation, err := s.EnsureDirectConversation(ctx, alice.Id, bob.Id, now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := saveMessage(t, s, alice.Id, conversation.Id, "hi")
+
+	for i := 0; i < 2; i++ {
+		reacted, err := s.AddReaction(ctx, message.Id, bob.Id, "👍")
+		if err != nil || len(reacted.Reactions[bob.Id.Hex()]) != 1 {
+			t.Fatalf("AddReaction = %+v, %v", reacted.Reactions, err)
+		}
+	}
+	reacted, err := s.AddReaction(ctx, message.Id, bob.Id, "🎉")
+	if err != nil || len(reacted.Reactions[bob.Id.Hex()]) != 2 {
+		t.Fatalf("second emoji = %+v, %v", reacted.Reactions, err)
+	}
+	for _, emoji := range []string{"👍", "🎉"} {
+		if reacted, err = s.RemoveReaction(ctx, message.Id, bob.Id, emoji); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(reacted.Reactions) != 0 {
+		t.Fatalf("reactions left = %+v", reacted.Reactions)
+	}
+	if _, err = s.AddReaction(ctx, primitive.NewObjectID(), bob.Id, "👍"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("AddReaction to a missing message = %v, want ErrNotFound", err)
+	}
+}
+
+func testReceipts(t *testing.T, s Store) {
+	ctx := context.Background()
+	alice := newUser(t, s, "alice")
+	bob := newUser(t, s, "bob")
+	conversation, err := s.EnsureDirectConversation(ctx, alice.Id, bob.Id, now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := saveMessage(t, s, alice.Id, conversation.Id, "one")
+	second := saveMessage(t, s, alice.Id, conversation.Id, "two")
+	saveMessage(t, s, bob.Id, conversation.Id, "own")
+
+	at := now()
+	if changed, err := s.MarkDelivered(ctx, bob.Id, conversation.Id, first.Id, at); err != nil || changed != 1 {
+		t.Fatalf("MarkDelivered = %d, %v", changed, err)
+	}
+	// Reading implies delivery, own messages are never marked
+	if changed, err := s.MarkRead(ctx, bob.Id, conversation.Id, second.Id, at); err != nil || changed != 2 {
+		t.Fatalf("MarkRead = %d, %v", changed, err)
+	}
+	if changed, err := s.MarkRead(ctx, bob.Id, conversation.Id, second.Id, at); err != nil || changed != 0 {
+		t.Fatalf("MarkRead again = %d, %v", changed, err)
+	}
+	message, err := s.GetMessage(ctx, second.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receipt := message.Receipts[bob.Id.Hex()]
+	if receipt.DeliveredAt == nil || receipt.ReadAt == nil || !receipt.ReadAt.Equal(at) {
+		t.Fatalf("receipt = %+v", receipt)
+	}
+}
+
+func testGroups(t *testing.T, s Store) {
+	ctx := context.Background()
+	alice := newUser(t, s, "alice")
+	bob := newUser(t, s, "bob")
+	carol := newUser(t, s, "carol")
+
+	created := now()
+	group := &Conversation{
+		Id:        primitive.NewObjectID(),
+		Type:      ConversationGroup,
+		Name:      "friends",
+		Members:   []primitive.ObjectID{alice.Id, bob.Id},
+		Admins:    []primitive.ObjectID{alice.Id},
+		CreatedBy: alice.Id,
+		CreatedAt: created,
+		UpdatedAt: created,
+	}
+	if err := s.CreateConversation(ctx, group); err != nil {
+		t.Fatal(err)
+	}
+	if summary := summaryOf(t, s, bob.Id, group.Id); summary == nil || summary.Name != "friends" || summary.Type != ConversationGroup {
+		t.Fatalf("member's summary = %+v", summary)
+	}
+	message := saveMessage(t, s, alice.Id, group.Id, "welcome")
+
+	updated, err := s.AddMembers(ctx, group.Id, []primitive.ObjectID{carol.Id}, now())
+	if err != nil || len(updated.Members) != 3 {
+		t.Fatalf("AddMembers = %+v, %v", updated, err)
+	}
+	// New members see the conversation as it is, nothing unread
+	summary := summaryOf(t, s, carol.Id, group.Id)
+	if summary == nil || summary.LastMessage == nil || summary.LastMessage.Id != message.Id || summary.UnreadCount != 0 {
+		t.Fatalf("new member's summary = %+v", summary)
+	}
+
+	if updated, err = s.SetAdmin(ctx, group.Id, carol.Id, true, now()); err != nil || len(updated.Admins) != 2 {
+		t.Fatalf("SetAdmin = %+v, %v", updated, err)
+	}
+	if updated, err = s.RemoveMember(ctx, group.Id, carol.Id, now()); err != nil || len(updated.Members) != 2 || len(updated.Admins) != 1 {
+		t.Fatalf("RemoveMember = %+v, %v", updated, err)
+	}
+	if summary := summaryOf(t, s, carol.Id, group.Id); summary != nil {
+		t.Fatalf("removed member kept their summary: %+v", summary)
+	}
+
+	if updated, err = s.RenameConversation(ctx, group.Id, "family", now()); err != nil || updated.Name != "family" {
+		t.Fatalf("RenameConversation = %+v, %v", updated, err)
+	}
+	if summary := summaryOf(t, s, bob.Id, group.Id); summary.Name != "family" {
+		t.Fatalf("summary after renaming = %+v", summary)
+	}
+
+	retention := &RetentionSetting{Policy: "24h", Disappearing: true, SetBy: bob.Id, SetAt: now()}
+	if updated, err = s.SetRetention(ctx, group.Id, retention, now()); err != nil || updated.Retention == nil || updated.Retention.Policy != "24h" {
+		t.Fatalf("SetRetention = %+v, %v", updated, err)
+	}
+	if summary := summaryOf(t, s, alice.Id, group.Id); summary.Retention == nil || !summary.Retention.Disappearing {
+		t.Fatalf("summary after setting the retention = %+v", summary)
+	}
+	if updated, err = s.SetRetention(ctx, group.Id, nil, now()); err != nil || updated.Retention != nil {
+		t.Fatalf("SetRetention back to the default = %+v, %v", updated, err)
+	}
+	if summary := summaryOf(t, s, alice.Id, group.Id); summary.Retention != nil {
+		t.Fatalf("summary after resetting the retention = %+v", summary)
+	}
+
+	conversations, err := s.GetConversations(ctx, bob.Id)
+	if err != nil || len(conversations) != 1 || conversations[0].Id != group.Id {
+		t.Fatalf("GetConversations = %+v, %v", conversations, err)
+	}
+	if _, err = s.RenameConversation(ctx, primitive.NewObjectID(), "x", now()); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("RenameConversation of a missing group = %v, want ErrNotFound", err)
+	}
+}
+
+func testAttachments(t *testing.T, s Store) {
+	ctx := context.Background()
+	alice := newUser(t, s, "alice")
+	bob := newUser(t, s, "bob")
+	conversation, err := s.EnsureDirectConversation(ctx, alice.Id, bob.Id, now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload := func(by primitive.ObjectID, createdAt time.Time) *Attachment {
+		attachment := &Attachment{
+			Id:             primitive.NewObjectID(),
+			ConversationId: conversation.Id,
+			UploadedBy:     by,
+			MimeType:       "text/plain",
+			Size:           1,
+			Key:            conversation.Id.Hex() + "/" + primitive.NewObjectID().Hex(),
+			CreatedAt:      createdAt,
+		}
+		if err := s.SaveAttachment(ctx, attachment); err != nil {
+			t.Fatal(err)
+		}
+		return attachment
+	}
+	first := upload(alice.Id, now())
+	second := upload(alice.Id, now())
+	bobs := upload(bob.Id, now())
+	stale := upload(alice.Id, now().Add(-48*time.Hour))
+
+	expireAt := now().Add(time.Hour)
+	message := &Message{Id: primitive.NewObjectID(), From: alice.Id, ConversationId: conversation.Id, ExpireAt: &expireAt}
+	// Someone else's upload fails the whole claim
+	if _, err = s.ClaimAttachments(ctx, []primitive.ObjectID{first.Id, bobs.Id}, message); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("claiming another user's upload = %v, want ErrNotFound", err)
+	}
+	if attachment, err := s.GetAttachment(ctx, first.Id); err != nil || attachment.MessageId != nil {
+		t.Fatalf("failed claim left %+v, %v", attachment, err)
+	}
+
+	claimed, err := s.ClaimAttachments(ctx, []primitive.ObjectID{second.Id, first.Id}, message)
+	if err != nil || len(claimed) != 2 || claimed[0].Id != second.Id || claimed[1].Id != first.Id {
+		t.Fatalf("ClaimAttachments = %+v, %v", claimed, err)
+	}
+	if claimed[0].MessageId == nil || *claimed[0].MessageId != message.Id || claimed[0].ExpireAt == nil || !claimed[0].ExpireAt.Equal(expireAt) {
+		t.Fatalf("claimed attachment = %+v", claimed[0])
+	}
+	other := &Message{Id: primitive.NewObjectID(), From: alice.Id, ConversationId: conversation.Id}
+	if _, err = s.ClaimAttachments(ctx, []primitive.ObjectID{first.Id}, other); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("claiming twice = %v, want ErrNotFound", err)
+	}
+
+	if err = s.ReleaseAttachments(ctx, message.Id); err != nil {
+		t.Fatal(err)
+	}
+	if attachment, err := s.GetAttachment(ctx, first.Id); err != nil || attachment.MessageId != nil || attachment.ExpireAt != nil {
+		t.Fatalf("released attachment = %+v, %v", attachment, err)
+	}
+	if _, err = s.ClaimAttachments(ctx, []primitive.ObjectID{first.Id, second.Id}, message); err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := s.DeleteMessageAttachments(ctx, message.Id)
+	if err != nil || len(deleted) != 2 {
+		t.Fatalf("DeleteMessageAttachments = %d, %v", len(deleted), err)
+	}
+	if _, err = s.GetAttachment(ctx, first.Id); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("GetAttachment after deleting = %v, want ErrNotFound", err)
+	}
+
+	// Expired with its message, and uploads nobody sent
+	expired := upload(alice.Id, now())
+	past := now().Add(-time.Minute)
+	gone := &Message{Id: primitive.NewObjectID(), From: alice.Id, ConversationId: conversation.Id, ExpireAt: &past}
+	if _, err = s.ClaimAttachments(ctx, []primitive.ObjectID{expired.Id}, gone); err != nil {
+		t.Fatal(err)
+	}
+	deleted, err = s.DeleteExpiredAttachments(ctx, now(), now().Add(-24*time.Hour), 10)
+	if err != nil || len(deleted) != 2 {
+		t.Fatalf("DeleteExpiredAttachments = %d, %v", len(deleted), err)
+	}
+	for _, id := range []primitive.ObjectID{expired.Id, stale.Id} {
+		if _, err = s.GetAttachment(ctx, id); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expired attachment still there: %v", err)
+		}
+	}
+	if _, err = s.GetAttachment(ctx, bobs.Id); err != nil {
+		t.Fatalf("recent upload swept: %v", err)
+	}
+}
+
+func testEvents(t *testing.T, s Store) {
+	ctx := context.Background()
+	alice := newUser(t, s, "alice")
+	bob := newUser(t, s, "bob")
+
+	var ids []primitive.ObjectID
+	for i := 0; i < 3; i++ {
+		event := &Event{
+			Id:        primitive.NewObjectID(),
+			User:      alice.Id,
+			Type:      "message",
+			Timestamp: now().UnixMilli(),
+			Payload:   []byte(`{}`),
+			ExpireAt:  now().Add(time.Hour),
+		}
+		if err := s.AppendEvent(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, event.Id)
+	}
+	other := &Event{Id: primitive.NewObjectID(), User: bob.Id, Type: "message", ExpireAt: now().Add(time.Hour)}
+	if err := s.AppendEvent(ctx, other); err != nil {
+		t.Fatal(err)
+	}
+
+	eventIds := func(events []Event) []primitive.ObjectID {
+		result := make([]primitive.ObjectID, len(events))
+		for i, event := range events {
+			result[i] = event.Id
+		}
+		return result
+	}
+	events, err := s.GetEvents(ctx, alice.Id, 0, 2)
+	if err != nil || !sameIds(eventIds(events), ids[0], ids[1]) {
+		t.Fatalf("GetEvents = %v, %v", eventIds(events), err)
+	}
+	if events[0].Seq != 1 || events[1].Seq != 2 || other.Seq != 1 {
+		t.Fatalf("sequence numbers %d, %d and bob's %d, want 1, 2 and 1", events[0].Seq, events[1].Seq, other.Seq)
+	}
+	events, err = s.GetEvents(ctx, alice.Id, events[1].Seq, 10)
+	if err != nil || !sameIds(eventIds(events), ids[2]) {
+		t.Fatalf("GetEvents after the second = %v, %v", eventIds(events), err)
+	}
+	if seq, err := s.EventSeqAt(ctx, alice.Id, ids[1]); err != nil || seq != 2 {
+		t.Fatalf("EventSeqAt the second = %d, %v, want 2", seq, err)
+	}
+	if seq, err := s.EventSeqAt(ctx, alice.Id, primitive.NilObjectID); err != nil || seq != 0 {
+		t.Fatalf("EventSeqAt before the first = %d, %v, want 0", seq, err)
+	}
+
+	// Concurrent writers get distinct numbers following the last one, the
+	// log is read in the order they were assigned
+	var wg sync.WaitGroup
+	seqs := make(chan int64, 8)
+	for i := 0; i < cap(seqs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			event := &Event{Id: primitive.NewObjectID(), User: alice.Id, Type: "message", ExpireAt: now().Add(time.Hour)}
+			if err := s.AppendEvent(ctx, event); err != nil {
+				t.Error(err)
+			}
+			seqs <- event.Seq
+		}()
+	}
+	wg.Wait()
+	close(seqs)
+	seen := make(map[int64]bool)
+	for seq := range seqs {
+		if seq <= 3 || seq > 3+int64(cap(seqs)) || seen[seq] {
+			t.Fatalf("concurrent append got sequence number %d", seq)
+		}
+		seen[seq] = true
+	}
+	events, err = s.GetEvents(ctx, alice.Id, 3, 0)
+	if err != nil || len(events) != cap(seqs) {
+		t.Fatalf("GetEvents after the concurrent appends = %d events, %v", len(events), err)
+	}
+	for i, event := range events {
+		if event.Seq != int64(4+i) {
+			t.Fatalf("event %d has sequence number %d", i, event.Seq)
+		}
+	}
+}
+
+func testExpiry(t *testing.T, s Store) {
+	ctx := context.Background()
+	alice := newUser(t, s, "alice")
+	bob := newUser(t, s, "bob")
+	conversation, err := s.EnsureDirectConversation(ctx, alice.Id, bob.Id, now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := saveMessage(t, s, alice.Id, conversation.Id, "kept")
+	expired := now().Add(-time.Minute)
+	for _, text := range []string{"expired", "expired too"} {
+		message := &Message{
+			Id:             primitive.NewObjectID(),
+			Message:        text,
+			From:           alice.Id,
+			ConversationId: conversation.Id,
+			CreatedAt:      now(),
+			ExpireAt:       &expired,
+		}
+		if err = s.SaveMessage(ctx, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := s.(MessageSweeper).DeleteExpiredMessages(ctx, now())
+	if err != nil || removed != 2 {
+		t.Fatalf("DeleteExpiredMessages = %d, %v, want 2", removed, err)
+	}
+	if conversation, err = s.GetConversation(ctx, conversation.Id); err != nil || conversation.LastMessage == nil || conversation.LastMessage.Id != kept.Id {
+		t.Fatalf("conversation after the sweep = %+v, %v", conversation, err)
+	}
+	for _, user := range []primitive.ObjectID{alice.Id, bob.Id} {
+		if summary := summaryOf(t, s, user, conversation.Id); summary == nil || summary.LastMessage == nil || summary.LastMessage.Id != kept.Id {
+			t.Fatalf("summary after the sweep = %+v", summary)
+		}
+	}
+	if summary := summaryOf(t, s, bob.Id, conversation.Id); summary.UnreadCount != 1 {
+		t.Fatalf("bob has %d unread, want 1", summary.UnreadCount)
+	}
+	if removed, err = s.(MessageSweeper).DeleteExpiredMessages(ctx, now()); err != nil || removed != 0 {
+		t.Fatalf("second sweep = %d, %v, want nothing", removed, err)
+	}
+
+	// A retention shortened to an hour drops the conversation's older events
+	other := primitive.NewObjectID()
+	at := now()
+	events := []*Event{
+		{Id: primitive.NewObjectID(), User: bob.Id, Type: "message", Timestamp: at.Add(-2 * time.Hour).UnixMilli(), ConversationId: conversation.Id},
+		{Id: primitive.NewObjectID(), User: bob.Id, Type: "message", Timestamp: at.Add(-time.Minute).UnixMilli(), ConversationId: conversation.Id},
+		{Id: primitive.NewObjectID(), User: bob.Id, Type: "message", Timestamp: at.Add(-2 * time.Hour).UnixMilli(), ConversationId: other},
+		{Id: primitive.NewObjectID(), User: bob.Id, Type: "request-received", Timestamp: at.Add(-2 * time.Hour).UnixMilli()},
+	}
+	for _, event := range events {
+		event.ExpireAt = at.Add(24 * time.Hour)
+		if err = s.AppendEvent(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if removed, err = s.ShortenConversationEvents(ctx, conversation.Id, time.Hour, at); err != nil || removed != 1 {
+		t.Fatalf("ShortenConversationEvents = %d, %v, want 1", removed, err)
+	}
+	stored, err := s.GetEvents(ctx, bob.Id, 0, 0)
+	if err != nil || len(stored) != 3 {
+		t.Fatalf("events left = %d, %v, want 3", len(stored), err)
+	}
+	for _, event := range stored {
+		want := at.Add(24 * time.Hour)
+		if event.ConversationId == conversation.Id {
+			want = at.Add(-time.Minute + time.Hour)
+		}
+		if !event.ExpireAt.Equal(want) {
+			t.Fatalf("%s event expires at %v, want %v", event.Type, event.ExpireAt, want)
+		}
+	}
+}
+
+func testSearch(t *testing.T, s Store) {
+	ctx := context.Background()
+	alice := newUser(t, s, "alice")
+	bob := newUser(t, s, "bob")
+	conversation, err := s.EnsureDirectConversation(ctx, alice.Id, bob.Id, now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lunch := saveMessage(t, s, alice.Id, conversation.Id, "Lunch at noon tomorrow?")
+	saveMessage(t, s, bob.Id, conversation.Id, "Tomorrow works")
+	hidden := saveMessage(t, s, alice.Id, conversation.Id, "lunch plans changed")
+	if err = s.HideMessage(ctx, hidden.Id, bob.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	query := SearchQuery{Me: bob.Id, Conversations: []primitive.ObjectID{conversation.Id}, Words: []string{"lun"}, Limit: 10}
+	messages, err := s.SearchMessages(ctx, query)
+	if err != nil || !sameIds(messageIds(messages), lunch.Id) {
+		t.Fatalf("SearchMessages by prefix = %v, %v", messageIds(messages), err)
+	}
+	query.Words = nil
+	query.Phrases = [][]string{{"noon", "tomorrow"}}
+	messages, err = s.SearchMessages(ctx, query)
+	if err != nil || !sameIds(messageIds(messages), lunch.Id) {
+		t.Fatalf("SearchMessages by phrase = %v, %v", messageIds(messages), err)
+	}
+}
@@ -0,0 +1,177 @@
+package image_processing
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+)
+
+var (
+	ErrUnsupported = errors.New("unsupported image type")
+	ErrTooLarge    = errors.New("image too large")
+)
+
+// Larger images aren't decoded, they'd take too much memory
+const maxPixels = 25_000_000
+
+const (
+	thumbnailSize = 320
+	previewSize   = 1280
+	blurhashSize  = 32
+	jpegQuality   = 80
+	// Of uploads re-encoded to remove their metadata, kept at full size
+	cleanedQuality = 90
+)
+
+// Smaller copy of an uploaded image
+type Variant struct {
+	Name     string
+	MimeType string
+	Width    int
+	Height   int
+	Data     []byte
+}
+
+type Result struct {
+	// The upload without its location metadata, nil when it had none
+	Cleaned []byte
+	// As displayed, after applying the EXIF orientation
+	Width    int
+	Height   int
+	Blurhash string
+	// Always a thumbnail, and a preview for images larger than one
+	Variants []Variant
+}
+
+type decoder struct {
+	decode       func(data []byte) (image.Image, error)
+	decodeConfig func(data []byte) (image.Config, error)
+}
+
+var decoders = map[string]decoder{
+	"image/jpeg": {
+		func(data []byte) (image.Image, error) { return jpeg.Decode(bytes.NewReader(data)) },
+		func(data []byte) (image.Config, error) { return jpeg.DecodeConfig(bytes.NewReader(data)) },
+	},
+	"image/png": {
+		func(data []byte) (image.Image, error) { return png.Decode(bytes.NewReader(data)) },
+		func(data []byte) (image.Config, error) { return png.DecodeConfig(bytes.NewReader(data)) },
+	},
+	// Only the first frame of animations
+	"image/gif": {
+		func(data []byte) (image.Image, error) { return gif.Decode(bytes.NewReader(data)) },
+		func(data []byte) (image.Config, error) { return gif.DecodeConfig(bytes.NewReader(data)) },
+	},
+}
+
+// Whether Process handles the type, other images are kept as uploaded
+func Supported(mimeType string) bool {
+	_, ok := decoders[mimeType]
+	return ok
+}
+
+// Strips the location from an uploaded image and makes its variants and
+// placeholder
+func Process(data []byte, mimeType string) (*Result, error) {
+	decoder, ok := decoders[mimeType]
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	config, err := decoder.decodeConfig(data)
+	if err != nil {
+		return nil, err
+	}
+	if int64(config.Width)*int64(config.Height) > maxPixels {
+		return nil, ErrTooLarge
+	}
+
+	result := &Result{}
+	orientation := 1
+	parsed := true
+	switch mimeType {
+	case "image/jpeg":
+		result.Cleaned, orientation, parsed = cleanJPEG(data)
+	case "image/png":
+		result.Cleaned, parsed = cleanPNG(data)
+	}
+	img, err := decoder.decode(data)
+	if err != nil {
+		return nil, err
+	}
+	source := toRGBA(img)
+	// Only the pixels are kept when the metadata couldn't all be found,
+	// turned upright since the orientation goes with the rest
+	if !parsed {
+		if result.Cleaned, err = encode(mimeType, orient(source, orientation), cleanedQuality); err != nil {
+			return nil, err
+		}
+	}
+	result.Width, result.Height = source.Rect.Dx(), source.Rect.Dy()
+	if orientation >= 5 {
+		result.Width, result.Height = result.Height, result.Width
+	}
+
+	// Each size is scaled down from the previous one, in the original
+	// orientation, and turned upright last
+	variantType := "image/png"
+	if mimeType == "image/jpeg" {
+		variantType = "image/jpeg"
+	}
+	if source.Rect.Dx() > previewSize || source.Rect.Dy() > previewSize {
+		source = shrink(source, previewSize)
+		variant, err := newVariant("preview", variantType, orient(source, orientation))
+		if err != nil {
+			return nil, err
+		}
+		result.Variants = append(result.Variants, *variant)
+	}
+	source = shrink(source, thumbnailSize)
+	variant, err := newVariant("thumbnail", variantType, orient(source, orientation))
+	if err != nil {
+		return nil, err
+	}
+	result.Variants = append(result.Variants, *variant)
+
+	small := orient(shrink(source, blurhashSize), orientation)
+	if small.Rect.Dx() >= small.Rect.Dy() {
+		result.Blurhash = blurhash(small, 4, 3)
+	} else {
+		result.Blurhash = blurhash(small, 3, 4)
+	}
+	return result, nil
+}
+
+// Scaled down copy of the image fitting in a box of side bound
+func shrink(img *image.RGBA, bound int) *image.RGBA {
+	width, height := fit(img.Rect.Dx(), img.Rect.Dy(), bound)
+	return resize(img, width, height)
+}
+
+// JPEG at the given quality or PNG
+func encode(mimeType string, img *image.RGBA, quality int) ([]byte, error) {
+	var data bytes.Buffer
+	var err error
+	if mimeType == "image/jpeg" {
+		err = jpeg.Encode(&data, img, &jpeg.Options{Quality: quality})
+	} else {
+		err = png.Encode(&data, img)
+	}
+	return data.Bytes(), err
+}
+
+func newVariant(name string, mimeType string, img *image.RGBA) (*Variant, error) {
+	data, err := encode(mimeType, img, jpegQuality)
+	if err != nil {
+		return nil, err
+	}
+	return &Variant{
+		Name:     name,
+		MimeType: mimeType,
+		Width:    img.Rect.Dx(),
+		Height:   img.Rect.Dy(),
+		Data:     data,
+	}, nil
+}
@@ -0,0 +1,194 @@
+package image_processing
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const (
+	tagOrientation = 0x0112
+	tagGPSInfo     = 0x8825
+)
+
+var (
+	exifHeader = []byte("Exif\x00\x00")
+	xmpHeader  = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	pngHeader  = []byte("\x89PNG\r\n\x1a\n")
+)
+
+// Bytes taken by one value of each TIFF field type
+var tiffTypeSizes = map[uint16]uint32{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+// TIFF structure inside an EXIF segment, every read is bounds checked since
+// it comes straight from the upload
+type tiff struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+func parseTiff(data []byte) (*tiff, bool) {
+	if len(data) < 8 {
+		return nil, false
+	}
+	var order binary.ByteOrder
+	switch string(data[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, false
+	}
+	if order.Uint16(data[2:]) != 42 {
+		return nil, false
+	}
+	return &tiff{data, order}, true
+}
+
+// Offsets of the entries of the directory at offset, nil when it's out of bounds
+func (t *tiff) entries(offset uint32) []uint32 {
+	if uint64(offset)+2 > uint64(len(t.data)) {
+		return nil
+	}
+	count := uint32(t.order.Uint16(t.data[offset:]))
+	if uint64(offset)+2+uint64(count)*12 > uint64(len(t.data)) {
+		return nil
+	}
+	entries := make([]uint32, count)
+	for i := range entries {
+		entries[i] = offset + 2 + uint32(i)*12
+	}
+	return entries
+}
+
+// Reads the orientation and blanks the GPS directory: its values are zeroed
+// and its entry count set to 0, every other offset stays valid
+func (t *tiff) stripLocation() (orientation int, stripped bool) {
+	orientation = 1
+	for _, entry := range t.entries(t.order.Uint32(t.data[4:])) {
+		switch t.order.Uint16(t.data[entry:]) {
+		case tagOrientation:
+			if value := int(t.order.Uint16(t.data[entry+8:])); value >= 1 && value <= 8 {
+				orientation = value
+			}
+		case tagGPSInfo:
+			gps := t.order.Uint32(t.data[entry+8:])
+			entries := t.entries(gps)
+			for _, field := range entries {
+				// In 64 bits, a forged count can't wrap around to a small size
+				size := uint64(tiffTypeSizes[t.order.Uint16(t.data[field+2:])]) * uint64(t.order.Uint32(t.data[field+4:]))
+				if size > 4 {
+					value := uint64(t.order.Uint32(t.data[field+8:]))
+					if value+size <= uint64(len(t.data)) {
+						zero(t.data[value : value+size])
+					}
+				}
+				zero(t.data[field : field+12])
+			}
+			if len(entries) > 0 {
+				t.order.PutUint16(t.data[gps:], 0)
+				stripped = true
+			}
+		}
+	}
+	return orientation, stripped
+}
+
+func zero(data []byte) {
+	for i := range data {
+		data[i] = 0
+	}
+}
+
+// Removes the location from a JPEG without re-encoding it: the EXIF GPS
+// directory is blanked and XMP packets, which may repeat it, are dropped.
+// Also returns the EXIF orientation, 1 when there is none. The result is nil
+// when nothing changed. parsed is false when the segments couldn't be
+// followed up to the image data, metadata could be anywhere after that point
+// and only re-encoding gets rid of it.
+func cleanJPEG(data []byte) (cleaned []byte, orientation int, parsed bool) {
+	orientation = 1
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, orientation, false
+	}
+	var out bytes.Buffer
+	out.Write(data[:2])
+	changed := false
+	position := 2
+	for position+4 <= len(data) {
+		if data[position] != 0xFF {
+			return nil, orientation, false
+		}
+		marker := data[position+1]
+		// Markers may be preceded by fill bytes
+		if marker == 0xFF {
+			position++
+			continue
+		}
+		// Start of scan, the rest is image data
+		if marker == 0xDA {
+			parsed = true
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[position+2:]))
+		end := position + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, orientation, false
+		}
+		segment := data[position:end]
+		payload := segment[4:]
+		if marker == 0xE1 && bytes.HasPrefix(payload, xmpHeader) {
+			changed = true
+			position = end
+			continue
+		}
+		if marker == 0xE1 && bytes.HasPrefix(payload, exifHeader) {
+			segment = append([]byte(nil), segment...)
+			if t, ok := parseTiff(segment[4+len(exifHeader):]); ok {
+				var stripped bool
+				orientation, stripped = t.stripLocation()
+				changed = changed || stripped
+			}
+		}
+		out.Write(segment)
+		position = end
+	}
+	if !parsed || !changed {
+		return nil, orientation, parsed
+	}
+	out.Write(data[position:])
+	return out.Bytes(), orientation, true
+}
+
+// Drops the EXIF and XMP chunks of a PNG, nil when there were none. parsed
+// is false when the chunks couldn't be followed to the end, like cleanJPEG.
+func cleanPNG(data []byte) (cleaned []byte, parsed bool) {
+	if !bytes.HasPrefix(data, pngHeader) {
+		return nil, false
+	}
+	var out bytes.Buffer
+	out.Write(pngHeader)
+	changed := false
+	position := len(pngHeader)
+	for position+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[position:]))
+		end := position + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, false
+		}
+		kind := string(data[position+4 : position+8])
+		if kind == "eXIf" || (kind == "iTXt" && bytes.HasPrefix(data[position+8:end], []byte("XML:com.adobe.xmp\x00"))) {
+			changed = true
+		} else {
+			out.Write(data[position:end])
+		}
+		position = end
+	}
+	if !changed {
+		return nil, true
+	}
+	out.Write(data[position:])
+	return out.Bytes(), true
+}
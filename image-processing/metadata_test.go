@@ -0,0 +1,181 @@
+package image_processing
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// Repeated by the XMP packet of the fixtures, gone once cleaned
+const xmpLocation = "<exif:GPSLatitude>48,51.5N</exif:GPSLatitude>"
+
+// Latitude rational values of the GPS directory, 48/1 51/1 30/1
+var gpsLatitude = []byte{0, 0, 0, 48, 0, 0, 0, 1, 0, 0, 0, 51, 0, 0, 0, 1, 0, 0, 0, 30, 0, 0, 0, 1}
+
+// Big endian TIFF with an orientation and a GPS directory holding a latitude
+// and an entry whose forged count wraps around in 32 bits
+func gpsTiff(orientation uint16) []byte {
+	var data bytes.Buffer
+	write := func(values ...interface{}) {
+		for _, value := range values {
+			binary.Write(&data, binary.BigEndian, value)
+		}
+	}
+	write([]byte("MM"), uint16(42), uint32(8))
+	// IFD0 at 8, 30 bytes
+	write(uint16(2))
+	write(uint16(tagOrientation), uint16(3), uint32(1), orientation, uint16(0))
+	write(uint16(tagGPSInfo), uint16(4), uint32(1), uint32(38))
+	write(uint32(0))
+	// GPS directory at 38, 42 bytes, the latitude follows it at 80
+	write(uint16(3))
+	write(uint16(1), uint16(2), uint32(2), []byte("N\x00\x00\x00"))
+	write(uint16(2), uint16(5), uint32(3), uint32(80))
+	write(uint16(3), uint16(12), uint32(0x20000001), uint32(0))
+	write(uint32(0))
+	data.Write(gpsLatitude)
+	return data.Bytes()
+}
+
+func testImage() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 16; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 16), uint8(y * 32), 128, 255})
+		}
+	}
+	return img
+}
+
+func jpegSegment(marker byte, payload []byte) []byte {
+	segment := []byte{0xFF, marker, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+// JPEG taken with the camera turned, orientation 6, with its location in
+// EXIF and XMP. extra goes between the two segments.
+func gpsJPEG(t *testing.T, extra []byte) []byte {
+	t.Helper()
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	data := append([]byte(nil), encoded.Bytes()[:2]...)
+	data = append(data, jpegSegment(0xE1, append(append([]byte(nil), exifHeader...), gpsTiff(6)...))...)
+	data = append(data, extra...)
+	data = append(data, jpegSegment(0xE1, append(append([]byte(nil), xmpHeader...), xmpLocation...))...)
+	return append(data, encoded.Bytes()[2:]...)
+}
+
+func pngChunk(kind string, payload []byte) []byte {
+	chunk := make([]byte, 8, 12+len(payload))
+	binary.BigEndian.PutUint32(chunk, uint32(len(payload)))
+	copy(chunk[4:], kind)
+	chunk = append(chunk, payload...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+// PNG with its location in an eXIf and an XMP iTXt chunk, after IHDR.
+// trailer is appended after IEND.
+func gpsPNG(t *testing.T, trailer []byte) []byte {
+	t.Helper()
+	var encoded bytes.Buffer
+	if err := png.Encode(&encoded, testImage()); err != nil {
+		t.Fatal(err)
+	}
+	// Signature and the 25 bytes of IHDR
+	headerEnd := len(pngHeader) + 25
+	data := append([]byte(nil), encoded.Bytes()[:headerEnd]...)
+	data = append(data, pngChunk("eXIf", gpsTiff(1))...)
+	data = append(data, pngChunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00"+xmpLocation))...)
+	data = append(data, encoded.Bytes()[headerEnd:]...)
+	return append(data, trailer...)
+}
+
+func TestProcessJPEGWithLocation(t *testing.T) {
+	data := gpsJPEG(t, nil)
+	result, err := Process(data, "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Cleaned == nil {
+		t.Fatal("location left in place")
+	}
+	if bytes.Contains(result.Cleaned, []byte(xmpLocation)) || bytes.Contains(result.Cleaned, gpsLatitude) {
+		t.Fatal("cleaned JPEG still has the location")
+	}
+	// The TIFF header survived the forged count, the orientation is kept
+	if _, orientation, parsed := cleanJPEG(result.Cleaned); !parsed || orientation != 6 {
+		t.Fatalf("cleaned JPEG has orientation %d, parsed %v", orientation, parsed)
+	}
+	if _, err = jpeg.Decode(bytes.NewReader(result.Cleaned)); err != nil {
+		t.Fatalf("cleaned JPEG doesn't decode: %v", err)
+	}
+	if result.Width != 8 || result.Height != 16 {
+		t.Fatalf("size %dx%d, want it turned to 8x16", result.Width, result.Height)
+	}
+}
+
+// A byte out of place between the segments hides the XMP packet from the
+// parser, the image is re-encoded instead
+func TestProcessJPEGReencoded(t *testing.T) {
+	data := gpsJPEG(t, []byte{0x00})
+	result, err := Process(data, "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Cleaned == nil || bytes.Contains(result.Cleaned, []byte(xmpLocation)) || bytes.Contains(result.Cleaned, gpsLatitude) {
+		t.Fatal("location left in the JPEG")
+	}
+	img, err := jpeg.Decode(bytes.NewReader(result.Cleaned))
+	if err != nil {
+		t.Fatalf("re-encoded JPEG doesn't decode: %v", err)
+	}
+	if size := img.Bounds().Size(); size.X != 8 || size.Y != 16 {
+		t.Fatalf("re-encoded JPEG is %v, want it upright at 8x16", size)
+	}
+}
+
+func TestProcessPNGWithLocation(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		trailer []byte
+	}{
+		{"chunks", nil},
+		// The truncated chunk stops the parser, the image is re-encoded
+		{"truncated chunk", pngChunk("tEXt", []byte("Comment\x00after the end"))[:20]},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := Process(gpsPNG(t, test.trailer), "image/png")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Cleaned == nil || bytes.Contains(result.Cleaned, []byte(xmpLocation)) || bytes.Contains(result.Cleaned, gpsLatitude) {
+				t.Fatal("location left in the PNG")
+			}
+			if bytes.Contains(result.Cleaned, []byte("eXIf")) {
+				t.Fatal("cleaned PNG still has its EXIF chunk")
+			}
+			if _, err = png.Decode(bytes.NewReader(result.Cleaned)); err != nil {
+				t.Fatalf("cleaned PNG doesn't decode: %v", err)
+			}
+		})
+	}
+}
+
+func TestProcessWithoutLocation(t *testing.T) {
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	result, err := Process(encoded.Bytes(), "image/jpeg")
+	if err != nil || result.Cleaned != nil {
+		t.Fatalf("Process = %v, cleaned %d bytes, want the upload kept", err, len(result.Cleaned))
+	}
+}